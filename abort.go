@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/JessonChan/longcat-web-api/logging"
+)
+
+// errStreamAborted cancels a stream its client aborted by response ID
+var errStreamAborted = errors.New("aborted by the client")
+
+// abortableStreams tracks running streams by response ID, for clients that
+// cannot cancel by closing the connection because it is pooled
+type abortableStreams struct {
+	mu      sync.Mutex
+	streams map[string]abortableStream
+}
+
+type abortableStream struct {
+	key    string // queueKey of the client that started the stream
+	cancel context.CancelCauseFunc
+}
+
+func newAbortableStreams() *abortableStreams {
+	return &abortableStreams{streams: make(map[string]abortableStream)}
+}
+
+// track records cancel as the way to abort responseID on behalf of key. The
+// returned function must be called when the stream ends.
+func (s *abortableStreams) track(responseID, key string, cancel context.CancelCauseFunc) func() {
+	s.mu.Lock()
+	s.streams[responseID] = abortableStream{key: key, cancel: cancel}
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.streams, responseID)
+	}
+}
+
+// abort cancels responseID if it is running and was started by key
+func (s *abortableStreams) abort(responseID, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stream, exists := s.streams[responseID]
+	if !exists || stream.key != key {
+		return false
+	}
+	stream.cancel(errStreamAborted)
+	delete(s.streams, responseID)
+	return true
+}
+
+// aborted reports whether ctx was cancelled by an abort request
+func aborted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errStreamAborted)
+}
+
+// AbortStreamResponse is returned by DELETE /v1/chat/completions/{id} and
+// DELETE /v1/messages/{id}
+type AbortStreamResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Aborted bool   `json:"aborted"`
+}
+
+// handleAbortStream serves DELETE /v1/chat/completions/{id} and
+// DELETE /v1/messages/{id}, cancelling the in-flight stream with that
+// response ID and its LongCat request. Only the API key that started a
+// stream can abort it, so clients without a key from API_KEYS, who all share
+// one identity, cannot abort streams at all.
+func (h *UnifiedHandler) handleAbortStream(w http.ResponseWriter, r *http.Request, endpoint string) {
+	responseID := strings.TrimPrefix(r.URL.Path, endpoint+"/")
+	if responseID == "" || strings.Contains(responseID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := queueKey(r)
+	if key == anonymousClient {
+		writeAPIError(w, endpoint, http.StatusUnauthorized, "invalid_api_key", "Aborting a stream requires an API key listed in API_KEYS")
+		return
+	}
+	if !h.aborts.abort(responseID, key) {
+		writeAPIError(w, endpoint, http.StatusNotFound, "not_found", "No in-flight stream with ID "+responseID)
+		return
+	}
+	logging.LogInfo("Stream %s aborted by the client", responseID)
+
+	object := "chat.completion.aborted"
+	if endpoint == "/v1/messages" {
+		object = "message.aborted"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AbortStreamResponse{ID: responseID, Object: object, Aborted: true})
+}
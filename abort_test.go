@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+func TestAbortStreamOwner(t *testing.T) {
+	tests := []struct {
+		name        string
+		apiKeys     []string
+		owner       string
+		key         string
+		wantStatus  int
+		wantAborted bool
+	}{
+		{"owner aborts", []string{"sk-owner", "sk-other"}, "sk-owner", "sk-owner", http.StatusOK, true},
+		{"other key", []string{"sk-owner", "sk-other"}, "sk-owner", "sk-other", http.StatusNotFound, false},
+		{"no key", []string{"sk-owner"}, "sk-owner", "", http.StatusUnauthorized, false},
+		{"anonymous owner", nil, "", "", http.StatusUnauthorized, false},
+		{"made-up keys are anonymous", nil, "sk-1", "sk-2", http.StatusUnauthorized, false},
+	}
+	saved := config.AppConfig.APIKeys
+	defer func() { config.AppConfig.APIKeys = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.APIKeys = tt.apiKeys
+			owner := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			owner.Header.Set("x-api-key", tt.owner)
+			h := &UnifiedHandler{aborts: newAbortableStreams()}
+			ctx, cancel := context.WithCancelCause(context.Background())
+			defer cancel(nil)
+			defer h.aborts.track("chatcmpl-1", queueKey(owner), cancel)()
+
+			req := httptest.NewRequest(http.MethodDelete, "/v1/chat/completions/chatcmpl-1", nil)
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			w := httptest.NewRecorder()
+			h.handleAbortStream(w, req, "/v1/chat/completions")
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if aborted(ctx) != tt.wantAborted {
+				t.Fatalf("aborted = %v, want %v", aborted(ctx), tt.wantAborted)
+			}
+		})
+	}
+}
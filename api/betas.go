@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// PromptCachingBeta makes Claude usage report the prompt cache token counts.
+// LongCat has no prompt cache, so both are always zero.
+const PromptCachingBeta = "prompt-caching-2024-07-31"
+
+// SupportedBetas lists the anthropic-beta features that change the response.
+// Others are accepted and ignored.
+var SupportedBetas = []string{PromptCachingBeta}
+
+// ParseBetas returns the features named by the anthropic-beta headers, which
+// may be repeated and hold comma-separated lists, without duplicates
+func ParseBetas(header http.Header) []string {
+	var betas []string
+	seen := make(map[string]bool)
+	for _, value := range header.Values("anthropic-beta") {
+		for _, beta := range strings.Split(value, ",") {
+			beta = strings.TrimSpace(beta)
+			if beta != "" && !seen[beta] {
+				seen[beta] = true
+				betas = append(betas, beta)
+			}
+		}
+	}
+	return betas
+}
+
+type betasKey struct{}
+
+// WithBetas returns a context whose Claude response honours the given
+// anthropic-beta features
+func WithBetas(ctx context.Context, betas []string) context.Context {
+	return context.WithValue(ctx, betasKey{}, betas)
+}
+
+// betaEnabled reports whether ctx carries the anthropic-beta feature
+func betaEnabled(ctx context.Context, beta string) bool {
+	if ctx == nil {
+		return false
+	}
+	betas, _ := ctx.Value(betasKey{}).([]string)
+	for _, b := range betas {
+		if b == beta {
+			return true
+		}
+	}
+	return false
+}
+
+// reportPromptCache adds the prompt cache counts that PromptCachingBeta
+// clients expect to usage
+func (u *ClaudeUsage) reportPromptCache() {
+	created, read := 0, 0
+	u.CacheCreationInputTokens = &created
+	u.CacheReadInputTokens = &read
+}
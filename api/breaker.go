@@ -0,0 +1,133 @@
+package api
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
+)
+
+// ErrCircuitOpen is returned instead of calling LongCat while the circuit
+// breaker is open
+var ErrCircuitOpen = errors.New("LongCat is unavailable after repeated failures; try again later")
+
+// breakerState is the state of the circuit breaker
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Requests go through
+	breakerOpen                         // Requests fail fast until the cool-down ends
+	breakerHalfOpen                     // One probe request tests recovery
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker stops calling LongCat after CIRCUIT_BREAKER_FAILURES
+// consecutive failures. Once CIRCUIT_BREAKER_COOLDOWN_SECONDS have passed a
+// single request is let through; its outcome closes or reopens the breaker.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int // Consecutive failures while closed
+	openedAt time.Time
+	probing  bool // Whether the half-open probe is in flight
+	trips    int64
+}
+
+// BreakerStats describes the circuit breaker for /admin/stats
+type BreakerStats struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Trips               int64      `json:"trips"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+}
+
+func breakerCooldown() time.Duration {
+	return time.Duration(config.AppConfig.BreakerCooldown) * time.Second
+}
+
+// allow reports whether a request may be sent to LongCat
+func (b *circuitBreaker) allow() error {
+	if config.AppConfig.BreakerFailures <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < breakerCooldown() {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		logging.LogInfo("Circuit breaker half-open, probing LongCat")
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record notes the outcome of a request that allow let through
+func (b *circuitBreaker) record(failed bool) {
+	if config.AppConfig.BreakerFailures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.state != breakerClosed {
+			logging.LogInfo("Circuit breaker closed, LongCat recovered")
+		}
+		b.state, b.failures, b.probing = breakerClosed, 0, false
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= config.AppConfig.BreakerFailures {
+		if b.state != breakerOpen {
+			b.trips++
+			logging.LogInfo("Circuit breaker open after %d consecutive failures", b.failures)
+		}
+		b.state, b.openedAt, b.probing = breakerOpen, time.Now(), false
+	}
+}
+
+// forget releases a half-open probe whose outcome says nothing about
+// LongCat, such as one the client cancelled
+func (b *circuitBreaker) forget() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := BreakerStats{State: b.state.String(), ConsecutiveFailures: b.failures, Trips: b.trips}
+	if b.state == breakerOpen {
+		openUntil := b.openedAt.Add(breakerCooldown())
+		stats.OpenUntil = &openUntil
+	}
+	return stats
+}
+
+// BreakerStats reports the state of the client's circuit breaker
+func (c *LongCatClient) BreakerStats() BreakerStats {
+	return c.breaker.stats()
+}
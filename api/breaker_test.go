@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		cooldown  int
+		steps     string // allow, deny (allow fails fast), fail, ok, forget
+		wantState string
+		wantTrips int64
+	}{
+		{"disabled", 0, 60, "allow fail allow fail allow", "closed", 0},
+		{"below threshold", 3, 60, "allow fail allow fail allow", "closed", 0},
+		{"success resets count", 2, 60, "allow fail allow ok allow fail allow", "closed", 0},
+		{"trips at threshold", 2, 60, "allow fail allow fail deny deny", "open", 1},
+		{"probe after cooldown", 1, 0, "allow fail allow", "half-open", 1},
+		{"one probe at a time", 1, 0, "allow fail allow deny", "half-open", 1},
+		{"probe success closes", 1, 0, "allow fail allow ok allow", "closed", 1},
+		{"probe failure reopens", 1, 0, "allow fail allow fail", "open", 2},
+		{"forgotten probe frees the slot", 1, 0, "allow fail allow forget allow", "half-open", 1},
+	}
+	saved := *config.AppConfig
+	t.Cleanup(func() { *config.AppConfig = saved })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.BreakerFailures = tt.failures
+			config.AppConfig.BreakerCooldown = tt.cooldown
+			var b circuitBreaker
+			for i, step := range strings.Fields(tt.steps) {
+				switch step {
+				case "allow", "deny":
+					err := b.allow()
+					if want := step == "deny"; errors.Is(err, ErrCircuitOpen) != want {
+						t.Fatalf("step %d: allow() = %v, want denied %v", i, err, want)
+					}
+				case "fail", "ok":
+					b.record(step == "fail")
+				case "forget":
+					b.forget()
+				}
+			}
+			stats := b.stats()
+			if stats.State != tt.wantState || stats.Trips != tt.wantTrips {
+				t.Fatalf("stats() = %s with %d trips, want %s with %d", stats.State, stats.Trips, tt.wantState, tt.wantTrips)
+			}
+			if (stats.OpenUntil != nil) != (tt.wantState == "open") {
+				t.Fatalf("stats().OpenUntil = %v in state %s", stats.OpenUntil, stats.State)
+			}
+		})
+	}
+}
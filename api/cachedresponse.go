@@ -0,0 +1,43 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// cachedFrameRunes is how much text each replayed frame of a cached answer adds
+const cachedFrameRunes = 24
+
+// CachedResponse builds a LongCat response that replays a stored answer, so
+// it is converted and streamed by ConvertResponse like a live one. ctx
+// stands in for the request context, carrying the response ID and model.
+func CachedResponse(ctx context.Context, content string, usage TokenInfo) *http.Response {
+	var body bytes.Buffer
+	writeFrame := func(frame LongCatResponse) {
+		frame.Choices = []LongCatChoice{{}}
+		data, _ := json.Marshal(frame)
+		fmt.Fprintf(&body, "data: %s\n\n", data)
+	}
+
+	// Frames carry the cumulative content, as LongCat sends it
+	runes := 0
+	for i := range content {
+		if runes > 0 && runes%cachedFrameRunes == 0 {
+			writeFrame(LongCatResponse{Content: content[:i]})
+		}
+		runes++
+	}
+	writeFrame(LongCatResponse{Content: content, ContentStatus: "FINISHED", LastOne: true, TokenInfo: usage})
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       io.NopCloser(&body),
+		Request:    req,
+	}
+}
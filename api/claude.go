@@ -1,23 +1,30 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/JessonChan/longcat-web-api/config"
 	"github.com/JessonChan/longcat-web-api/logging"
 )
 
 // Claude API compatible request structure
 type ClaudeAPIRequest struct {
 	Model     string          `json:"model"`
-	MaxTokens int             `json:"max_tokens"`
+	MaxTokens *int            `json:"max_tokens"`
 	Messages  []ClaudeMessage `json:"messages"`
 	Stream    bool            `json:"stream,omitempty"`
 	System    interface{}     `json:"system,omitempty"` // string or []ClaudeMessageContent
+	// TopK is accepted for compatibility; LongCat has no sampling controls
+	TopK *int `json:"top_k,omitempty"`
+	// ServiceTier is accepted but has no effect: LongCat has a single tier
+	ServiceTier string `json:"service_tier,omitempty"`
+	// N is not part of the Anthropic API, but some adapters send it. It is
+	// handled as on the OpenAI endpoint: 1 is accepted, more is rejected.
+	N *int `json:"n,omitempty"`
 }
 
 type ClaudeMessage struct {
@@ -43,11 +50,24 @@ type ClaudeAPIResponse struct {
 	Container    *ClaudeContainer        `json:"container,omitempty"`
 }
 
-type ClaudeResponseContent struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+// MarshalJSON always emits stop_reason and stop_sequence, as null while
+// unset, since Anthropic's message shape includes both
+func (r ClaudeAPIResponse) MarshalJSON() ([]byte, error) {
+	type plain ClaudeAPIResponse
+	var stopReason *string
+	if r.StopReason != "" {
+		stopReason = &r.StopReason
+	}
+	return json.Marshal(struct {
+		plain
+		StopReason   *string `json:"stop_reason"`
+		StopSequence *string `json:"stop_sequence"`
+	}{plain(r), stopReason, r.StopSequence})
 }
 
+// ClaudeResponseContent is a content block of a complete Claude message
+type ClaudeResponseContent = ClaudeContentBlock
+
 type ClaudeUsage struct {
 	InputTokens              int                  `json:"input_tokens"`
 	OutputTokens             int                  `json:"output_tokens"`
@@ -55,6 +75,7 @@ type ClaudeUsage struct {
 	CacheReadInputTokens     *int                 `json:"cache_read_input_tokens,omitempty"`
 	ServiceTier              *string              `json:"service_tier,omitempty"`
 	ServerToolUse            *ClaudeServerToolUse `json:"server_tool_use,omitempty"`
+	Estimated                bool                 `json:"estimated,omitempty"` // Counted by the gateway, not LongCat
 }
 
 type ClaudeServerToolUse struct {
@@ -75,11 +96,20 @@ type ClaudeStreamChunk struct {
 	Usage        *ClaudeUsage        `json:"usage,omitempty"`
 	ContentBlock *ClaudeContentBlock `json:"content_block,omitempty"`
 	MessageDelta *ClaudeMessageDelta `json:"message_delta,omitempty"`
+	MessageID    string              `json:"-"` // ID to report in message_start
+	InputTokens  int                 `json:"-"` // Prompt tokens to report in message_start
+	Model        string              `json:"-"` // Model name to report to the client
+	// IDs of the reply in LongCat's message tree
+	LongCatMessageID int  `json:"-"`
+	LongCatParentID  int  `json:"-"`
+	Partial          bool `json:"-"` // See ChatCompletionChunk.Partial
 }
 
 type ClaudeStreamDelta struct {
-	Type string `json:"type"`
-	Text string `json:"text,omitempty"`
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	Thinking    string `json:"thinking,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
 }
 
 type ClaudeMessageDelta struct {
@@ -94,8 +124,71 @@ type ClaudeDelta struct {
 }
 
 type ClaudeContentBlock struct {
-	Type string `json:"type"`
-	Text string `json:"text,omitempty"`
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	Thinking string          `json:"thinking,omitempty"`
+	ID       string          `json:"id,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	Input    json.RawMessage `json:"input,omitempty"`
+}
+
+// MarshalJSON emits exactly the fields Claude defines for each block type,
+// including empty text/thinking that SDKs append deltas to
+func (b ClaudeContentBlock) MarshalJSON() ([]byte, error) {
+	switch b.Type {
+	case "text":
+		return json.Marshal(struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}{b.Type, b.Text})
+	case "thinking":
+		return json.Marshal(struct {
+			Type     string `json:"type"`
+			Thinking string `json:"thinking"`
+		}{b.Type, b.Thinking})
+	case "tool_use":
+		input := json.RawMessage(toolInput(string(b.Input)))
+		return json.Marshal(struct {
+			Type  string          `json:"type"`
+			ID    string          `json:"id"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		}{b.Type, b.ID, b.Name, input})
+	}
+	type plain ClaudeContentBlock
+	return json.Marshal(plain(b))
+}
+
+// ClaudeContentBlockEvent is a content_block_start/delta/stop event. Unlike
+// ClaudeStreamChunk it always carries the block index, including 0.
+type ClaudeContentBlockEvent struct {
+	Type         string              `json:"type"`
+	Index        int                 `json:"index"`
+	ContentBlock *ClaudeContentBlock `json:"content_block,omitempty"`
+	Delta        *ClaudeStreamDelta  `json:"delta,omitempty"`
+}
+
+// claudeBlockKey identifies which content block a delta belongs to; a change
+// of key closes the current block and opens the next one
+func claudeBlockKey(chunk ClaudeStreamChunk) string {
+	if chunk.ContentBlock != nil && chunk.ContentBlock.Type == "tool_use" {
+		return "tool_use:" + chunk.ContentBlock.ID
+	}
+	if chunk.Delta != nil && chunk.Delta.Type == "thinking_delta" {
+		return "thinking"
+	}
+	return "text"
+}
+
+// claudeBlockFor returns the content_block_start payload for a delta chunk
+func claudeBlockFor(chunk ClaudeStreamChunk) ClaudeContentBlock {
+	if chunk.ContentBlock != nil {
+		return *chunk.ContentBlock
+	}
+	if chunk.Delta != nil && chunk.Delta.Type == "thinking_delta" {
+		return ClaudeContentBlock{Type: "thinking"}
+	}
+	return ClaudeContentBlock{Type: "text"}
 }
 
 // ClaudeService implements APIService for Claude compatibility
@@ -119,18 +212,23 @@ func (s *ClaudeService) ConvertResponse(resp *http.Response, stream bool) (<-cha
 		defer close(errs)
 		defer resp.Body.Close()
 
-		processor := NewStreamProcessor()
+		processor := acquireStreamProcessor()
 		openAIChunks, rawErrs := processor.ProcessStream(resp, stream)
+		ctx := context.Background()
+		if resp.Request != nil {
+			ctx = resp.Request.Context()
+		}
 
 		// Convert OpenAI chunks to Claude format
 		for {
 			select {
 			case openAIChunk, ok := <-openAIChunks:
 				if !ok {
+					releaseStreamProcessor(processor)
 					return
 				}
 				// Convert OpenAI chunk to Claude format
-				if claudeChunk := s.convertOpenAIToClaudeChunk(openAIChunk, processor); claudeChunk != nil {
+				for _, claudeChunk := range s.convertOpenAIToClaudeChunks(ctx, openAIChunk) {
 					select {
 					case chunks <- claudeChunk:
 					case <-time.After(5 * time.Second):
@@ -151,53 +249,103 @@ func (s *ClaudeService) ConvertResponse(resp *http.Response, stream bool) (<-cha
 	return chunks, errs
 }
 
-func (s *ClaudeService) convertOpenAIToClaudeChunk(openAIChunk ChatCompletionChunk, processor *StreamProcessor) interface{} {
+// convertOpenAIToClaudeChunks splits an OpenAI chunk into Claude deltas, one
+// per content block kind (thinking, text, tool_use), followed by the final
+// message_delta when the chunk finishes the response. The counts come from
+// the chunk, as the processor is still being written by ProcessStream.
+func (s *ClaudeService) convertOpenAIToClaudeChunks(ctx context.Context, openAIChunk ChatCompletionChunk) []ClaudeStreamChunk {
 	// Ensure we have valid choices
 	if len(openAIChunk.Choices) == 0 {
 		return nil
 	}
 
 	choice := openAIChunk.Choices[0]
+	var claudeChunks []ClaudeStreamChunk
 
-	// Handle content delta
-	if choice.Delta.Content != "" {
-		claudeChunk := ClaudeStreamChunk{
-			Type:  "content_block_delta",
-			Index: 0,
+	// Handle reasoning delta
+	if choice.Delta.ReasoningContent != "" {
+		claudeChunks = append(claudeChunks, ClaudeStreamChunk{
+			Type: "content_block_delta",
+			Delta: &ClaudeStreamDelta{
+				Type:     "thinking_delta",
+				Thinking: choice.Delta.ReasoningContent,
+			},
+		})
+	}
+
+	// Handle content delta. Claude has no refusal field, so a refusal notice
+	// is sent as text ahead of the refusal stop reason.
+	text := choice.Delta.Content
+	if choice.Delta.Refusal != "" && text != "" {
+		text += "\n\n"
+	}
+	text += choice.Delta.Refusal
+	if text != "" {
+		claudeChunks = append(claudeChunks, ClaudeStreamChunk{
+			Type: "content_block_delta",
 			Delta: &ClaudeStreamDelta{
 				Type: "text_delta",
-				Text: choice.Delta.Content,
+				Text: text,
 			},
-		}
-		// Log Claude conversion output in verbose mode
-		logging.LogDebug("Claude Conversion Output: %+v", claudeChunk)
-		return claudeChunk
+		})
+	}
+
+	// Handle tool calls, each in its own tool_use block
+	for _, toolCall := range choice.Delta.ToolCalls {
+		claudeChunks = append(claudeChunks, ClaudeStreamChunk{
+			Type: "content_block_delta",
+			ContentBlock: &ClaudeContentBlock{
+				Type: "tool_use",
+				ID:   toolCall.ID,
+				Name: toolCall.Function.Name,
+			},
+			Delta: &ClaudeStreamDelta{
+				Type:        "input_json_delta",
+				PartialJSON: toolCall.Function.Arguments,
+			},
+		})
 	}
 
 	// Handle final message with proper Claude stop reason
 	if choice.FinishReason != "" {
 		stopReason := s.mapToClaudeStopReason(choice.FinishReason)
+		usage := openAIChunk.Usage
+		if usage == nil {
+			usage = &Usage{PromptTokens: openAIChunk.PromptTokens, Estimated: true}
+		}
 
 		// Create message delta with final usage and stop reason
-		claudeChunk := ClaudeStreamChunk{
+		messageDelta := &ClaudeMessageDelta{
 			Type: "message_delta",
-			MessageDelta: &ClaudeMessageDelta{
-				Type: "message_delta",
-				Delta: ClaudeDelta{
-					StopReason: &stopReason,
-				},
-				Usage: ClaudeUsage{
-					InputTokens:  processor.tokenInfo.PromptTokens,
-					OutputTokens: processor.tokenInfo.CompletionTokens,
-				},
+			Delta: ClaudeDelta{
+				StopReason: &stopReason,
+			},
+			Usage: ClaudeUsage{
+				InputTokens:  usage.PromptTokens,
+				OutputTokens: usage.CompletionTokens,
+				Estimated:    usage.Estimated,
 			},
 		}
-		// Log Claude conversion output in verbose mode
-		logging.LogDebug("Claude Conversion Output (final): %+v", claudeChunk)
-		return claudeChunk
+		if betaEnabled(ctx, PromptCachingBeta) {
+			messageDelta.Usage.reportPromptCache()
+		}
+		claudeChunks = append(claudeChunks, ClaudeStreamChunk{
+			Type:         "message_delta",
+			MessageDelta: messageDelta,
+		})
 	}
 
-	return nil
+	for i := range claudeChunks {
+		claudeChunks[i].MessageID = openAIChunk.ID
+		claudeChunks[i].InputTokens = openAIChunk.PromptTokens
+		claudeChunks[i].Model = openAIChunk.Model
+		claudeChunks[i].LongCatMessageID = openAIChunk.LongCatMessageID
+		claudeChunks[i].LongCatParentID = openAIChunk.LongCatParentID
+		claudeChunks[i].Partial = openAIChunk.Partial
+		// Log Claude conversion output in verbose mode
+		logging.LogBody(ctx, "Claude Conversion Output: %+v", claudeChunks[i])
+	}
+	return claudeChunks
 }
 
 // mapToClaudeStopReason maps OpenAI finish reasons to Claude stop reasons
@@ -205,11 +353,14 @@ func (s *ClaudeService) mapToClaudeStopReason(openAIReason string) string {
 	switch openAIReason {
 	case "stop":
 		return "end_turn"
-	case "length":
+	case "length", "timeout":
 		return "max_tokens"
 	case "content_filter":
 		return "refusal"
+	case "tool_calls", "function_call":
+		return "tool_use"
 	default:
+		logging.LogDebug("Unmapped finish reason %q, using end_turn", openAIReason)
 		return "end_turn"
 	}
 }
@@ -222,46 +373,76 @@ func (s *ClaudeService) GetResponseContentType(stream bool) string {
 }
 
 func (s *ClaudeService) HandleNonStreamingResponse(w http.ResponseWriter, chunks <-chan interface{}, errs <-chan error) error {
-	var fullContent strings.Builder
+	content := []ClaudeResponseContent{}
+	var lastBlockKey string
 	var finalStopReason string
-	var inputTokens, outputTokens int
-	messageID := uuid.New().String()
+	var usage ClaudeUsage
+	messageID := NewMessageID()
+	model := "LongCat-Flash"
 
 	// Process all chunks
 	for {
 		select {
 		case chunk, ok := <-chunks:
 			if !ok {
+				if len(content) == 0 && config.AppConfig.EmptyResponseErr {
+					return ErrEmptyResponse
+				}
+				// CLAUDE_EMPTY_CONTENT=none answers with an empty content array
+				if len(content) == 0 && config.AppConfig.ClaudeEmptyBlock != "none" {
+					content = append(content, ClaudeResponseContent{Type: "text"})
+				}
+				// A complete message always has a stop reason
+				if finalStopReason == "" {
+					finalStopReason = "end_turn"
+				}
+
 				// Build final response with proper Claude format
+				usage.ServiceTier = claudeServiceTier()
 				response := &ClaudeAPIResponse{
-					ID:   messageID,
-					Type: "message",
-					Role: "assistant",
-					Content: []ClaudeResponseContent{{
-						Type: "text",
-						Text: fullContent.String(),
-					}},
-					Model:      "LongCat-Flash",
+					ID:         messageID,
+					Type:       "message",
+					Role:       "assistant",
+					Content:    content,
+					Model:      model,
 					StopReason: finalStopReason,
-					Usage: ClaudeUsage{
-						InputTokens:  inputTokens,
-						OutputTokens: outputTokens,
-					},
+					Usage:      usage,
 				}
 
 				w.Header().Set("Content-Type", "application/json")
 				return json.NewEncoder(w).Encode(response)
 			}
 
-			if openAIChunk, ok := chunk.(ChatCompletionChunk); ok {
-				if openAIChunk.Choices != nil && len(openAIChunk.Choices) > 0 {
-					fullContent.WriteString(openAIChunk.Choices[0].Delta.Content)
-					if openAIChunk.Choices[0].FinishReason != "" {
-						finalStopReason = s.mapToClaudeStopReason(openAIChunk.Choices[0].FinishReason)
-					}
+			claudeChunk, ok := chunk.(ClaudeStreamChunk)
+			if !ok {
+				continue
+			}
+			if claudeChunk.MessageID != "" {
+				messageID = claudeChunk.MessageID
+			}
+			if claudeChunk.Model != "" {
+				model = claudeChunk.Model
+			}
+			switch claudeChunk.Type {
+			case "content_block_delta":
+				// Merge consecutive deltas of the same block
+				key := claudeBlockKey(claudeChunk)
+				if key != lastBlockKey {
+					content = append(content, claudeBlockFor(claudeChunk))
+					lastBlockKey = key
+				}
+				block := &content[len(content)-1]
+				block.Text += claudeChunk.Delta.Text
+				block.Thinking += claudeChunk.Delta.Thinking
+				if claudeChunk.Delta.PartialJSON != "" {
+					block.Input = append(block.Input, claudeChunk.Delta.PartialJSON...)
+				}
+
+			case "message_delta":
+				if claudeChunk.MessageDelta.Delta.StopReason != nil {
+					finalStopReason = *claudeChunk.MessageDelta.Delta.StopReason
 				}
-				// Extract token info from processor if available
-				// Note: This would need to be passed through the chunk or accessed differently
+				usage = claudeChunk.MessageDelta.Usage
 			}
 
 		case err := <-errs:
@@ -272,79 +453,165 @@ func (s *ClaudeService) HandleNonStreamingResponse(w http.ResponseWriter, chunks
 	}
 }
 
-func (s *ClaudeService) HandleStreamingResponse(w http.ResponseWriter, flusher http.Flusher, chunks <-chan interface{}, errs <-chan error) error {
-	messageID := uuid.New().String()
+func (s *ClaudeService) HandleStreamingResponse(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, chunks <-chan interface{}, errs <-chan error) error {
+	sse := newSSEWriter(w, flusher)
+	defer sse.close()
+	// The request already names the response, so a message_start sent ahead
+	// of the first chunk (for a ping) matches the one the chunks would send
+	messageID := ResponseID(ctx)
+	if messageID == "" {
+		messageID = NewMessageID()
+	}
+	model := modelIn(ctx)
+	if model == "" {
+		model = "LongCat-Flash"
+	}
 	sentMessageStart := false
-	sentContentBlockStart := false
 	sentMessageDelta := false
 	hasReceivedContent := false
-	var inputTokens, outputTokens int
+	inputTokens, outputTokens := promptTokensIn(ctx), 0
+
+	// Content blocks are numbered in the order they are opened; only one
+	// block is open at a time
+	blockIndex := -1
+	openBlockKey := ""
+
+	// Text deltas of a block that fall in one STREAM_COALESCE_MS window are
+	// merged into a single event; the next event of any kind sends them first
+	sendDelta := func(delta *ClaudeStreamDelta) {
+		if delta.Type != "text_delta" {
+			s.sendContentBlockDelta(sse, blockIndex, delta)
+			return
+		}
+		index := blockIndex
+		sse.sendText("content_block_delta", fmt.Sprint(index), delta.Text, func(text string) []byte {
+			data, _ := json.Marshal(ClaudeContentBlockEvent{
+				Type:  "content_block_delta",
+				Index: index,
+				Delta: &ClaudeStreamDelta{Type: "text_delta", Text: text},
+			})
+			return data
+		})
+	}
+
+	startBlock := func(key string, block ClaudeContentBlock) {
+		if openBlockKey != "" {
+			s.sendContentBlockStop(sse, blockIndex)
+		}
+		blockIndex++
+		openBlockKey = key
+		s.sendContentBlockStart(sse, blockIndex, block)
+	}
+	stopBlock := func() {
+		if openBlockKey == "" {
+			if blockIndex < 0 && config.AppConfig.ClaudeEmptyBlock == "none" {
+				return
+			}
+			// Claude clients expect at least one (possibly empty) text block
+			startBlock("text", ClaudeContentBlock{Type: "text"})
+		}
+		s.sendContentBlockStop(sse, blockIndex)
+		openBlockKey = ""
+	}
+
+	// Periodic ping events keep strict clients from treating the stream as stalled
+	var pingC <-chan time.Time
+	if config.AppConfig.ClaudePingSeconds > 0 {
+		ticker := time.NewTicker(time.Duration(config.AppConfig.ClaudePingSeconds) * time.Second)
+		defer ticker.Stop()
+		pingC = ticker.C
+	}
+
+	deadline, stopDeadline := streamDeadline()
+	defer stopDeadline()
 
 	for {
 		select {
+		case <-deadline:
+			// Stream ran too long, close it out as if max_tokens was reached
+			if !sentMessageStart {
+				s.sendMessageStart(sse, messageID, model, inputTokens, 0)
+			}
+			if !sentMessageDelta {
+				stopBlock()
+				s.sendMessageDelta(sse, messageID, "max_tokens", inputTokens, outputTokens)
+			}
+			s.sendMessageStop(sse)
+			return ErrMaxStreamDuration
+
+		case <-pingC:
+			// Pings must follow message_start to keep the event ordering valid
+			if !sentMessageStart {
+				s.sendMessageStart(sse, messageID, model, inputTokens, 0)
+				sentMessageStart = true
+			}
+			s.sendPing(sse)
+
 		case chunk, ok := <-chunks:
 			if !ok {
+				if !hasReceivedContent && config.AppConfig.EmptyResponseErr {
+					// Report the empty upstream as an error instead of a fake answer
+					s.sendErrorEvent(sse, ErrEmptyResponse)
+					return ErrEmptyResponse
+				}
 				if !hasReceivedContent {
 					// Send complete default sequence if no content was received
-					s.sendDefaultSequence(w, flusher, messageID)
+					s.sendDefaultSequence(sse, messageID, model, sentMessageStart)
 					return nil
 				}
 
 				// Send final message_stop if not already sent
 				if !sentMessageDelta {
-					s.sendMessageDelta(w, flusher, messageID, "end_turn", inputTokens, outputTokens)
+					stopBlock()
+					s.sendMessageDelta(sse, messageID, "end_turn", inputTokens, outputTokens)
 					sentMessageDelta = true
 				}
 
-				s.sendMessageStop(w, flusher)
+				s.sendMessageStop(sse)
 				return nil
 			}
 
 			hasReceivedContent = true
 
 			if claudeChunk, ok := chunk.(ClaudeStreamChunk); ok {
+				if claudeChunk.MessageID != "" && !sentMessageStart {
+					messageID = claudeChunk.MessageID
+				}
+				if claudeChunk.Model != "" && !sentMessageStart {
+					model = claudeChunk.Model
+				}
+				if claudeChunk.InputTokens > 0 {
+					inputTokens = claudeChunk.InputTokens
+				}
 				switch claudeChunk.Type {
 				case "content_block_delta":
 					// Send message_start if not already sent
 					if !sentMessageStart {
-						s.sendMessageStart(w, flusher, messageID, 0, 0)
+						s.sendMessageStart(sse, messageID, model, inputTokens, 0)
 						sentMessageStart = true
 					}
 
-					// Send content_block_start if not already sent
-					if !sentContentBlockStart {
-						s.sendContentBlockStart(w, flusher)
-						sentContentBlockStart = true
+					// Open a new block when the delta belongs to a different one
+					if key := claudeBlockKey(claudeChunk); key != openBlockKey {
+						startBlock(key, claudeBlockFor(claudeChunk))
 					}
 
 					// Send the content delta
-					if data, err := json.Marshal(claudeChunk); err == nil {
-						fmt.Fprintf(w, "event: %s\ndata: %s\n\n", claudeChunk.Type, data)
-						flusher.Flush()
-					}
+					sendDelta(claudeChunk.Delta)
 
 				case "message_delta":
 					// Send message_start if not already sent
 					if !sentMessageStart {
-						s.sendMessageStart(w, flusher, messageID,
-							claudeChunk.MessageDelta.Usage.InputTokens,
-							claudeChunk.MessageDelta.Usage.OutputTokens)
+						s.sendMessageStart(sse, messageID, model, claudeChunk.MessageDelta.Usage.InputTokens, 0)
 						sentMessageStart = true
 					}
 
-					// Send content_block_start if not already sent
-					if !sentContentBlockStart {
-						s.sendContentBlockStart(w, flusher)
-						sentContentBlockStart = true
-					}
-
 					// Send content_block_stop before message_delta
-					s.sendContentBlockStop(w, flusher)
+					stopBlock()
 
 					// Send message_delta with final usage
-					if data, err := json.Marshal(claudeChunk); err == nil {
-						fmt.Fprintf(w, "event: %s\ndata: %s\n\n", claudeChunk.Type, data)
-						flusher.Flush()
+					if data, err := json.Marshal(claudeChunk.MessageDelta); err == nil {
+						sse.send(claudeChunk.Type, data)
 					}
 
 					sentMessageDelta = true
@@ -355,7 +622,7 @@ func (s *ClaudeService) HandleStreamingResponse(w http.ResponseWriter, flusher h
 
 		case err := <-errs:
 			if err != nil {
-				s.sendErrorEvent(w, flusher, err)
+				s.sendErrorEvent(sse, err)
 				return err
 			}
 		}
@@ -363,7 +630,20 @@ func (s *ClaudeService) HandleStreamingResponse(w http.ResponseWriter, flusher h
 }
 
 // Helper methods for Claude streaming events
-func (s *ClaudeService) sendMessageStart(w http.ResponseWriter, flusher http.Flusher, messageID string, inputTokens, outputTokens int) {
+// claudeServiceTier reports SERVICE_TIER in Anthropic's terms, where
+// OpenAI's "default" tier is called "standard"
+func claudeServiceTier() *string {
+	tier := config.AppConfig.ServiceTier
+	if tier == "" {
+		return nil
+	}
+	if tier == "default" {
+		tier = "standard"
+	}
+	return &tier
+}
+
+func (s *ClaudeService) sendMessageStart(sse *sseWriter, messageID, model string, inputTokens, outputTokens int) {
 	msgStart := ClaudeStreamChunk{
 		Type: "message_start",
 		Message: &ClaudeAPIResponse{
@@ -371,105 +651,112 @@ func (s *ClaudeService) sendMessageStart(w http.ResponseWriter, flusher http.Flu
 			Type:    "message",
 			Role:    "assistant",
 			Content: []ClaudeResponseContent{},
-			Model:   "LongCat-Flash",
+			Model:   model,
 			Usage: ClaudeUsage{
 				InputTokens:  inputTokens,
 				OutputTokens: outputTokens,
+				ServiceTier:  claudeServiceTier(),
 			},
 		},
 	}
 	if data, err := json.Marshal(msgStart); err == nil {
-		fmt.Fprintf(w, "event: message_start\ndata: %s\n\n", data)
-		flusher.Flush()
+		sse.send("message_start", data)
 	}
 }
 
-func (s *ClaudeService) sendContentBlockStart(w http.ResponseWriter, flusher http.Flusher) {
-	blockStart := ClaudeStreamChunk{
-		Type:  "content_block_start",
-		Index: 0,
-		ContentBlock: &ClaudeContentBlock{
-			Type: "text",
-		},
+func (s *ClaudeService) sendContentBlockStart(sse *sseWriter, index int, block ClaudeContentBlock) {
+	blockStart := ClaudeContentBlockEvent{
+		Type:         "content_block_start",
+		Index:        index,
+		ContentBlock: &block,
 	}
 	if data, err := json.Marshal(blockStart); err == nil {
-		fmt.Fprintf(w, "event: content_block_start\ndata: %s\n\n", data)
-		flusher.Flush()
+		sse.send("content_block_start", data)
+	}
+}
+
+func (s *ClaudeService) sendContentBlockDelta(sse *sseWriter, index int, delta *ClaudeStreamDelta) {
+	blockDelta := ClaudeContentBlockEvent{
+		Type:  "content_block_delta",
+		Index: index,
+		Delta: delta,
+	}
+	if data, err := json.Marshal(blockDelta); err == nil {
+		sse.send("content_block_delta", data)
 	}
 }
 
-func (s *ClaudeService) sendContentBlockStop(w http.ResponseWriter, flusher http.Flusher) {
-	blockStop := ClaudeStreamChunk{
+func (s *ClaudeService) sendContentBlockStop(sse *sseWriter, index int) {
+	blockStop := ClaudeContentBlockEvent{
 		Type:  "content_block_stop",
-		Index: 0,
+		Index: index,
 	}
 	if data, err := json.Marshal(blockStop); err == nil {
-		fmt.Fprintf(w, "event: content_block_stop\ndata: %s\n\n", data)
-		flusher.Flush()
+		sse.send("content_block_stop", data)
 	}
 }
 
-func (s *ClaudeService) sendMessageDelta(w http.ResponseWriter, flusher http.Flusher, messageID string, stopReason string, inputTokens, outputTokens int) {
-	msgDelta := ClaudeStreamChunk{
+func (s *ClaudeService) sendMessageDelta(sse *sseWriter, messageID string, stopReason string, inputTokens, outputTokens int) {
+	msgDelta := ClaudeMessageDelta{
 		Type: "message_delta",
-		MessageDelta: &ClaudeMessageDelta{
-			Type: "message_delta",
-			Delta: ClaudeDelta{
-				StopReason: &stopReason,
-			},
-			Usage: ClaudeUsage{
-				InputTokens:  inputTokens,
-				OutputTokens: outputTokens,
-			},
+		Delta: ClaudeDelta{
+			StopReason: &stopReason,
+		},
+		Usage: ClaudeUsage{
+			InputTokens:  inputTokens,
+			OutputTokens: outputTokens,
 		},
 	}
 	if data, err := json.Marshal(msgDelta); err == nil {
-		fmt.Fprintf(w, "event: message_delta\ndata: %s\n\n", data)
-		flusher.Flush()
+		sse.send("message_delta", data)
 	}
 }
 
-func (s *ClaudeService) sendMessageStop(w http.ResponseWriter, flusher http.Flusher) {
+func (s *ClaudeService) sendMessageStop(sse *sseWriter) {
 	stopEvent := ClaudeStreamChunk{
 		Type: "message_stop",
 	}
 	if data, err := json.Marshal(stopEvent); err == nil {
-		fmt.Fprintf(w, "event: message_stop\ndata: %s\n\n", data)
-		flusher.Flush()
+		sse.send("message_stop", data)
 	}
 }
 
-func (s *ClaudeService) sendDefaultSequence(w http.ResponseWriter, flusher http.Flusher, messageID string) {
-	// Send complete default sequence for empty response
-	s.sendMessageStart(w, flusher, messageID, 0, 0)
-	s.sendContentBlockStart(w, flusher)
-
-	// Send default content
-	contentDelta := ClaudeStreamChunk{
-		Type:  "content_block_delta",
-		Index: 0,
-		Delta: &ClaudeStreamDelta{
-			Type: "text_delta",
-			Text: "I apologize, but I'm unable to process your request at the moment.",
-		},
+func (s *ClaudeService) sendPing(sse *sseWriter) {
+	ping := ClaudeStreamChunk{
+		Type: "ping",
 	}
-	if data, err := json.Marshal(contentDelta); err == nil {
-		fmt.Fprintf(w, "event: content_block_delta\ndata: %s\n\n", data)
-		flusher.Flush()
+	if data, err := json.Marshal(ping); err == nil {
+		sse.send("ping", data)
 	}
+}
 
-	s.sendContentBlockStop(w, flusher)
-	s.sendMessageDelta(w, flusher, messageID, "end_turn", 0, 0)
-	s.sendMessageStop(w, flusher)
+func (s *ClaudeService) sendDefaultSequence(sse *sseWriter, messageID, model string, sentMessageStart bool) {
+	// Send complete default sequence for empty response
+	if !sentMessageStart {
+		s.sendMessageStart(sse, messageID, model, 0, 0)
+	}
+	s.sendContentBlockStart(sse, 0, ClaudeContentBlock{Type: "text"})
+
+	// Send default content
+	s.sendContentBlockDelta(sse, 0, &ClaudeStreamDelta{
+		Type: "text_delta",
+		Text: config.AppConfig.EmptyResponseMsg,
+	})
+
+	s.sendContentBlockStop(sse, 0)
+	s.sendMessageDelta(sse, messageID, "end_turn", 0, 0)
+	s.sendMessageStop(sse)
 }
 
-func (s *ClaudeService) sendErrorEvent(w http.ResponseWriter, flusher http.Flusher, err error) {
+func (s *ClaudeService) sendErrorEvent(sse *sseWriter, err error) {
 	errorEvent := map[string]interface{}{
-		"type":  "error",
-		"error": err.Error(),
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    "api_error",
+			"message": err.Error(),
+		},
 	}
 	if data, jsonErr := json.Marshal(errorEvent); jsonErr == nil {
-		fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
-		flusher.Flush()
+		sse.send("error", data)
 	}
 }
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+// collectClaudeChunks drains a ClaudeService.ConvertResponse result
+func collectClaudeChunks(chunks <-chan interface{}, errs <-chan error) ([]ClaudeStreamChunk, error) {
+	var got []ClaudeStreamChunk
+	for chunk := range chunks {
+		got = append(got, chunk.(ClaudeStreamChunk))
+	}
+	return got, <-errs
+}
+
+// Run with -race: the usage in message_delta must come from the chunks, not
+// from the processor ProcessStream is still writing
+func TestClaudeConvertResponseUsage(t *testing.T) {
+	tests := []struct {
+		name       string
+		betas      []string
+		tokens     *TokenInfo
+		wantInput  int
+		wantOutput int
+		wantCache  bool
+	}{
+		{"reported", nil, &TokenInfo{PromptTokens: 40, CompletionTokens: 9, HasTokens: true}, 40, 9, false},
+		{"estimated", nil, nil, 5, -1, false},
+		{"prompt caching beta", []string{PromptCachingBeta}, &TokenInfo{PromptTokens: 40, CompletionTokens: 9, HasTokens: true}, 40, 9, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(WithBetas(context.Background(), tt.betas), promptTokensKey{}, 5)
+			resp := longCatStream(ctx, longCatFrame("Hi", false, nil), longCatFrame("Hi there", true, tt.tokens))
+			chunks, err := collectClaudeChunks(NewClaudeService(nil).ConvertResponse(resp, true))
+			if err != nil {
+				t.Fatalf("ConvertResponse error: %v", err)
+			}
+
+			if len(chunks) == 0 || chunks[0].InputTokens != 5 {
+				t.Fatalf("first chunk should report the prompt estimate 5 for message_start, got %+v", chunks)
+			}
+			var delta *ClaudeMessageDelta
+			for _, chunk := range chunks {
+				if chunk.MessageDelta != nil {
+					delta = chunk.MessageDelta
+				}
+			}
+			if delta == nil {
+				t.Fatal("no message_delta")
+			}
+			if delta.Usage.InputTokens != tt.wantInput {
+				t.Errorf("input_tokens = %d, want %d", delta.Usage.InputTokens, tt.wantInput)
+			}
+			if tt.wantOutput >= 0 && delta.Usage.OutputTokens != tt.wantOutput {
+				t.Errorf("output_tokens = %d, want %d", delta.Usage.OutputTokens, tt.wantOutput)
+			}
+			if tt.wantOutput < 0 && delta.Usage.OutputTokens == 0 {
+				t.Error("estimated output_tokens = 0, want a count of the reply")
+			}
+			if delta.Usage.Estimated != (tt.tokens == nil) {
+				t.Errorf("estimated = %v, want %v", delta.Usage.Estimated, tt.tokens == nil)
+			}
+			if (delta.Usage.CacheReadInputTokens != nil) != tt.wantCache {
+				t.Errorf("cache_read_input_tokens set = %v, want %v", delta.Usage.CacheReadInputTokens != nil, tt.wantCache)
+			}
+		})
+	}
+}
+
+func TestClaudeStreamingPingsBeforeFirstChunk(t *testing.T) {
+	saved := config.AppConfig.ClaudePingSeconds
+	config.AppConfig.ClaudePingSeconds = 1
+	defer func() { config.AppConfig.ClaudePingSeconds = saved }()
+
+	ctx := WithModel(WithResponseID(context.Background(), "msg_request"), "claude-alias")
+	ctx = context.WithValue(ctx, promptTokensKey{}, 21)
+
+	// LongCat answers only after the first ping is due
+	chunks := make(chan interface{})
+	errs := make(chan error)
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		chunks <- ClaudeStreamChunk{
+			Type:        "content_block_delta",
+			Delta:       &ClaudeStreamDelta{Type: "text_delta", Text: "late"},
+			MessageID:   "msg_request",
+			InputTokens: 21,
+		}
+		close(chunks)
+	}()
+
+	w := httptest.NewRecorder()
+	if err := NewClaudeService(nil).HandleStreamingResponse(ctx, w, w, chunks, errs); err != nil {
+		t.Fatalf("HandleStreamingResponse: %v", err)
+	}
+	body := w.Body.String()
+
+	ping := strings.Index(body, "event: ping")
+	text := strings.Index(body, "late")
+	if ping < 0 || text < 0 || ping > text {
+		t.Fatalf("want a ping before the delayed content, got:\n%s", body)
+	}
+	if n := strings.Count(body, "event: message_start"); n != 1 {
+		t.Fatalf("got %d message_start events, want 1:\n%s", n, body)
+	}
+
+	start := body[strings.Index(body, "event: message_start"):]
+	start = start[strings.Index(start, "data: ")+len("data: "):]
+	start = start[:strings.Index(start, "\n")]
+	var event ClaudeStreamChunk
+	if err := json.Unmarshal([]byte(start), &event); err != nil || event.Message == nil {
+		t.Fatalf("bad message_start %s: %v", start, err)
+	}
+	if event.Message.ID != "msg_request" || event.Message.Model != "claude-alias" || event.Message.Usage.InputTokens != 21 {
+		t.Errorf("message_start = id %q model %q input_tokens %d, want msg_request claude-alias 21",
+			event.Message.ID, event.Message.Model, event.Message.Usage.InputTokens)
+	}
+}
+
+func TestClaudeStreamingCoalescesTextDeltas(t *testing.T) {
+	saved := *config.AppConfig
+	defer func() { *config.AppConfig = saved }()
+	config.AppConfig.CoalesceMillis = 1000
+	config.AppConfig.CoalesceBytes = 1 << 20
+
+	parts := []string{"Hel", "lo", ", wor", "ld"}
+	chunks := make(chan interface{}, len(parts)+1)
+	for _, part := range parts {
+		chunks <- ClaudeStreamChunk{Type: "content_block_delta", Delta: &ClaudeStreamDelta{Type: "text_delta", Text: part}}
+	}
+	chunks <- ClaudeStreamChunk{Type: "content_block_delta", ContentBlock: &ClaudeContentBlock{Type: "tool_use", ID: "t1", Name: "search"},
+		Delta: &ClaudeStreamDelta{Type: "input_json_delta", PartialJSON: "{}"}}
+	close(chunks)
+
+	w := httptest.NewRecorder()
+	if err := NewClaudeService(nil).HandleStreamingResponse(context.Background(), w, w, chunks, make(chan error)); err != nil {
+		t.Fatalf("HandleStreamingResponse: %v", err)
+	}
+
+	var types []string
+	var text strings.Builder
+	for _, data := range sseDataLines(w.Body.String()) {
+		var event ClaudeContentBlockEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("bad event %s: %v", data, err)
+		}
+		if event.Type == "content_block_delta" && event.Delta.Type == "text_delta" {
+			text.WriteString(event.Delta.Text)
+		}
+		types = append(types, event.Type)
+	}
+	if text.String() != strings.Join(parts, "") {
+		t.Fatalf("text = %q, want %q", text.String(), strings.Join(parts, ""))
+	}
+	// One merged text delta, closed before the tool_use block opens
+	want := "message_start content_block_start content_block_delta content_block_stop content_block_start content_block_delta content_block_stop message_delta message_stop"
+	if got := strings.Join(types, " "); got != want {
+		t.Fatalf("events = %s, want %s", got, want)
+	}
+}
+
+func TestClaudeToolUseBlockInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"absent", ``, `{}`},
+		{"object", `{"q":"go"}`, `{"q":"go"}`},
+		{"plain text", `search go`, `"search go"`},
+		{"truncated object", `{"q":`, `"{\"q\":"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(ClaudeContentBlock{Type: "tool_use", ID: "t1", Name: "search", Input: json.RawMessage(tt.input)})
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			var got struct {
+				Input json.RawMessage `json:"input"`
+			}
+			if err := json.Unmarshal(data, &got); err != nil || string(got.Input) != tt.want {
+				t.Fatalf("json.Marshal() = %s, want input %s", data, tt.want)
+			}
+		})
+	}
+}
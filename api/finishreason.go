@@ -0,0 +1,48 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
+)
+
+// longCatFinishReasons maps the finishReason values LongCat is known to send
+// to OpenAI finish reasons. Cancelled and failed generations have no OpenAI
+// equivalent and end the turn normally with the partial text.
+var longCatFinishReasons = map[string]string{
+	"stop":           "stop",
+	"eos":            "stop",
+	"end":            "stop",
+	"length":         "length",
+	"max_tokens":     "length",
+	"max_length":     "length",
+	"content_filter": "content_filter",
+	"sensitive":      "content_filter",
+	"tool_calls":     "tool_calls",
+	"function_call":  "tool_calls",
+	"plugin":         "tool_calls",
+	"cancelled":      "stop",
+	"canceled":       "stop",
+	"abort":          "stop",
+	"error":          "stop",
+}
+
+// openAIFinishReason translates a LongCat finishReason, consulting
+// FINISH_REASON_MAP before the built-in table. Both are matched
+// case-insensitively. Unknown values are logged so new ones can be added and
+// fall back to "stop".
+func openAIFinishReason(longCatReason string) string {
+	if longCatReason == "" {
+		return ""
+	}
+	key := strings.ToLower(longCatReason)
+	if reason, ok := config.AppConfig.FinishReasonMap[key]; ok {
+		return reason
+	}
+	if reason, ok := longCatFinishReasons[key]; ok {
+		return reason
+	}
+	logging.LogDebug("Unmapped LongCat finish reason %q, using stop", longCatReason)
+	return "stop"
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+func TestOpenAIFinishReason(t *testing.T) {
+	saved := config.AppConfig.FinishReasonMap
+	// As loaded from FINISH_REASON_MAP=Error=length,eos=content_filter
+	config.AppConfig.FinishReasonMap = map[string]string{"error": "length", "eos": "content_filter"}
+	defer func() { config.AppConfig.FinishReasonMap = saved }()
+
+	tests := []struct {
+		longCat string
+		want    string
+	}{
+		{"", ""},
+		{"stop", "stop"},
+		{"STOP", "stop"},
+		{"max_tokens", "length"},
+		{"Sensitive", "content_filter"},
+		{"plugin", "tool_calls"},
+		{"error", "length"},       // Override of a built-in value
+		{"ERROR", "length"},       // Overrides match case-insensitively too
+		{"EOS", "content_filter"}, // And take precedence over the table
+		{"something_new", "stop"}, // Unknown values fall back to stop
+	}
+	for _, tt := range tests {
+		t.Run(tt.longCat, func(t *testing.T) {
+			if got := openAIFinishReason(tt.longCat); got != tt.want {
+				t.Fatalf("openAIFinishReason(%q) = %q, want %q", tt.longCat, got, tt.want)
+			}
+		})
+	}
+}
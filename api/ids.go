@@ -0,0 +1,63 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/logging"
+	"github.com/google/uuid"
+)
+
+// IDGenerator produces the unique part of response, message and tool call IDs
+type IDGenerator interface {
+	NewID() string
+}
+
+var idGenerator IDGenerator = &uuidGenerator{}
+
+// SetIDGenerator replaces the generator used for all IDs, for example with
+// SequentialIDs to get deterministic output
+func SetIDGenerator(g IDGenerator) {
+	idGenerator = g
+}
+
+// NewChatCompletionID returns an ID in the format of OpenAI completion IDs
+func NewChatCompletionID() string {
+	return "chatcmpl-" + idGenerator.NewID()
+}
+
+// NewMessageID returns an ID in the format of Anthropic message IDs
+func NewMessageID() string {
+	return "msg_" + idGenerator.NewID()
+}
+
+// newToolCallID returns an ID for a tool call LongCat did not name
+func newToolCallID() string {
+	return "call_" + idGenerator.NewID()
+}
+
+// uuidGenerator issues random UUIDs. If the random source fails it logs a
+// warning and falls back to timestamp-based IDs instead of panicking.
+type uuidGenerator struct {
+	fallback atomic.Int64
+}
+
+func (g *uuidGenerator) NewID() string {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		logging.LogError("Failed to generate a random ID, using a timestamp-based one: %v", err)
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), g.fallback.Add(1))
+	}
+	return id.String()
+}
+
+// SequentialIDs issues 1, 2, 3, ...
+type SequentialIDs struct {
+	last atomic.Int64
+}
+
+func (s *SequentialIDs) NewID() string {
+	return strconv.FormatInt(s.last.Add(1), 10)
+}
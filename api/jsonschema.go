@@ -0,0 +1,270 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// errCyclicRef is returned for a $ref that leads back to itself without
+// constraining anything on the way
+var errCyclicRef = errors.New("cyclic $ref")
+
+// schemaValidator checks decoded JSON against the subset of JSON Schema that
+// OpenAI structured outputs accept: type, properties, required,
+// additionalProperties, items, enum, const, anyOf and local $ref.
+// Unsupported keywords are ignored.
+type schemaValidator struct {
+	root map[string]interface{}
+}
+
+// validate reports the first place where value does not conform to schema
+func (v schemaValidator) validate(schema map[string]interface{}, value interface{}, path string) error {
+	return v.validateRefs(schema, value, path, nil)
+}
+
+// validateRefs is validate for a value already reached through the refs in
+// following. Meeting one of them again, before descending into the value,
+// means the schema refers to itself without ever constraining anything.
+func (v schemaValidator) validateRefs(schema map[string]interface{}, value interface{}, path string, following []string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		if slices.Contains(following, ref) {
+			return fmt.Errorf("%s: %w %q", path, errCyclicRef, ref)
+		}
+		resolved, err := v.resolve(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return v.validateRefs(resolved, value, path, append(following, ref))
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, option := range anyOf {
+			sub, ok := option.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			err := v.validateRefs(sub, value, path, following)
+			if errors.Is(err, errCyclicRef) {
+				return err
+			}
+			if err == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: does not match any of the allowed schemas", path)
+		}
+	}
+
+	if types, ok := schemaTypes(schema["type"]); ok && !matchesAnyType(value, types) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonTypeName(value))
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		return fmt.Errorf("%s: expected %v", path, constant)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return v.validateObject(schema, value, path)
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				if err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (v schemaValidator) validateObject(schema map[string]interface{}, value map[string]interface{}, path string) error {
+	properties, _ := schema["properties"].(map[string]interface{})
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := value[name]; !present {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+	}
+
+	// Keys are checked in order so the reported error is stable
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		childPath := path + "." + key
+		if sub, ok := properties[key].(map[string]interface{}); ok {
+			if err := v.validate(sub, value[key], childPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, declared := properties[key]; declared {
+			continue
+		}
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				return fmt.Errorf("%s: unexpected property", childPath)
+			}
+		case map[string]interface{}:
+			if err := v.validate(extra, value[key], childPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRefs reports the first $ref under node that cannot be resolved or
+// that is cyclic, so a bad schema is refused before LongCat is asked
+func (v schemaValidator) checkRefs(node interface{}) error {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		if _, ok := node["$ref"].(string); ok {
+			if err := v.followRefs(node, nil); err != nil {
+				return err
+			}
+		}
+		keys := make([]string, 0, len(node))
+		for key := range node {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := v.checkRefs(node[key]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range node {
+			if err := v.checkRefs(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// followRefs walks the $ref and anyOf links that validate follows without
+// descending into the value, failing on one it has already taken
+func (v schemaValidator) followRefs(schema map[string]interface{}, following []string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		if slices.Contains(following, ref) {
+			return fmt.Errorf("%w %q", errCyclicRef, ref)
+		}
+		resolved, err := v.resolve(ref)
+		if err != nil {
+			return err
+		}
+		return v.followRefs(resolved, append(following, ref))
+	}
+	anyOf, _ := schema["anyOf"].([]interface{})
+	for _, option := range anyOf {
+		if sub, ok := option.(map[string]interface{}); ok {
+			if err := v.followRefs(sub, following); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve follows a local reference such as #/$defs/step
+func (v schemaValidator) resolve(ref string) (map[string]interface{}, error) {
+	pointer, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	var node interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		node = object[part]
+	}
+	resolved, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %q", ref)
+	}
+	return resolved, nil
+}
+
+func schemaTypes(value interface{}) ([]string, bool) {
+	switch value := value.(type) {
+	case string:
+		return []string{value}, true
+	case []interface{}:
+		var types []string
+		for _, t := range value {
+			if t, ok := t.(string); ok {
+				types = append(types, t)
+			}
+		}
+		return types, len(types) > 0
+	}
+	return nil, false
+}
+
+func matchesAnyType(value interface{}, types []string) bool {
+	for _, t := range types {
+		if t == "integer" {
+			if n, ok := value.(float64); ok && n == math.Trunc(n) {
+				return true
+			}
+			continue
+		}
+		if jsonTypeName(value) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeName names the JSON type of a value decoded by encoding/json
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
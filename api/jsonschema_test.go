@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, text string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		t.Fatalf("decode %s: %v", text, err)
+	}
+	return value
+}
+
+func TestSchemaValidator(t *testing.T) {
+	const person = `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer"},
+			"role": {"enum": ["admin", "user"]},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"friends": {"type": "array", "items": {"$ref": "#"}}
+		},
+		"required": ["name"],
+		"additionalProperties": false
+	}`
+	const stepsWithDefs = `{
+		"$defs": {"step": {"type": "object", "properties": {"next": {"anyOf": [{"$ref": "#/$defs/step"}, {"type": "null"}]}}}},
+		"$ref": "#/$defs/step"
+	}`
+
+	tests := []struct {
+		name    string
+		schema  string
+		value   string
+		wantErr string
+	}{
+		{"conforming object", person, `{"name": "Ada", "age": 36, "role": "admin", "tags": ["a"]}`, ""},
+		{"recursive ref", person, `{"name": "Ada", "friends": [{"name": "Bob", "friends": []}]}`, ""},
+		{"missing required", person, `{"age": 36}`, `$: missing required property "name"`},
+		{"wrong type", person, `{"name": 7}`, "$.name: expected string, got number"},
+		{"integer with fraction", person, `{"name": "Ada", "age": 3.5}`, "$.age: expected integer, got number"},
+		{"not in enum", person, `{"name": "Ada", "role": "root"}`, "$.role: root is not one of [admin user]"},
+		{"bad array item", person, `{"name": "Ada", "tags": ["a", 1]}`, "$.tags[1]: expected string, got number"},
+		{"unexpected property", person, `{"name": "Ada", "email": "a@b"}`, "$.email: unexpected property"},
+		{"bad recursive item", person, `{"name": "Ada", "friends": [{}]}`, `$.friends[0]: missing required property "name"`},
+		{"defs chain", stepsWithDefs, `{"next": {"next": null}}`, ""},
+		{"defs chain bad link", stepsWithDefs, `{"next": 1}`, "$.next: does not match any of the allowed schemas"},
+		{"const", `{"const": "x"}`, `"y"`, "$: expected x"},
+		{"unresolvable ref", `{"$ref": "#/$defs/missing"}`, `{}`, `$: unresolvable $ref "#/$defs/missing"`},
+		{"remote ref", `{"$ref": "other.json"}`, `{}`, `$: unsupported $ref "other.json"`},
+		{"self ref", `{"$ref": "#"}`, `{}`, `$: cyclic $ref "#"`},
+		{"defs self ref", `{"$defs": {"a": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`, `1`, `$: cyclic $ref "#/$defs/a"`},
+		{"anyOf self ref", `{"$defs": {"a": {"anyOf": [{"$ref": "#/$defs/a"}]}}, "$ref": "#/$defs/a"}`, `1`, `$: cyclic $ref "#/$defs/a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema := decodeJSON(t, tt.schema).(map[string]interface{})
+			err := schemaValidator{root: schema}.validate(schema, decodeJSON(t, tt.value), "$")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("validate() = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchemaValidatorCheckRefs(t *testing.T) {
+	tests := []struct {
+		name      string
+		schema    string
+		wantErr   string
+		wantCycle bool
+	}{
+		{"no refs", `{"type": "object"}`, "", false},
+		{"recursive through properties", `{"type": "object", "properties": {"child": {"$ref": "#"}}}`, "", false},
+		{"defs", `{"$defs": {"a": {"type": "string"}}, "properties": {"x": {"$ref": "#/$defs/a"}}}`, "", false},
+		{"escaped pointer", `{"$defs": {"a/b": {"type": "string"}}, "$ref": "#/$defs/a~1b"}`, "", false},
+		{"root self ref", `{"$ref": "#"}`, `cyclic $ref "#"`, true},
+		{"defs loop", `{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}, "properties": {"x": {"$ref": "#/$defs/a"}}}`, `cyclic $ref "#/$defs/b"`, true},
+		{"anyOf loop", `{"$defs": {"a": {"anyOf": [{"type": "null"}, {"$ref": "#/$defs/a"}]}}}`, `cyclic $ref "#/$defs/a"`, true},
+		{"unresolvable", `{"properties": {"x": {"$ref": "#/$defs/missing"}}}`, `unresolvable $ref "#/$defs/missing"`, false},
+		{"nested in array", `{"anyOf": [{"$ref": "#/nowhere"}]}`, `unresolvable $ref "#/nowhere"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := &JSONSchemaFormat{Name: "test", Schema: decodeJSON(t, tt.schema).(map[string]interface{})}
+			err := format.CheckRefs()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("CheckRefs() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("CheckRefs() = %v, want %s", err, tt.wantErr)
+			}
+			if errors.Is(err, errCyclicRef) != tt.wantCycle {
+				t.Fatalf("errors.Is(err, errCyclicRef) = %v, want %v", !tt.wantCycle, tt.wantCycle)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaFormatCheck(t *testing.T) {
+	format := &JSONSchemaFormat{Name: "answer", Schema: map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"answer"},
+	}}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{"conforming output passes", `{"answer": 42}`, `{"answer": 42}`, false},
+		{"code fence is stripped", "```json\n{\"answer\": 42}\n```", `{"answer": 42}`, false},
+		{"bare code fence is stripped", "```\n{\"answer\": 42}\n```", `{"answer": 42}`, false},
+		{"non-conforming output is flagged", `{"other": 1}`, "", true},
+		{"invalid JSON is flagged", `answer: 42`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := format.Check(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Check() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
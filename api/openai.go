@@ -2,12 +2,20 @@ package api
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
-	"github.com/google/uuid"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/JessonChan/longcat-web-api/config"
 	"github.com/JessonChan/longcat-web-api/logging"
 )
 
@@ -17,11 +25,113 @@ type ChatCompletionRequest struct {
 	Messages  []OpenaiMessage `json:"messages"`
 	Stream    bool            `json:"stream,omitempty"`
 	MaxTokens int             `json:"max_tokens,omitempty"`
+	// PreviousResponseID continues the conversation of an earlier response
+	// instead of matching it by message history
+	PreviousResponseID string `json:"previous_response_id,omitempty"`
+	// MaxCompletionTokens supersedes max_tokens in newer OpenAI clients
+	MaxCompletionTokens int `json:"max_completion_tokens,omitempty"`
+	// StreamOptions tunes a streamed response; see StreamOptions
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	// ParallelToolCalls set to false limits a response to one tool call; see
+	// WithSerialToolCalls
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+	// Metadata and Store are accepted so common client payloads round-trip
+	// harmlessly; metadata is kept with the conversation for debugging
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Store    bool              `json:"store,omitempty"`
+	// Modalities and Audio request multimodal output, which LongCat cannot
+	// produce; anything beyond text is rejected
+	Modalities []string        `json:"modalities,omitempty"`
+	Audio      json.RawMessage `json:"audio,omitempty"`
+	// Prediction carries predicted outputs for speculative decoding. LongCat
+	// has no use for it, so it is accepted and ignored: responses are not
+	// accelerated.
+	Prediction json.RawMessage `json:"prediction,omitempty"`
+	// ReasoningEffort switches LongCat's deep thinking on unless it is
+	// "none"; LongCat has no thinking budget, so the levels are not
+	// distinguished further. Verbosity is accepted and ignored.
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	Verbosity       string `json:"verbosity,omitempty"`
+	// ServiceTier is accepted but has no effect: LongCat has a single tier,
+	// reported back as SERVICE_TIER
+	ServiceTier string `json:"service_tier,omitempty"`
+	// IncludeReasoning is OpenRouter's reasoning switch. Those clients read
+	// reasoning from the field named by REASONING_FIELD.
+	IncludeReasoning *bool           `json:"include_reasoning,omitempty"`
+	ResponseFormat   *ResponseFormat `json:"response_format,omitempty"`
+	// N is the number of choices. LongCat produces one reply per request,
+	// so anything above 1 is rejected rather than silently answered once.
+	N *int `json:"n,omitempty"`
 }
 
 type OpenaiMessage struct {
-	Role    string
-	Content any // string or []ClaudeMessageContent
+	Role  string        `json:"role"`
+	Name  string        `json:"name,omitempty"`
+	Parts []ContentPart `json:"content"` // String content is parsed as a single text part
+}
+
+// ContentPart is one entry of an OpenAI content array
+type ContentPart struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+}
+
+// UnmarshalJSON accepts content either as a plain string or as an array of parts
+func (m *OpenaiMessage) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Role    string          `json:"role"`
+		Name    string          `json:"name"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Role = raw.Role
+	m.Name = raw.Name
+	m.Parts = nil
+
+	content := strings.TrimSpace(string(raw.Content))
+	switch {
+	case content == "" || content == "null":
+		return nil
+	case content[0] == '"':
+		var text string
+		if err := json.Unmarshal(raw.Content, &text); err != nil {
+			return err
+		}
+		m.Parts = []ContentPart{{Type: "text", Text: text}}
+		return nil
+	default:
+		if err := json.Unmarshal(raw.Content, &m.Parts); err != nil {
+			return fmt.Errorf("invalid content for %s message: %w", raw.Role, err)
+		}
+		return nil
+	}
+}
+
+// StreamOptions is the stream_options object of a chat completion request.
+// Only include_usage changes the response; include_obfuscation is accepted,
+// but no obfuscation padding is sent.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage,omitempty"`
+	// Ignored lists the options the gateway does not implement
+	Ignored []string `json:"-"`
+}
+
+// UnmarshalJSON keeps the options the gateway understands and ignores the
+// rest whatever their type, so options from newer SDKs never fail a request
+func (o *StreamOptions) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	for name, value := range fields {
+		if name != "include_usage" || json.Unmarshal(value, &o.IncludeUsage) != nil {
+			o.Ignored = append(o.Ignored, name)
+		}
+	}
+	sort.Strings(o.Ignored)
+	return nil
 }
 
 // OpenAI compatible response structures - ENHANCED
@@ -31,33 +141,140 @@ type ChatCompletionChunk struct {
 	Created int64    `json:"created"`
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
+	// ServiceTier is filled in by the streaming handler
+	ServiceTier string `json:"service_tier,omitempty"`
+	// SystemFingerprint is always null; LongCat has no equivalent
+	SystemFingerprint *string `json:"system_fingerprint"`
+	// Usage is set on the final chunk for usage accounting and, with
+	// STREAM_USAGE_UPDATES, on every streamed chunk as a running count
+	Usage *Usage `json:"-"`
+	// StreamUsage is the non-standard usage the streaming handler sends
+	StreamUsage *Usage `json:"usage,omitempty"`
+	// ReasoningField is where the response reports reasoning; see
+	// WithReasoningField
+	ReasoningField string `json:"-"`
+	// ResponseSchema is the json_schema the finished content is checked against
+	ResponseSchema *JSONSchemaFormat `json:"-"`
+	// LongCatMessageID and LongCatParentID locate the reply in LongCat's own
+	// message tree
+	LongCatMessageID int `json:"-"`
+	LongCatParentID  int `json:"-"`
+	// Partial marks content cut short by PARTIAL_ON_TIMEOUT or
+	// MAX_RESPONSE_BYTES
+	Partial bool `json:"-"`
+	// IncludeUsage asks the streaming handler for a final usage chunk; see
+	// WithIncludeUsage
+	IncludeUsage bool `json:"-"`
+	// PromptTokens is the prompt token count when the chunk was produced,
+	// so consumers need not read the processor from another goroutine
+	PromptTokens int `json:"-"`
 }
 
 type Choice struct {
 	Delta        Delta  `json:"delta"`
 	Index        int    `json:"index"`
 	FinishReason string `json:"finish_reason,omitempty"` // OpenAI uses underscore
+	// Message is the complete reply of a non-streaming response; Delta
+	// carries the same content for clients that read it there
+	Message *ResponseMessage `json:"message,omitempty"`
+}
+
+// MarshalJSON always emits finish_reason and logprobs, as null while unset,
+// since strict OpenAI clients require both on every choice. LongCat reports
+// no log probabilities.
+func (c Choice) MarshalJSON() ([]byte, error) {
+	type plain Choice
+	var finishReason *string
+	if c.FinishReason != "" {
+		finishReason = &c.FinishReason
+	}
+	return json.Marshal(struct {
+		plain
+		FinishReason *string   `json:"finish_reason"`
+		Logprobs     *struct{} `json:"logprobs"`
+	}{plain(c), finishReason, nil})
+}
+
+// ResponseMessage is the assistant message of a non-streaming response.
+// Content and refusal are null rather than absent when empty.
+type ResponseMessage struct {
+	Role             string     `json:"role"`
+	Content          *string    `json:"content"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	Reasoning        string     `json:"reasoning,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	Refusal          *string    `json:"refusal"`
+}
+
+// newResponseMessage returns the message form of a complete delta
+func newResponseMessage(d Delta) *ResponseMessage {
+	message := &ResponseMessage{
+		Role:             "assistant",
+		ReasoningContent: d.ReasoningContent,
+		Reasoning:        d.Reasoning,
+		ToolCalls:        d.ToolCalls,
+	}
+	if d.Content != "" || len(d.ToolCalls) == 0 {
+		message.Content = &d.Content
+	}
+	if d.Refusal != "" {
+		message.Refusal = &d.Refusal
+	}
+	return message
 }
 
 type Delta struct {
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role             string     `json:"role,omitempty"`
+	Content          string     `json:"content,omitempty"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	Reasoning        string     `json:"reasoning,omitempty"` // OpenRouter's name for reasoning_content
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	Refusal          string     `json:"refusal,omitempty"` // Set when LongCat's content filter blocks the reply
+}
+
+// moveReasoning reports reasoning under field: "reasoning",
+// "reasoning_content" or "both"
+func (d *Delta) moveReasoning(field string) {
+	switch field {
+	case "reasoning":
+		d.Reasoning, d.ReasoningContent = d.ReasoningContent, ""
+	case "both":
+		d.Reasoning = d.ReasoningContent
+	}
+}
+
+type ToolCall struct {
+	Index    int              `json:"index"`
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
 // For non-streaming responses
 type ChatCompletionResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Choices []Choice `json:"choices"`
-	Usage   Usage    `json:"usage"`
+	ID          string   `json:"id"`
+	Object      string   `json:"object"`
+	Created     int64    `json:"created"`
+	Model       string   `json:"model"`
+	Choices     []Choice `json:"choices"`
+	Usage       Usage    `json:"usage"`
+	ServiceTier string   `json:"service_tier,omitempty"`
+	// SystemFingerprint is always null; LongCat has no equivalent
+	SystemFingerprint *string `json:"system_fingerprint"`
 }
 
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+	// Estimated is set when LongCat did not report usage and the gateway
+	// counted the tokens itself
+	Estimated bool `json:"estimated,omitempty"`
 }
 
 // LongCat specific structures needed for OpenAI service
@@ -80,7 +297,7 @@ type LongCatResponse struct {
 	ContentStatus  string          `json:"contentStatus"`
 	SearchResults  *string         `json:"searchResults"`
 	TokenInfo      TokenInfo       `json:"tokenInfo"`
-	PluginInfo     *string         `json:"pluginInfo"`
+	PluginInfo     json.RawMessage `json:"pluginInfo"`
 	LoadingStatus  bool            `json:"loadingStatus"`
 	Sensitive      bool            `json:"sensitive"`
 	LastOne        bool            `json:"lastOne"`
@@ -111,53 +328,442 @@ type StreamProcessor struct {
 	parentID       int
 	responseID     string
 	model          string
-	accumulated    strings.Builder // Tracks what we've already sent
-	lastContent    string          // Tracks the last full content from LongCat
+	// content is the answer of a non-streaming response, which is returned
+	// whole. A stream keeps only what its diff needs: how many bytes the
+	// client has and a copy of the last of them.
+	content        string
+	sentLen        int
+	sentTail       string
+	contentTokens  int  // Estimated tokens in the answer so far
+	stream         bool // Whether the client receives deltas
 	finishReason   string
 	tokenInfo      TokenInfo
+	phase          streamPhase     // Whether LongCat is currently reasoning or answering
+	reasoning      strings.Builder // Tracks the reasoning text we've already sent
+	toolCalls      []ToolCall      // Plugin invocations already surfaced as tool calls
+	seenPlugins    map[string]bool
+	serialTools    bool            // parallel_tool_calls:false, at most one tool call per response
+	prefill        string          // Assistant prefill LongCat may echo before continuing
+	promptEstimate int             // Local prompt token estimate until LongCat reports one
+	ctx            context.Context // Request context, used to sample body logging
+	roleSent       bool            // Whether a streamed chunk has carried the assistant role
+	runningUsage   Usage           // Last running usage streamed, see STREAM_USAGE_UPDATES
+}
+
+// streamPhase tracks LongCat's reasoning-then-answer progression
+type streamPhase int
+
+const (
+	phaseStarting streamPhase = iota
+	phaseReasoning
+	phaseContent
+)
+
+// advancePhase moves the processor through reasoning -> content based on the
+// status fields of each frame. Phases never move backwards.
+func (p *StreamProcessor) advancePhase(longCatResp LongCatResponse) {
+	next := p.phase
+	switch {
+	case longCatResp.ContentStatus != "" || longCatResp.Content != "":
+		next = phaseContent
+	case longCatResp.ReasonStatus != "" && longCatResp.ReasonStatus != "FINISHED":
+		next = phaseReasoning
+	}
+	if next > p.phase {
+		logging.LogDebug("Stream phase %d -> %d (reasonStatus=%q, contentStatus=%q)", p.phase, next, longCatResp.ReasonStatus, longCatResp.ContentStatus)
+		p.phase = next
+	}
+}
+
+// pluginToolCalls returns tool calls for plugin invocations not yet sent
+func (p *StreamProcessor) pluginToolCalls(longCatResp LongCatResponse) []ToolCall {
+	if !config.AppConfig.PluginInfo || len(longCatResp.PluginInfo) == 0 {
+		return nil
+	}
+
+	plugins, err := parsePluginInfo(longCatResp.PluginInfo)
+	if err != nil {
+		logging.LogDebug("Ignoring plugin info: %v", err)
+		return nil
+	}
+
+	var calls []ToolCall
+	for _, plugin := range plugins {
+		key := plugin.ID
+		if key == "" {
+			key = plugin.Name
+		}
+		if plugin.Name == "" || p.seenPlugins[key] {
+			continue
+		}
+		if p.seenPlugins == nil {
+			p.seenPlugins = make(map[string]bool)
+		}
+		p.seenPlugins[key] = true
+
+		// Later invocations are deferred to the client's next turn, where
+		// LongCat makes them again if the first tool's result still calls for them
+		if p.serialTools && len(p.toolCalls) > 0 {
+			logging.LogDebug("Deferring tool call %s, parallel_tool_calls is false", plugin.Name)
+			continue
+		}
+
+		call := plugin.toToolCall(len(p.toolCalls))
+		p.toolCalls = append(p.toolCalls, call)
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// promptTokens returns LongCat's prompt token count, or the local estimate
+// while LongCat has not reported one
+func (p *StreamProcessor) promptTokens() int {
+	if p.tokenInfo.PromptTokens > 0 {
+		return p.tokenInfo.PromptTokens
+	}
+	return p.promptEstimate
+}
+
+// completionTokens returns LongCat's completion token count, or counts the
+// text sent so far when LongCat has not reported one
+func (p *StreamProcessor) completionTokens() int {
+	if p.tokenInfo.CompletionTokens > 0 {
+		return p.tokenInfo.CompletionTokens
+	}
+	return tokenizerFor(p.model).CountTokens(p.reasoning.String()) + p.contentTokens
+}
+
+// usage returns the token usage of the response so far
+func (p *StreamProcessor) usage() *Usage {
+	prompt, completion := p.promptTokens(), p.completionTokens()
+	return &Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      prompt + completion,
+		Estimated:        !p.tokenInfo.HasTokens,
+	}
+}
+
+// streamedUsage returns usage() for a chunk before the final one. The local
+// estimate can overshoot what LongCat reports later, so the counts are held
+// from going down; the final chunk's usage() is the authoritative one.
+func (p *StreamProcessor) streamedUsage() *Usage {
+	usage := p.usage()
+	usage.PromptTokens = max(usage.PromptTokens, p.runningUsage.PromptTokens)
+	usage.CompletionTokens = max(usage.CompletionTokens, p.runningUsage.CompletionTokens)
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	p.runningUsage = *usage
+	return usage
+}
+
+// snapshot records the token counts on a chunk about to leave ProcessStream.
+// A finishing chunk always carries its usage, which the Claude conversion
+// reports in message_delta.
+func (p *StreamProcessor) snapshot(chunk ChatCompletionChunk) ChatCompletionChunk {
+	chunk.PromptTokens = p.promptTokens()
+	if chunk.Usage == nil && len(chunk.Choices) > 0 && chunk.Choices[0].FinishReason != "" {
+		chunk.Usage = p.usage()
+	}
+	return chunk
+}
+
+// defaultRefusal is reported when a flagged frame carries no notice of its own
+const defaultRefusal = "The response was blocked by LongCat's content filter."
+
+// refusalChunk builds the final chunk of a response that LongCat's content
+// filter blocked, carrying its notice as the refusal
+func (p *StreamProcessor) refusalChunk(longCatResp LongCatResponse, stream bool) ChatCompletionChunk {
+	refusal := longCatResp.Content
+	if refusal == "" || p.holds(refusal) {
+		refusal = defaultRefusal
+	}
+	p.finishReason = "content_filter"
+
+	delta := Delta{Refusal: refusal}
+	if !stream {
+		// Non-streaming callers only see this chunk, so carry what came before
+		delta.Content = p.content
+		delta.ReasoningContent = p.reasoning.String()
+		delta.ToolCalls = p.toolCalls
+	}
+	return ChatCompletionChunk{
+		ID:      p.responseID,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   p.model,
+		Choices: []Choice{{
+			Delta:        delta,
+			Index:        0,
+			FinishReason: p.finishReason,
+		}},
+		Usage:            p.usage(),
+		LongCatMessageID: p.messageID,
+		LongCatParentID:  p.parentID,
+	}
+}
+
+// partialChunk builds the only chunk of a non-streaming response cut short
+// by a timeout or MAX_RESPONSE_BYTES, carrying the content received so far
+func (p *StreamProcessor) partialChunk(finishReason string) ChatCompletionChunk {
+	p.finishReason = finishReason
+	return ChatCompletionChunk{
+		ID:      p.responseID,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   p.model,
+		Choices: []Choice{{
+			Delta: Delta{
+				Role:             "assistant",
+				Content:          p.content,
+				ReasoningContent: p.reasoning.String(),
+				ToolCalls:        p.toolCalls,
+			},
+			Index:        0,
+			FinishReason: p.finishReason,
+		}},
+		Usage:            p.usage(),
+		LongCatMessageID: p.messageID,
+		LongCatParentID:  p.parentID,
+		Partial:          true,
+	}
+}
+
+// truncateToLimit cuts the accumulated reasoning and content to
+// MAX_RESPONSE_BYTES, reasoning first as it comes first, and reports whether
+// the limit was exceeded
+func (p *StreamProcessor) truncateToLimit() bool {
+	limit := config.AppConfig.MaxResponseBytes
+	if limit <= 0 || p.reasoning.Len()+len(p.content) <= limit {
+		return false
+	}
+	if p.reasoning.Len() > limit {
+		reasoning := truncateUTF8(p.reasoning.String(), limit)
+		p.reasoning.Reset()
+		p.reasoning.WriteString(reasoning)
+	}
+	p.content = truncateUTF8(p.content, limit-p.reasoning.Len())
+	p.contentTokens = tokenizerFor(p.model).CountTokens(p.content)
+	return true
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// timedOut reports whether err comes from TIMEOUT_SECONDS or a request
+// deadline rather than a broken stream
+func timedOut(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// completeRunesEnd returns the length of s without trailing replacement
+// characters, which stand in for a multi-byte character cut off mid-frame
+func completeRunesEnd(s string) int {
+	end := len(s)
+	for end > 0 {
+		r, size := utf8.DecodeLastRuneInString(s[:end])
+		if r != utf8.RuneError {
+			break
+		}
+		end -= size
+	}
+	return end
+}
+
+// sentTailBytes is how much of the sent content a stream keeps to tell
+// LongCat extending it from rewriting it
+const sentTailBytes = 64
+
+// continues reports whether text starts with the content already sent, as
+// far as the kept tail can tell
+func (p *StreamProcessor) continues(text string) bool {
+	return len(text) >= p.sentLen && text[p.sentLen-len(p.sentTail):p.sentLen] == p.sentTail
+}
+
+// holds reports whether text is the content already sent
+func (p *StreamProcessor) holds(text string) bool {
+	return len(text) == p.sentLen && p.continues(text)
+}
+
+// dropsTrailingSpace reports whether text is the content already sent
+// without some of its trailing whitespace
+func (p *StreamProcessor) dropsTrailingSpace(text string) bool {
+	dropped := p.sentLen - len(text)
+	if dropped <= 0 || dropped > len(p.sentTail) {
+		return false
+	}
+	kept := p.sentTail[:len(p.sentTail)-dropped]
+	return strings.TrimSpace(p.sentTail[len(kept):]) == "" && strings.HasSuffix(text, kept)
+}
+
+// recordSent notes that the client now has n bytes of content ending in
+// tail. The tail is copied so the frame it came from can be collected.
+func (p *StreamProcessor) recordSent(n int, tail string) {
+	p.sentLen = n
+	p.sentTail = strings.Clone(tail[max(0, len(tail)-sentTailBytes):])
+}
+
+// stripPrefill removes an echoed assistant prefill from cumulative content so
+// the client only receives the continuation. Content that is still a partial
+// echo is held back; once the reply diverges from the prefill it is passed
+// through unchanged.
+func (p *StreamProcessor) stripPrefill(content string) string {
+	if p.prefill == "" || content == "" {
+		return content
+	}
+	trimmed := strings.TrimLeft(content, " \n")
+	if strings.HasPrefix(trimmed, p.prefill) {
+		return trimmed[len(p.prefill):]
+	}
+	if strings.HasPrefix(p.prefill, trimmed) {
+		return ""
+	}
+	logging.LogDebug("Reply does not echo the prefill, passing it through")
+	p.prefill = ""
+	return content
+}
+
+// reasoningDelta returns the reasoning text not yet sent to the client
+func (p *StreamProcessor) reasoningDelta(longCatResp LongCatResponse) string {
+	if delta := longCatResp.Choices[0].Delta.ReasoningContent; delta != nil && *delta != "" {
+		return *delta
+	}
+	// Like content, reasonContent is cumulative
+	sent := p.reasoning.String()
+	if len(longCatResp.ReasonContent) > len(sent) && strings.HasPrefix(longCatResp.ReasonContent, sent) {
+		return longCatResp.ReasonContent[len(sent):]
+	}
+	return ""
 }
 
 func NewStreamProcessor() *StreamProcessor {
-	return &StreamProcessor{
-		responseID:  uuid.New().String(),
-		model:       "LongCat-Flash",
-		accumulated: strings.Builder{},
-		lastContent: "",
+	p := &StreamProcessor{}
+	p.Reset()
+	return p
+}
+
+// Reset returns the processor to the state of a new one. A processor must be
+// reset before it is reused for another response, or content accumulated
+// from the previous stream would leak into the next.
+func (p *StreamProcessor) Reset() {
+	p.conversationID = ""
+	p.messageID = 0
+	p.parentID = 0
+	p.responseID = NewChatCompletionID()
+	p.model = "LongCat-Flash"
+	p.content = ""
+	p.sentLen = 0
+	p.sentTail = ""
+	p.contentTokens = 0
+	p.stream = false
+	p.finishReason = ""
+	p.tokenInfo = TokenInfo{}
+	p.runningUsage = Usage{}
+	p.phase = phaseStarting
+	p.reasoning.Reset()
+	// Emitted chunks may still reference the old tool calls, so the slice is
+	// dropped rather than truncated
+	p.toolCalls = nil
+	clear(p.seenPlugins)
+	p.serialTools = false
+	p.prefill = ""
+	p.promptEstimate = 0
+	p.ctx = context.Background()
+	p.roleSent = false
+}
+
+// markRole sets the assistant role on the first streamed chunk of a
+// response, as OpenAI does, or on every chunk with EMIT_ROLE_EVERY_CHUNK.
+// LongCat's own delta role is unreliable, so it is not consulted.
+func (p *StreamProcessor) markRole(chunk *ChatCompletionChunk) {
+	if !p.roleSent || config.AppConfig.RoleEveryChunk {
+		chunk.Choices[0].Delta.Role = "assistant"
+		p.roleSent = true
 	}
 }
 
+// processorPool recycles StreamProcessors between responses
+var processorPool = sync.Pool{
+	New: func() any { return new(StreamProcessor) },
+}
+
+// acquireStreamProcessor returns a reset processor from the pool
+func acquireStreamProcessor() *StreamProcessor {
+	p := processorPool.Get().(*StreamProcessor)
+	p.Reset()
+	return p
+}
+
+// releaseStreamProcessor returns p to the pool. It may only be called once
+// ProcessStream has closed its chunk channel and nothing else uses p.
+func releaseStreamProcessor(p *StreamProcessor) {
+	p.ctx = nil // Do not keep the request context alive
+	processorPool.Put(p)
+}
+
 func (p *StreamProcessor) ProcessStream(resp *http.Response, stream bool) (<-chan ChatCompletionChunk, <-chan error) {
 	chunks := make(chan ChatCompletionChunk)
 	errs := make(chan error, 1)
 
+	if responseID := responseIDFor(resp); responseID != "" {
+		p.responseID = responseID
+	}
+	p.prefill = prefillFor(resp)
+	p.serialTools = serialToolCallsFor(resp)
+	p.stream = stream
+	if resp.Request != nil {
+		p.ctx = resp.Request.Context()
+	}
+	p.promptEstimate = promptTokensFor(resp)
+	if model := modelFor(resp); model != "" {
+		p.model = model
+	}
+
 	go func() {
 		defer close(chunks)
 		defer close(errs)
 		defer resp.Body.Close()
 
-		scanner := bufio.NewScanner(resp.Body)
+		body, err := plainJSONBody(resp)
+		if err != nil {
+			errs <- err
+			return
+		}
+		scanner := bufio.NewScanner(body)
+		scanner.Split(scanSSELines)
 		for scanner.Scan() {
-			line := scanner.Text()
-			if !strings.HasPrefix(line, "data:") {
+			// Only data lines matter; event:, id:, retry: and comment lines are skipped
+			data, ok := sseData(scanner.Text())
+			if !ok {
 				continue
 			}
-
-			data := strings.TrimPrefix(line, "data:")
-			data = strings.TrimSpace(data)
 			if data == "[DONE]" {
 				break
 			}
 
 			var longCatResp LongCatResponse
 			if err := json.Unmarshal([]byte(data), &longCatResp); err != nil {
-				errs <- fmt.Errorf("failed to unmarshal response: %w", err)
+				errs <- &UpstreamError{fmt.Errorf("failed to unmarshal response: %w", err)}
 				return
 			}
+			// Frames without choices, such as a plain JSON body, get an empty one
+			if len(longCatResp.Choices) == 0 {
+				longCatResp.Choices = []LongCatChoice{{}}
+			}
 
 			// Log LongCat response data in verbose mode
-			logging.LogDebug("LongCat Response: %+v", longCatResp)
+			logging.LogBody(p.ctx, "LongCat Response: %+v", longCatResp)
 
 			// Update processor state
+			p.advancePhase(longCatResp)
 			p.conversationID = longCatResp.ConversationID
 			p.messageID = longCatResp.MessageID
 			p.parentID = longCatResp.ParentID
@@ -168,15 +774,23 @@ func (p *StreamProcessor) ProcessStream(resp *http.Response, stream bool) (<-cha
 				p.tokenInfo = longCatResp.TokenInfo
 			}
 
+			// A flagged frame ends the response as a refusal
+			if longCatResp.Sensitive {
+				chunk := p.refusalChunk(longCatResp, stream)
+				if stream {
+					p.markRole(&chunk)
+				}
+				chunks <- p.snapshot(chunk)
+				break
+			}
+
 			// Accumulate content
 			// LongCat sends cumulative content (full content so far), not deltas
 			// We need to track this to calculate deltas for streaming
-			if longCatResp.Content != "" {
-				p.lastContent = longCatResp.Content
-			}
+			longCatResp.Content = p.stripPrefill(longCatResp.Content)
 
 			// Determine finish reason
-			finishReason := longCatResp.Choices[0].FinishReason
+			finishReason := openAIFinishReason(longCatResp.Choices[0].FinishReason)
 			if finishReason == "" && longCatResp.LastOne {
 				finishReason = "stop"
 			}
@@ -188,18 +802,36 @@ func (p *StreamProcessor) ProcessStream(resp *http.Response, stream bool) (<-cha
 			}
 
 			// Convert to OpenAI format with proper delta handling
-			chunk := p.convertToOpenAIFormat(longCatResp, true)
+			chunk, err := p.convertToOpenAIFormat(longCatResp, true)
+			if err != nil && stream {
+				errs <- &UpstreamError{err}
+				return
+			}
+			final := longCatResp.LastOne || finishReason == "stop"
+
+			// MAX_RESPONSE_BYTES bounds what a non-streaming response holds
+			if !stream && p.truncateToLimit() {
+				logging.LogInfo("Response exceeded MAX_RESPONSE_BYTES, truncated to %d bytes", len(p.content)+p.reasoning.Len())
+				chunks <- p.snapshot(p.partialChunk("length"))
+				break
+			}
+			if chunk != nil && final {
+				chunk.Usage = p.usage()
+			} else if chunk != nil && stream && config.AppConfig.StreamUsage {
+				chunk.Usage = p.streamedUsage()
+			}
 			if chunk != nil {
 				// Log OpenAI conversion output in verbose mode
-				logging.LogDebug("OpenAI Conversion Output: %+v", *chunk)
+				logging.LogBody(p.ctx, "OpenAI Conversion Output: %+v", *chunk)
 				
 				if stream {
-					chunks <- *chunk
+					p.markRole(chunk)
+					chunks <- p.snapshot(*chunk)
 				}
 			}
 
 			// If this is the final chunk, ensure it's properly handled
-			if longCatResp.LastOne || finishReason == "stop" {
+			if final {
 				// For streaming, send a final chunk with finish reason if not already included
 				if stream && chunk != nil && chunk.Choices[0].FinishReason == "" && finishReason != "" {
 					finalChunk := ChatCompletionChunk{
@@ -216,49 +848,104 @@ func (p *StreamProcessor) ProcessStream(resp *http.Response, stream bool) (<-cha
 								FinishReason: finishReason,
 							},
 						},
+						Usage: chunk.Usage,
 					}
-					chunks <- finalChunk
+					p.markRole(&finalChunk)
+					chunks <- p.snapshot(finalChunk)
 				}
 				if !stream && chunk != nil {
-					chunks <- *chunk
+					// Non-streaming callers only see this chunk, so carry the full content
+					chunk.Choices[0].Delta.Content = p.content
+					chunk.Choices[0].Delta.ReasoningContent = p.reasoning.String()
+					chunk.Choices[0].Delta.ToolCalls = p.toolCalls
+					chunks <- p.snapshot(*chunk)
 				}
 				break
 			}
 		}
 
 		if err := scanner.Err(); err != nil {
-			errs <- fmt.Errorf("scanner error: %w", err)
+			// PARTIAL_ON_TIMEOUT answers a non-streaming request with what
+			// LongCat produced before the deadline
+			if !stream && config.AppConfig.PartialOnTimeout && timedOut(err) && p.content != "" {
+				logging.LogInfo("LongCat timed out, returning %d bytes of partial content", len(p.content))
+				chunks <- p.snapshot(p.partialChunk(config.AppConfig.PartialFinish))
+				return
+			}
+			errs <- &UpstreamError{fmt.Errorf("scanner error: %w", err)}
 		}
 	}()
 
 	return chunks, errs
 }
 
-// convertToOpenAIFormat - ENHANCED to properly format OpenAI responses
-func (p *StreamProcessor) convertToOpenAIFormat(longCatResp LongCatResponse, stream bool) *ChatCompletionChunk {
+// convertToOpenAIFormat - ENHANCED to properly format OpenAI responses. It
+// reports ErrContentRewritten when LongCat changed content already sent;
+// the chunk then carries the new content for a non-streaming response.
+func (p *StreamProcessor) convertToOpenAIFormat(longCatResp LongCatResponse, stream bool) (*ChatCompletionChunk, error) {
 	// For streaming, we need to handle deltas carefully
 	if stream {
-		// First chunk should include the role
-		role := ""
-		if longCatResp.Choices[0].Delta.Role != "" && longCatResp.ContentStatus == "PROCESSING" {
-			role = "assistant"
-		}
+		// Reasoning is emitted before content; a frame that finishes reasoning
+		// and starts the answer carries both, so neither delta is lost
+		reasoning := p.reasoningDelta(longCatResp)
+		toolCalls := p.pluginToolCalls(longCatResp)
 
 		// Calculate delta content
 		content := ""
-		if longCatResp.Choices[0].Delta.Content != "" {
-			// If LongCat provides delta directly, use it
-			content = longCatResp.Choices[0].Delta.Content
-		} else if longCatResp.Content != "" {
-			// Calculate the delta by comparing with what we've already sent
-			accumulated := p.accumulated.String()
-			if len(longCatResp.Content) > len(accumulated) {
-				// New content is everything after what we've already sent
-				content = longCatResp.Content[len(accumulated):]
-			} else if longCatResp.Content != accumulated {
-				// If content is different but not longer, send the difference
-				// This handles cases where the final message might be shorter due to cleanup
-				content = longCatResp.Content
+		full := "" // The whole answer after this chunk, when the frame carries it
+		final := false
+		rewritten := false
+		// No answer text is expected while LongCat is still reasoning
+		if p.phase == phaseContent {
+			if longCatResp.Choices[0].Delta.Content != "" {
+				// If LongCat provides delta directly, use it
+				content = longCatResp.Choices[0].Delta.Content
+			} else if longCatResp.Content != "" {
+				final = longCatResp.LastOne || longCatResp.ContentStatus == "FINISHED"
+				normalize := config.AppConfig.TrailingSpace != "keep"
+				text := longCatResp.Content
+				if normalize && final {
+					text = strings.TrimRightFunc(text, unicode.IsSpace)
+				}
+
+				// New content is everything after the prefix the client already
+				// has, up to the last complete character: a character LongCat split
+				// across frames arrives as U+FFFD and is only sent once it is whole
+				end := len(text)
+				if !final {
+					end = completeRunesEnd(text)
+					if normalize {
+						// Trailing whitespace waits until text follows it, so
+						// the end of the reply can still be normalized
+						end = len(strings.TrimRightFunc(text[:end], unicode.IsSpace))
+					}
+				}
+				switch {
+				case p.continues(text):
+					if end > p.sentLen {
+						content = text[p.sentLen:end]
+						full = text[:end]
+					}
+				case !final && len(text) < p.sentLen, p.dropsTrailingSpace(text):
+					// Shorter text needs nothing while LongCat may still catch up,
+					// nor when all it dropped at the end is whitespace
+				default:
+					// Deltas cannot take back what the client already has
+					logging.LogDebug("LongCat rewrote content sent up to byte %d", p.sentLen)
+					full = text[:end]
+					rewritten = true
+				}
+
+				held := p.sentTail
+				if full != "" {
+					held = full
+				}
+				if final && config.AppConfig.TrailingSpace == "newline" && held != "" && !strings.HasSuffix(held, "\n") {
+					content += "\n"
+					if full != "" {
+						full += "\n"
+					}
+				}
 			}
 		}
 
@@ -271,41 +958,55 @@ func (p *StreamProcessor) convertToOpenAIFormat(longCatResp LongCatResponse, str
 			Choices: []Choice{
 				{
 					Delta: Delta{
-						Role:    role,
-						Content: content,
+						Content:          content,
+						ReasoningContent: reasoning,
+						ToolCalls:        toolCalls,
 					},
 					Index:        0,
 					FinishReason: p.finishReason,
 				},
 			},
+			LongCatMessageID: p.messageID,
+			LongCatParentID:  p.parentID,
 		}
 
-		// Update accumulated content with what we're sending
-		if content != "" {
-			p.accumulated.WriteString(content)
+		// Update what the client has with what we're sending. The estimate
+		// adds up deltas and is redone on the whole answer when it is known.
+		tokenizer := tokenizerFor(p.model)
+		if full != "" {
+			p.recordSent(len(full), full)
+			if !p.stream {
+				p.content = full
+			}
+			if final || rewritten {
+				p.contentTokens = tokenizer.CountTokens(full)
+			} else {
+				p.contentTokens += tokenizer.CountTokens(content)
+			}
+		} else if content != "" {
+			p.recordSent(p.sentLen+len(content), p.sentTail+content)
+			if !p.stream {
+				p.content += content
+			}
+			p.contentTokens += tokenizer.CountTokens(content)
+		}
+		if reasoning != "" {
+			p.reasoning.WriteString(reasoning)
 		}
 
-		// Only return chunk if it has content or is the final chunk
-		if content != "" || p.finishReason != "" || role != "" {
-			return chunk
+		var err error
+		if rewritten {
+			err = ErrContentRewritten
 		}
-		
-		// Special case: if this is the final message and we haven't sent all content yet,
-		// ensure we send the remaining content
-		if longCatResp.LastOne || longCatResp.ContentStatus == "FINISHED" {
-			accumulated := p.accumulated.String()
-			if longCatResp.Content != "" && longCatResp.Content != accumulated {
-				// Send the remaining content as the final chunk
-				chunk.Choices[0].Delta.Content = longCatResp.Content
-				return chunk
-			}
+		// Only return chunk if it has content or is the final chunk
+		if content != "" || reasoning != "" || len(toolCalls) > 0 || p.finishReason != "" {
+			return chunk, err
 		}
-		
-		return nil
+		return nil, err
 	}
 
 	// For non-streaming, we'll handle this in the handler
-	return nil
+	return nil, nil
 }
 
 // OpenAIService implements APIService for OpenAI compatibility
@@ -330,15 +1031,24 @@ func (s *OpenAIService) ConvertResponse(resp *http.Response, stream bool) (<-cha
 		defer close(errs)
 		defer resp.Body.Close()
 
-		processor := NewStreamProcessor()
+		processor := acquireStreamProcessor()
 		rawChunks, rawErrs := processor.ProcessStream(resp, stream)
+		reasoningField := reasoningFieldFor(resp)
+		responseSchema := responseSchemaFor(resp)
+		includeUsage := includeUsageFor(resp)
 
 		for {
 			select {
 			case chunk, ok := <-rawChunks:
 				if !ok {
+					// The stream goroutine is done with the processor. On the
+					// error paths it may still be running, so it is left to the GC.
+					releaseStreamProcessor(processor)
 					return
 				}
+				chunk.ReasoningField = reasoningField
+				chunk.ResponseSchema = responseSchema
+				chunk.IncludeUsage = includeUsage
 				select {
 				case chunks <- chunk:
 				case <-time.After(5 * time.Second):
@@ -369,16 +1079,37 @@ func (s *OpenAIService) GetResponseContentType(stream bool) string {
 func (s *OpenAIService) HandleNonStreamingResponse(w http.ResponseWriter, chunks <-chan interface{}, errs <-chan error) error {
 	// Collect all chunks and build final response
 	var fullContent strings.Builder
+	var fullReasoning strings.Builder
+	var refusal strings.Builder
+	var toolCalls []ToolCall
 	var finishReason string
-	responseID := uuid.New().String()
+	responseID := NewChatCompletionID()
 	model := "LongCat-Flash"
-	tokenInfo := TokenInfo{}
+	usage := Usage{}
+	reasoningField := ""
+	var responseSchema *JSONSchemaFormat
 
 	// Process all chunks
 	for {
 		select {
 		case chunk, ok := <-chunks:
 			if !ok {
+				if fullContent.Len() == 0 && refusal.Len() == 0 && len(toolCalls) == 0 && config.AppConfig.EmptyResponseErr {
+					return ErrEmptyResponse
+				}
+				content := fullContent.String()
+				if responseSchema != nil && refusal.Len() == 0 {
+					checked, err := responseSchema.Check(content)
+					switch {
+					case err == nil:
+						content = checked
+					case responseSchema.Strict:
+						return &UpstreamError{err}
+					default:
+						logging.LogDebug("Returning non-conforming structured output: %v", err)
+					}
+				}
+
 				// Build final response
 				response := ChatCompletionResponse{
 					ID:      responseID,
@@ -387,18 +1118,20 @@ func (s *OpenAIService) HandleNonStreamingResponse(w http.ResponseWriter, chunks
 					Model:   model,
 					Choices: []Choice{{
 						Delta: Delta{
-							Role:    "assistant",
-							Content: fullContent.String(),
+							Role:             "assistant",
+							Content:          content,
+							ReasoningContent: fullReasoning.String(),
+							ToolCalls:        toolCalls,
+							Refusal:          refusal.String(),
 						},
 						Index:        0,
 						FinishReason: finishReason,
 					}},
-					Usage: Usage{
-						PromptTokens:     tokenInfo.PromptTokens,
-						CompletionTokens: tokenInfo.CompletionTokens,
-						TotalTokens:      tokenInfo.TotalTokens,
-					},
+					Usage:       usage,
+					ServiceTier: config.AppConfig.ServiceTier,
 				}
+				response.Choices[0].Delta.moveReasoning(reasoningField)
+				response.Choices[0].Message = newResponseMessage(response.Choices[0].Delta)
 
 				w.Header().Set("Content-Type", "application/json")
 				return json.NewEncoder(w).Encode(response)
@@ -407,12 +1140,20 @@ func (s *OpenAIService) HandleNonStreamingResponse(w http.ResponseWriter, chunks
 			if openAIChunk, ok := chunk.(ChatCompletionChunk); ok {
 				if openAIChunk.Choices != nil && len(openAIChunk.Choices) > 0 {
 					fullContent.WriteString(openAIChunk.Choices[0].Delta.Content)
+					fullReasoning.WriteString(openAIChunk.Choices[0].Delta.ReasoningContent)
+					refusal.WriteString(openAIChunk.Choices[0].Delta.Refusal)
+					toolCalls = append(toolCalls, openAIChunk.Choices[0].Delta.ToolCalls...)
 					if openAIChunk.Choices[0].FinishReason != "" {
 						finishReason = openAIChunk.Choices[0].FinishReason
 					}
 				}
+				if openAIChunk.Usage != nil {
+					usage = *openAIChunk.Usage
+				}
 				model = openAIChunk.Model
 				responseID = openAIChunk.ID
+				reasoningField = openAIChunk.ReasoningField
+				responseSchema = openAIChunk.ResponseSchema
 			}
 
 		case err := <-errs:
@@ -423,50 +1164,150 @@ func (s *OpenAIService) HandleNonStreamingResponse(w http.ResponseWriter, chunks
 	}
 }
 
-func (s *OpenAIService) HandleStreamingResponse(w http.ResponseWriter, flusher http.Flusher, chunks <-chan interface{}, errs <-chan error) error {
+func (s *OpenAIService) HandleStreamingResponse(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, chunks <-chan interface{}, errs <-chan error) error {
+	sse := newSSEWriter(w, flusher)
+	defer sse.close()
 	hasReceivedContent := false
+	// Chunks name the response too, but the request does so before any arrive
+	responseID := ResponseID(ctx)
+	if responseID == "" {
+		responseID = NewChatCompletionID()
+	}
+	model := modelIn(ctx)
+	if model == "" {
+		model = "LongCat-Flash"
+	}
+
+	deadline, stopDeadline := streamDeadline()
+	defer stopDeadline()
+
+	// Streamed structured output can only be checked once it is complete
+	var responseSchema *JSONSchemaFormat
+	var content strings.Builder
+	// With stream_options.include_usage the usage follows in its own chunk
+	var includeUsage bool
+	var usage *Usage
 
 	for {
 		select {
+		case <-deadline:
+			// Stream ran too long, finish it as truncated output
+			finalChunk := ChatCompletionChunk{
+				ID:      responseID,
+				Object:  "chat.completion.chunk",
+				Created: time.Now().Unix(),
+				Model:   model,
+				Choices: []Choice{{
+					Delta:        Delta{},
+					Index:        0,
+					FinishReason: "length",
+				}},
+				ServiceTier: config.AppConfig.ServiceTier,
+			}
+			if data, err := json.Marshal(finalChunk); err == nil {
+				sse.send("", data)
+			}
+			sse.send("", []byte("[DONE]"))
+			return ErrMaxStreamDuration
+
 		case chunk, ok := <-chunks:
 			if !ok {
+				if !hasReceivedContent && config.AppConfig.EmptyResponseErr {
+					// Report the empty upstream as an error instead of a fake answer
+					s.sendErrorChunk(sse, ErrEmptyResponse)
+					sse.send("", []byte("[DONE]"))
+					return ErrEmptyResponse
+				}
 				if !hasReceivedContent {
 					// Send a default chunk if no content was received
 					defaultChunk := ChatCompletionChunk{
-						ID:      uuid.New().String(),
+						ID:      responseID,
 						Object:  "chat.completion.chunk",
 						Created: time.Now().Unix(),
-						Model:   "LongCat-Flash",
+						Model:   model,
 						Choices: []Choice{{
 							Delta: Delta{
 								Role:    "assistant",
-								Content: "I apologize, but I'm unable to process your request at the moment.",
+								Content: config.AppConfig.EmptyResponseMsg,
 							},
 							Index:        0,
 							FinishReason: "stop",
 						}},
+						ServiceTier: config.AppConfig.ServiceTier,
 					}
 					if data, err := json.Marshal(defaultChunk); err == nil {
-						fmt.Fprintf(w, "data: %s\n\n", data)
-						flusher.Flush()
+						sse.send("", data)
+					}
+				}
+				if responseSchema != nil && responseSchema.Strict {
+					if _, err := responseSchema.Check(content.String()); err != nil {
+						s.sendErrorChunk(sse, err)
+						sse.send("", []byte("[DONE]"))
+						return &UpstreamError{err}
+					}
+				}
+				if includeUsage && usage != nil {
+					usageChunk := ChatCompletionChunk{
+						ID:          responseID,
+						Object:      "chat.completion.chunk",
+						Created:     time.Now().Unix(),
+						Model:       model,
+						Choices:     []Choice{},
+						ServiceTier: config.AppConfig.ServiceTier,
+						StreamUsage: usage,
+					}
+					if data, err := json.Marshal(usageChunk); err == nil {
+						sse.send("", data)
 					}
 				}
 				// Send final [DONE] marker
-				fmt.Fprintf(w, "data: [DONE]\n\n")
-				flusher.Flush()
+				sse.send("", []byte("[DONE]"))
 				return nil
 			}
 
 			hasReceivedContent = true
+			if openAIChunk, ok := chunk.(ChatCompletionChunk); ok {
+				responseID = openAIChunk.ID
+				model = openAIChunk.Model
+				openAIChunk.ServiceTier = config.AppConfig.ServiceTier
+				if config.AppConfig.StreamUsage {
+					openAIChunk.StreamUsage = openAIChunk.Usage
+				}
+				if openAIChunk.Usage != nil {
+					usage = openAIChunk.Usage
+				}
+				includeUsage = openAIChunk.IncludeUsage
+				for i := range openAIChunk.Choices {
+					openAIChunk.Choices[i].Delta.moveReasoning(openAIChunk.ReasoningField)
+				}
+				if responseSchema = openAIChunk.ResponseSchema; responseSchema != nil && len(openAIChunk.Choices) > 0 {
+					content.WriteString(openAIChunk.Choices[0].Delta.Content)
+				}
+				chunk = openAIChunk
+			}
 			if data, err := json.Marshal(chunk); err == nil {
-				fmt.Fprintf(w, "data: %s\n\n", data)
-				flusher.Flush()
+				sse.send("", data)
 			}
 
 		case err := <-errs:
 			if err != nil {
+				s.sendErrorChunk(sse, err)
+				sse.send("", []byte("[DONE]"))
 				return fmt.Errorf("error processing stream: %w", err)
 			}
 		}
 	}
+}
+
+// sendErrorChunk reports an error in-band using OpenAI's streaming error shape
+func (s *OpenAIService) sendErrorChunk(sse *sseWriter, err error) {
+	errorChunk := map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": err.Error(),
+			"type":    "server_error",
+		},
+	}
+	if data, jsonErr := json.Marshal(errorChunk); jsonErr == nil {
+		sse.send("", data)
+	}
 }
\ No newline at end of file
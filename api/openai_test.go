@@ -0,0 +1,439 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+// longCatStream returns an upstream response streaming the given LongCat
+// frames as SSE, for a request carrying ctx
+func longCatStream(ctx context.Context, frames ...string) *http.Response {
+	var body strings.Builder
+	for _, frame := range frames {
+		body.WriteString("data:" + frame + "\n\n")
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://longcat.test/chat", nil)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(body.String())),
+		Request:    req,
+	}
+}
+
+// longCatFrame encodes a LongCat frame with the given cumulative content
+func longCatFrame(content string, last bool, tokens *TokenInfo) string {
+	frame := LongCatResponse{Content: content, LastOne: last, ContentStatus: "GENERATING"}
+	if last {
+		frame.ContentStatus = "FINISHED"
+	}
+	if tokens != nil {
+		frame.TokenInfo = *tokens
+	}
+	data, _ := json.Marshal(frame)
+	return string(data)
+}
+
+// sseDataLines returns the data of each event in an SSE body
+func sseDataLines(body string) []string {
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if value, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, value)
+		}
+	}
+	return data
+}
+
+// collectChunks drains a ProcessStream result
+func collectChunks(chunks <-chan ChatCompletionChunk, errs <-chan error) ([]ChatCompletionChunk, error) {
+	var got []ChatCompletionChunk
+	for chunk := range chunks {
+		got = append(got, chunk)
+	}
+	return got, <-errs
+}
+
+func TestProcessStreamSnapshotsTokens(t *testing.T) {
+	ctx := context.WithValue(context.Background(), promptTokensKey{}, 12)
+	tests := []struct {
+		name           string
+		tokens         *TokenInfo
+		wantPrompt     int
+		wantCompletion int
+		wantEstimated  bool
+	}{
+		{"estimated", nil, 12, 0, true},
+		{"reported", &TokenInfo{PromptTokens: 30, CompletionTokens: 7, HasTokens: true}, 30, 7, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := longCatStream(ctx, longCatFrame("Hel", false, nil), longCatFrame("Hello", true, tt.tokens))
+			chunks, err := collectChunks(NewStreamProcessor().ProcessStream(resp, true))
+			if err != nil {
+				t.Fatalf("ProcessStream error: %v", err)
+			}
+			if len(chunks) == 0 {
+				t.Fatal("no chunks")
+			}
+			for i, chunk := range chunks {
+				if i < len(chunks)-1 && chunk.PromptTokens != 12 {
+					t.Errorf("chunk %d PromptTokens = %d, want the estimate 12", i, chunk.PromptTokens)
+				}
+			}
+			last := chunks[len(chunks)-1]
+			if last.PromptTokens != tt.wantPrompt {
+				t.Errorf("final PromptTokens = %d, want %d", last.PromptTokens, tt.wantPrompt)
+			}
+			if last.Usage == nil {
+				t.Fatal("final chunk has no usage")
+			}
+			if last.Usage.PromptTokens != tt.wantPrompt || last.Usage.Estimated != tt.wantEstimated {
+				t.Errorf("final usage = %+v, want prompt %d estimated %v", *last.Usage, tt.wantPrompt, tt.wantEstimated)
+			}
+			if tt.wantCompletion > 0 && last.Usage.CompletionTokens != tt.wantCompletion {
+				t.Errorf("final completion tokens = %d, want %d", last.Usage.CompletionTokens, tt.wantCompletion)
+			}
+		})
+	}
+}
+
+func TestProcessStreamParallelToolCalls(t *testing.T) {
+	saved := config.AppConfig.PluginInfo
+	config.AppConfig.PluginInfo = true
+	defer func() { config.AppConfig.PluginInfo = saved }()
+
+	plugins := `[{"id":"call_a","name":"search","arguments":{"q":"go"}},{"id":"call_b","name":"weather","arguments":"{\"city\":\"Paris\"}"}]`
+	frame := func(content string, last bool, pluginInfo string) string {
+		resp := LongCatResponse{Content: content, LastOne: last, PluginInfo: json.RawMessage(pluginInfo)}
+		data, _ := json.Marshal(resp)
+		return string(data)
+	}
+
+	tests := []struct {
+		name      string
+		serial    bool
+		stream    bool
+		wantNames []string
+	}{
+		{"parallel streaming", false, true, []string{"search", "weather"}},
+		{"parallel non-streaming", false, false, []string{"search", "weather"}},
+		{"serial streaming", true, true, []string{"search"}},
+		{"serial non-streaming", true, false, []string{"search"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.serial {
+				ctx = WithSerialToolCalls(ctx)
+			}
+			// The second frame repeats the plugins, as LongCat's cumulative frames do
+			resp := longCatStream(ctx, frame("", false, plugins), frame("Done", true, plugins))
+			chunks, err := collectChunks(NewStreamProcessor().ProcessStream(resp, tt.stream))
+			if err != nil {
+				t.Fatalf("ProcessStream error: %v", err)
+			}
+			var names []string
+			for _, chunk := range chunks {
+				for i, call := range chunk.Choices[0].Delta.ToolCalls {
+					if call.Index != len(names) && tt.stream {
+						t.Errorf("tool call %d has index %d", i, call.Index)
+					}
+					names = append(names, call.Function.Name)
+				}
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Fatalf("tool calls = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestOpenAIStreamingDefaultChunkNamesTheRequest(t *testing.T) {
+	saved := config.AppConfig.EmptyResponseErr
+	config.AppConfig.EmptyResponseErr = false
+	defer func() { config.AppConfig.EmptyResponseErr = saved }()
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		wantID    string
+		wantModel string
+	}{
+		{"request names the response", WithModel(WithResponseID(context.Background(), "chatcmpl-request"), "gpt-alias"), "chatcmpl-request", "gpt-alias"},
+		{"nothing known", context.Background(), "", "LongCat-Flash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := make(chan interface{})
+			close(chunks)
+			w := httptest.NewRecorder()
+			if err := NewOpenAIService(nil).HandleStreamingResponse(tt.ctx, w, w, chunks, make(chan error)); err != nil {
+				t.Fatalf("HandleStreamingResponse: %v", err)
+			}
+
+			events := sseDataLines(w.Body.String())
+			if len(events) != 2 || events[1] != "[DONE]" {
+				t.Fatalf("events = %q, want a default chunk and [DONE]", events)
+			}
+			data := events[0]
+			var chunk ChatCompletionChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				t.Fatalf("bad default chunk %q: %v", data, err)
+			}
+			if tt.wantID != "" && chunk.ID != tt.wantID {
+				t.Errorf("id = %q, want %q", chunk.ID, tt.wantID)
+			}
+			if !strings.HasPrefix(chunk.ID, "chatcmpl-") {
+				t.Errorf("id = %q, want a chatcmpl- id", chunk.ID)
+			}
+			if chunk.Model != tt.wantModel {
+				t.Errorf("model = %q, want %q", chunk.Model, tt.wantModel)
+			}
+		})
+	}
+}
+
+func TestOpenAIStreamingReportsUpstreamErrors(t *testing.T) {
+	chunks := make(chan interface{})
+	errs := make(chan error, 1)
+	errs <- &UpstreamError{ErrContentRewritten}
+	w := httptest.NewRecorder()
+	if err := NewOpenAIService(nil).HandleStreamingResponse(context.Background(), w, w, chunks, errs); !errors.Is(err, ErrContentRewritten) {
+		t.Fatalf("HandleStreamingResponse error = %v, want %v", err, ErrContentRewritten)
+	}
+	events := sseDataLines(w.Body.String())
+	if len(events) != 2 || !strings.Contains(events[0], ErrContentRewritten.Error()) || events[1] != "[DONE]" {
+		t.Fatalf("events = %q, want an error chunk and [DONE]", events)
+	}
+}
+
+func TestProcessStreamContentDeltas(t *testing.T) {
+	tests := []struct {
+		name          string
+		trailingSpace string
+		frames        []string // Cumulative content; the last frame finishes the reply
+		want          []string
+		wantErr       error // Ends the stream after want; what was sent stays valid text
+	}{
+		{"growing prefix", "keep", []string{"Hel", "Hello", "Hello world"}, []string{"Hel", "lo", " world"}, nil},
+		{"repeated frame", "keep", []string{"Hello", "Hello", "Hello!"}, []string{"Hello", "!"}, nil},
+		{"rewrite ends the stream", "keep", []string{"Hello wor", "Hello there"}, []string{"Hello wor"}, ErrContentRewritten},
+		{"shorter frame waits", "keep", []string{"Hello world", "Hello", "Hello world!"}, []string{"Hello world", "!"}, nil},
+		{"shorter final frame ends the stream", "keep", []string{"Hello world", "Hello"}, []string{"Hello world"}, ErrContentRewritten},
+		{"dropped trailing space", "keep", []string{"Hello ", "Hello"}, []string{"Hello "}, nil},
+		{"split character waits", "keep", []string{"caf\ufffd", "café"}, []string{"caf", "é"}, nil},
+		{"rewrite inside a character", "keep", []string{"aé", "aè"}, []string{"aé"}, ErrContentRewritten},
+		{"trailing space waits", "trim", []string{"Hello ", "Hello  \n"}, []string{"Hello"}, nil},
+		{"trailing space sent once text follows", "trim", []string{"Hello ", "Hello world"}, []string{"Hello", " world"}, nil},
+		{"newline appended", "newline", []string{"Hi", "Hi  "}, []string{"Hi", "\n"}, nil},
+	}
+	saved := config.AppConfig.TrailingSpace
+	defer func() { config.AppConfig.TrailingSpace = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.TrailingSpace = tt.trailingSpace
+			var frames []string
+			for i, content := range tt.frames {
+				frames = append(frames, longCatFrame(content, i == len(tt.frames)-1, nil))
+			}
+			chunks, err := collectChunks(NewStreamProcessor().ProcessStream(longCatStream(context.Background(), frames...), true))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ProcessStream error = %v, want %v", err, tt.wantErr)
+			}
+			var deltas []string
+			for _, chunk := range chunks {
+				if content := chunk.Choices[0].Delta.Content; content != "" {
+					deltas = append(deltas, content)
+				}
+			}
+			if strings.Join(deltas, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("deltas = %q, want %q", deltas, tt.want)
+			}
+		})
+	}
+}
+
+// A non-streaming response has nothing to take back, so it carries
+// LongCat's final content however it was rewritten
+func TestProcessNonStreamRewrittenContent(t *testing.T) {
+	frames := []string{longCatFrame("Hello wor", false, nil), longCatFrame("Hello there", true, nil)}
+	chunks, err := collectChunks(NewStreamProcessor().ProcessStream(longCatStream(context.Background(), frames...), false))
+	if err != nil {
+		t.Fatalf("ProcessStream error: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Choices[0].Delta.Content != "Hello there" {
+		t.Fatalf("chunks = %+v, want one chunk with %q", chunks, "Hello there")
+	}
+}
+
+// largeResponseFrames returns n cumulative frames of a long reply mixing
+// ASCII and multi-byte text, and the reply itself
+func largeResponseFrames(n int) ([]string, string) {
+	var reply strings.Builder
+	frames := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&reply, "word %d, 日本語 ", i)
+		frames = append(frames, longCatFrame(reply.String(), i == n-1, nil))
+	}
+	return frames, reply.String()
+}
+
+func TestProcessStreamLargeResponse(t *testing.T) {
+	frames, reply := largeResponseFrames(500)
+	p := NewStreamProcessor()
+	chunks, err := collectChunks(p.ProcessStream(longCatStream(context.Background(), frames...), true))
+	if err != nil {
+		t.Fatalf("ProcessStream error: %v", err)
+	}
+	var streamed strings.Builder
+	for _, chunk := range chunks {
+		streamed.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	if streamed.String() != reply {
+		t.Fatalf("streamed %d bytes, want the %d byte reply", streamed.Len(), len(reply))
+	}
+	if p.content != "" || p.sentLen != len(reply) || len(p.sentTail) > sentTailBytes {
+		t.Fatalf("processor kept %d bytes of content and a %d byte tail, want none and at most %d", len(p.content), len(p.sentTail), sentTailBytes)
+	}
+	last := chunks[len(chunks)-1]
+	if want := tokenizerFor(p.model).CountTokens(reply); last.Usage == nil || last.Usage.CompletionTokens != want {
+		t.Fatalf("final usage = %+v, want %d completion tokens", last.Usage, want)
+	}
+}
+
+func BenchmarkProcessStreamLargeResponse(b *testing.B) {
+	frames, _ := largeResponseFrames(500)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := acquireStreamProcessor()
+		if _, err := collectChunks(p.ProcessStream(longCatStream(context.Background(), frames...), true)); err != nil {
+			b.Fatalf("ProcessStream error: %v", err)
+		}
+		releaseStreamProcessor(p)
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 3, "hel"},
+		{"hello", 0, ""},
+		{"héllo", 2, "h"}, // é is two bytes; cutting after one would split it
+		{"héllo", 3, "hé"},
+		{"日本", 4, "日"},
+		{"日本", 2, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateUTF8(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestStreamProcessorSentTail(t *testing.T) {
+	long := strings.Repeat("x", sentTailBytes)
+	tests := []struct {
+		name           string
+		sent, text     string
+		wantContinues  bool
+		wantDropsSpace bool
+	}{
+		{"nothing sent", "", "abc", true, false},
+		{"extended", "abc", "abcd", true, false},
+		{"unchanged", "abc", "abc", true, false},
+		{"rewritten", "abc", "abd", false, false},
+		{"shorter", "abc", "ab", false, false},
+		{"trailing space dropped", "abc \n", "abc", false, true},
+		{"rewritten inside a character", "aé", "aè", false, false},
+		{"rewritten before the tail", "a" + long, "b" + long + "y", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewStreamProcessor()
+			p.recordSent(len(tt.sent), tt.sent)
+			if len(p.sentTail) > sentTailBytes {
+				t.Fatalf("kept %d bytes of sent content, want at most %d", len(p.sentTail), sentTailBytes)
+			}
+			if got := p.continues(tt.text); got != tt.wantContinues {
+				t.Errorf("continues(%q) after %q = %v, want %v", tt.text, tt.sent, got, tt.wantContinues)
+			}
+			if got := p.dropsTrailingSpace(tt.text); got != tt.wantDropsSpace {
+				t.Errorf("dropsTrailingSpace(%q) after %q = %v, want %v", tt.text, tt.sent, got, tt.wantDropsSpace)
+			}
+		})
+	}
+}
+
+func TestStripPrefill(t *testing.T) {
+	tests := []struct {
+		name        string
+		prefill     string
+		content     []string // Successive cumulative contents
+		want        []string
+		wantPrefill string // The prefill left afterwards
+	}{
+		{"no prefill", "", []string{"Hello"}, []string{"Hello"}, ""},
+		{"echo stripped", "{\"a\":", []string{"{\"a\": 1}"}, []string{" 1}"}, "{\"a\":"},
+		{"leading space before echo", "Sure", []string{" \nSure, here"}, []string{", here"}, "Sure"},
+		{"partial echo held back", "Once upon", []string{"Once", "Once upon a", "Once upon a time"}, []string{"", " a", " a time"}, "Once upon"},
+		{"divergent reply passes through", "Yes", []string{"No, because"}, []string{"No, because"}, ""},
+		{"divergence drops the prefill for good", "Yes", []string{"No", "NoYes"}, []string{"No", "NoYes"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewStreamProcessor()
+			p.prefill = tt.prefill
+			for i, content := range tt.content {
+				if got := p.stripPrefill(content); got != tt.want[i] {
+					t.Fatalf("stripPrefill(%q) = %q, want %q", content, got, tt.want[i])
+				}
+			}
+			if p.prefill != tt.wantPrefill {
+				t.Fatalf("prefill = %q, want %q", p.prefill, tt.wantPrefill)
+			}
+		})
+	}
+}
+
+func FuzzProcessStream(f *testing.F) {
+	f.Add("data:"+longCatFrame("Hel", false, nil)+"\n\ndata:"+longCatFrame("Hello", true, nil)+"\n\n", true)
+	f.Add("data:"+longCatFrame("héllo", true, &TokenInfo{PromptTokens: 3, CompletionTokens: 2, HasTokens: true})+"\r\n\r\n", false)
+	f.Add("event: message\rdata: {\"content\":\"a\"}\rdata: [DONE]\r", true)
+	f.Add("data: {not json}\n\n", false)
+	f.Fuzz(func(t *testing.T, body string, stream bool) {
+		req, _ := http.NewRequest(http.MethodPost, "http://longcat.test/chat", nil)
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}
+		chunks, _ := collectChunks(NewStreamProcessor().ProcessStream(resp, stream))
+		for _, chunk := range chunks {
+			if len(chunk.Choices) == 0 {
+				t.Fatalf("chunk %+v has no choices", chunk)
+			}
+			for _, choice := range chunk.Choices {
+				if !utf8.ValidString(choice.Delta.Content) || !utf8.ValidString(choice.Delta.ReasoningContent) {
+					t.Fatalf("delta %+v splits a rune", choice.Delta)
+				}
+			}
+		}
+	})
+}
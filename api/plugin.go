@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// LongCatPluginInfo describes a plugin/tool invocation reported by LongCat.
+// The payload shape is undocumented, so parsing is deliberately lenient.
+type LongCatPluginInfo struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Status    string          `json:"status"`
+	Arguments json.RawMessage `json:"arguments"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// parsePluginInfo decodes the pluginInfo field, which may be a JSON string
+// holding the payload or the payload itself, as a single object or a list
+func parsePluginInfo(raw json.RawMessage) ([]LongCatPluginInfo, error) {
+	data := strings.TrimSpace(string(raw))
+	if data == "" || data == "null" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(data, `"`) {
+		var encoded string
+		if err := json.Unmarshal(raw, &encoded); err != nil {
+			return nil, fmt.Errorf("failed to decode plugin info string: %w", err)
+		}
+		data = strings.TrimSpace(encoded)
+		if data == "" {
+			return nil, nil
+		}
+	}
+
+	var plugins []LongCatPluginInfo
+	if strings.HasPrefix(data, "[") {
+		if err := json.Unmarshal([]byte(data), &plugins); err != nil {
+			return nil, fmt.Errorf("failed to parse plugin info: %w", err)
+		}
+	} else {
+		var plugin LongCatPluginInfo
+		if err := json.Unmarshal([]byte(data), &plugin); err != nil {
+			return nil, fmt.Errorf("failed to parse plugin info: %w", err)
+		}
+		plugins = append(plugins, plugin)
+	}
+
+	return plugins, nil
+}
+
+// toToolCall maps a plugin invocation to an OpenAI tool call
+func (pi LongCatPluginInfo) toToolCall(index int) ToolCall {
+	id := pi.ID
+	if id == "" {
+		id = newToolCallID()
+	}
+
+	arguments := strings.TrimSpace(string(pi.Arguments))
+	if arguments == "" || arguments == "null" {
+		arguments = "{}"
+	} else if strings.HasPrefix(arguments, `"`) {
+		// Arguments sent as an encoded string are already what OpenAI expects
+		var decoded string
+		if err := json.Unmarshal(pi.Arguments, &decoded); err == nil {
+			arguments = decoded
+		}
+	}
+	arguments = toolInput(arguments)
+
+	return ToolCall{
+		Index: index,
+		ID:    id,
+		Type:  "function",
+		Function: ToolCallFunction{
+			Name:      pi.Name,
+			Arguments: arguments,
+		},
+	}
+}
+
+// toolInput returns arguments as tool call input: valid JSON as is, nothing
+// as an empty object and anything else as a JSON string, so the message
+// carrying it still encodes
+func toolInput(arguments string) string {
+	if strings.TrimSpace(arguments) == "" {
+		return "{}"
+	}
+	if json.Valid([]byte(arguments)) {
+		return arguments
+	}
+	quoted, _ := json.Marshal(arguments)
+	return string(quoted)
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParsePluginInfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		wantNames []string
+		wantErr   bool
+	}{
+		{"absent", ``, nil, false},
+		{"null", `null`, nil, false},
+		{"empty string", `""`, nil, false},
+		{"object", `{"id":"p1","name":"search","arguments":{"q":"go"}}`, []string{"search"}, false},
+		{"list", `[{"name":"search"},{"name":"fetch"}]`, []string{"search", "fetch"}, false},
+		{"encoded object", `"{\"name\":\"search\"}"`, []string{"search"}, false},
+		{"encoded list", `" [{\"name\":\"search\"}] "`, []string{"search"}, false},
+		{"malformed object", `{"name":`, nil, true},
+		{"malformed encoded list", `"[{\"name\""`, nil, true},
+		{"wrong type", `42`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugins, err := parsePluginInfo(json.RawMessage(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePluginInfo(%s) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			}
+			var names []string
+			for _, plugin := range plugins {
+				names = append(names, plugin.Name)
+			}
+			if len(names) != len(tt.wantNames) {
+				t.Fatalf("parsePluginInfo(%s) names = %q, want %q", tt.raw, names, tt.wantNames)
+			}
+			for i := range names {
+				if names[i] != tt.wantNames[i] {
+					t.Fatalf("parsePluginInfo(%s) names = %q, want %q", tt.raw, names, tt.wantNames)
+				}
+			}
+		})
+	}
+}
+
+func TestPluginInfoToToolCall(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments string
+		want      string
+	}{
+		{"absent", ``, "{}"},
+		{"null", `null`, "{}"},
+		{"object", `{"q":"go"}`, `{"q":"go"}`},
+		{"encoded string", `"{\"q\":\"go\"}"`, `{"q":"go"}`},
+		{"encoded empty string", `""`, "{}"},
+		{"encoded plain text", `"search go"`, `"search go"`},
+		{"encoded truncated object", `"{\"q\":"`, `"{\"q\":"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call := LongCatPluginInfo{ID: "p1", Name: "search", Arguments: json.RawMessage(tt.arguments)}.toToolCall(2)
+			if call.Function.Arguments != tt.want || call.ID != "p1" || call.Index != 2 || call.Type != "function" {
+				t.Fatalf("toToolCall() = %+v, want arguments %s", call, tt.want)
+			}
+		})
+	}
+}
@@ -4,11 +4,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
 )
 
 // APIServiceType represents the type of API service
@@ -19,6 +28,401 @@ const (
 	ClaudeServiceType APIServiceType = "claude"
 )
 
+// ErrMaxStreamDuration is returned by HandleStreamingResponse when the stream
+// was cut because it exceeded the configured maximum duration
+var ErrMaxStreamDuration = errors.New("maximum stream duration exceeded")
+
+// ErrEmptyResponse is returned when LongCat produced no content and
+// EMPTY_RESPONSE_AS_ERROR is enabled
+var ErrEmptyResponse = errors.New("upstream returned an empty response")
+
+// ErrContentRewritten ends a stream when LongCat rewrites or cuts back
+// content the client was already sent, which deltas cannot take back
+var ErrContentRewritten = errors.New("upstream rewrote content that was already streamed")
+
+// ErrSessionTimeout is returned when a session-create attempt outlives
+// SESSION_TIMEOUT_SECONDS
+var ErrSessionTimeout = errors.New("session creation timed out")
+
+// UpstreamError marks a failure caused by LongCat, such as an unreachable
+// host or a malformed response, rather than by the gateway itself
+type UpstreamError struct {
+	Err error
+}
+
+func (e *UpstreamError) Error() string { return e.Err.Error() }
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// streamDeadline returns a channel that fires once the configured maximum
+// stream duration elapses, or nil when no limit is configured
+func streamDeadline() (<-chan time.Time, func()) {
+	if config.AppConfig.MaxStreamSeconds <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Duration(config.AppConfig.MaxStreamSeconds) * time.Second)
+	return timer.C, func() { timer.Stop() }
+}
+
+// sseWriter writes Server-Sent Events tagged with monotonic ids so that
+// EventSource clients can track their position in the stream
+type sseWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+	lastID  int
+	// With STREAM_COALESCE_MS set, small events are held for up to that long
+	// and flushed together
+	pending int         // Bytes written since the last flush
+	timer   *time.Timer // Scheduled flush of pending events
+	closed  bool
+	// Text held by sendText until the next flush or a different event
+	mergeKey   string
+	mergeEvent string
+	mergeText  strings.Builder
+	mergeData  func(text string) []byte
+}
+
+// newSSEWriter starts an event stream, sending the retry hint if configured.
+// close must be called before the handler returns.
+func newSSEWriter(w io.Writer, flusher http.Flusher) *sseWriter {
+	if config.AppConfig.SSERetryMillis > 0 {
+		fmt.Fprintf(w, "retry: %d\n\n", config.AppConfig.SSERetryMillis)
+	}
+	return &sseWriter{w: w, flusher: flusher}
+}
+
+// send writes a single event and flushes it, or schedules the flush when
+// coalescing; event may be empty for data-only frames
+func (s *sseWriter) send(event string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeMerged()
+	s.write(event, data)
+	s.schedule()
+}
+
+// sendText sends text as the event data returns for it. When coalescing,
+// consecutive calls with the same key until the next flush are sent as a
+// single event carrying all their text, such as one Claude text_delta.
+func (s *sseWriter) sendText(event, key, text string, data func(text string) []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mergeData != nil && s.mergeKey != key {
+		s.writeMerged()
+	}
+	s.mergeKey, s.mergeEvent, s.mergeData = key, event, data
+	s.mergeText.WriteString(text)
+	s.schedule()
+}
+
+// write writes one event without flushing it; s.mu must be held
+func (s *sseWriter) write(event string, data []byte) {
+	s.lastID++
+	n, _ := fmt.Fprintf(s.w, "id: %d\n", s.lastID)
+	s.pending += n
+	if event != "" {
+		n, _ = fmt.Fprintf(s.w, "event: %s\n", event)
+		s.pending += n
+	}
+	n, _ = fmt.Fprintf(s.w, "data: %s\n\n", data)
+	s.pending += n
+}
+
+// writeMerged writes the text held by sendText as its event; s.mu must be
+// held
+func (s *sseWriter) writeMerged() {
+	if s.mergeData == nil {
+		return
+	}
+	data := s.mergeData(s.mergeText.String())
+	s.mergeText.Reset()
+	s.mergeData = nil
+	s.write(s.mergeEvent, data)
+}
+
+// schedule flushes now or arms the coalescing timer; s.mu must be held
+func (s *sseWriter) schedule() {
+	delay := time.Duration(config.AppConfig.CoalesceMillis) * time.Millisecond
+	if delay <= 0 || s.pending+s.mergeText.Len() >= config.AppConfig.CoalesceBytes {
+		s.flush()
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(delay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !s.closed {
+				s.flush()
+			}
+		})
+	}
+}
+
+// flush sends pending events to the client; s.mu must be held
+func (s *sseWriter) flush() {
+	s.writeMerged()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.flusher.Flush()
+	s.pending = 0
+}
+
+// close flushes anything still held back. The writer must not be used by a
+// scheduled flush once the handler has returned.
+func (s *sseWriter) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending > 0 || s.mergeData != nil {
+		s.flush()
+	}
+	s.closed = true
+}
+
+// scanSSELines is a bufio.SplitFunc for event streams, which may end lines
+// with \n, \r\n or a lone \r
+func scanSSELines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		// Wait to see whether the \r is followed by \n
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// sseData returns the payload of an SSE data line. A byte order mark before
+// the field name is ignored.
+func sseData(line string) (string, bool) {
+	line = strings.TrimPrefix(line, "\ufeff")
+	data, ok := strings.CutPrefix(line, "data:")
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSpace(data), true
+}
+
+// plainJSONBody returns the body of resp to scan for frames. LongCat
+// occasionally answers with plain application/json instead of SSE, even for
+// a streaming request; that response is turned into one final data frame.
+// An API envelope around it is unwrapped, and one reporting a failure
+// becomes an error.
+func plainJSONBody(resp *http.Response) (io.Reader, error) {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" {
+		return resp.Body, nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &UpstreamError{fmt.Errorf("failed to read response: %w", err)}
+	}
+	var frame map[string]json.RawMessage
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, &UpstreamError{fmt.Errorf("failed to unmarshal response: %w", err)}
+	}
+	if _, ok := frame["content"]; !ok {
+		var envelope struct {
+			Code    int                        `json:"code"`
+			Message string                     `json:"message"`
+			Data    map[string]json.RawMessage `json:"data"`
+		}
+		json.Unmarshal(data, &envelope)
+		if envelope.Code != 0 || envelope.Data == nil {
+			message := envelope.Message
+			if message == "" {
+				message = "response has no content"
+			}
+			return nil, &UpstreamError{fmt.Errorf("LongCat returned %s: %s", resp.Status, message)}
+		}
+		frame = envelope.Data
+	}
+	frame["lastOne"] = json.RawMessage("true")
+	data, _ = json.Marshal(frame)
+	return strings.NewReader("data:" + string(data) + "\n\n"), nil
+}
+
+type responseIDKey struct{}
+
+// WithResponseID returns a context whose LongCat response is reported to the
+// client under the given response/message ID
+func WithResponseID(ctx context.Context, responseID string) context.Context {
+	return context.WithValue(ctx, responseIDKey{}, responseID)
+}
+
+// ResponseID returns the response ID carried by ctx, if any
+func ResponseID(ctx context.Context) string {
+	responseID, _ := ctx.Value(responseIDKey{}).(string)
+	return responseID
+}
+
+// responseIDFor returns the response ID chosen for resp's request, if any
+func responseIDFor(resp *http.Response) string {
+	if resp.Request == nil {
+		return ""
+	}
+	return ResponseID(resp.Request.Context())
+}
+
+type agentKey struct{}
+
+// WithAgent returns a context whose new LongCat sessions are created on the
+// given agent instead of the default one
+func WithAgent(ctx context.Context, agent string) context.Context {
+	return context.WithValue(ctx, agentKey{}, agent)
+}
+
+// Agent returns the LongCat agent carried by ctx, "" for the default
+func Agent(ctx context.Context) string {
+	agent, _ := ctx.Value(agentKey{}).(string)
+	return agent
+}
+
+type modelKey struct{}
+
+// WithModel returns a context whose response reports the given model name,
+// so clients see the alias they asked for
+func WithModel(ctx context.Context, model string) context.Context {
+	return context.WithValue(ctx, modelKey{}, model)
+}
+
+// modelFor returns the model name to report for resp's request, if any
+func modelFor(resp *http.Response) string {
+	if resp.Request == nil {
+		return ""
+	}
+	return modelIn(resp.Request.Context())
+}
+
+// modelIn returns the model name carried by ctx, if any
+func modelIn(ctx context.Context) string {
+	model, _ := ctx.Value(modelKey{}).(string)
+	return model
+}
+
+type promptTokensKey struct{}
+
+// promptTokensFor returns the estimated prompt size of resp's request
+func promptTokensFor(resp *http.Response) int {
+	if resp.Request == nil {
+		return 0
+	}
+	return promptTokensIn(resp.Request.Context())
+}
+
+// promptTokensIn returns the estimated prompt size carried by ctx, which
+// SendRequest records on the upstream request's context
+func promptTokensIn(ctx context.Context) int {
+	tokens, _ := ctx.Value(promptTokensKey{}).(int)
+	return tokens
+}
+
+type prefillKey struct{}
+
+// WithPrefill returns a context whose LongCat response continues an
+// assistant prefill; an echoed copy of the prefill is stripped from the reply
+func WithPrefill(ctx context.Context, prefill string) context.Context {
+	return context.WithValue(ctx, prefillKey{}, prefill)
+}
+
+// prefillFor returns the assistant prefill of resp's request, if any
+func prefillFor(resp *http.Response) string {
+	if resp.Request == nil {
+		return ""
+	}
+	prefill, _ := resp.Request.Context().Value(prefillKey{}).(string)
+	return prefill
+}
+
+type reasoningFieldKey struct{}
+
+type includeUsageKey struct{}
+
+// WithIncludeUsage returns a context whose streamed OpenAI response ends with
+// a usage chunk, as stream_options.include_usage asks
+func WithIncludeUsage(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeUsageKey{}, true)
+}
+
+// includeUsageFor reports whether resp's request asked for a usage chunk
+func includeUsageFor(resp *http.Response) bool {
+	if resp.Request == nil {
+		return false
+	}
+	include, _ := resp.Request.Context().Value(includeUsageKey{}).(bool)
+	return include
+}
+
+type serialToolCallsKey struct{}
+
+// WithSerialToolCalls returns a context whose response surfaces at most one
+// tool call, as parallel_tool_calls:false asks
+func WithSerialToolCalls(ctx context.Context) context.Context {
+	return context.WithValue(ctx, serialToolCallsKey{}, true)
+}
+
+// serialToolCallsFor reports whether resp's request disallowed parallel tool calls
+func serialToolCallsFor(resp *http.Response) bool {
+	if resp.Request == nil {
+		return false
+	}
+	serial, _ := resp.Request.Context().Value(serialToolCallsKey{}).(bool)
+	return serial
+}
+
+// WithReasoningField returns a context whose OpenAI response reports
+// reasoning under field ("reasoning", "reasoning_content" or "both")
+// instead of reasoning_content
+func WithReasoningField(ctx context.Context, field string) context.Context {
+	return context.WithValue(ctx, reasoningFieldKey{}, field)
+}
+
+// reasoningFieldFor returns the reasoning field chosen for resp's request, if any
+func reasoningFieldFor(resp *http.Response) string {
+	if resp.Request == nil {
+		return ""
+	}
+	field, _ := resp.Request.Context().Value(reasoningFieldKey{}).(string)
+	return field
+}
+
+type upstreamOverrideKey struct{}
+
+// WithUpstreamOverride returns a context whose LongCat calls are sent to
+// baseURL (scheme and host) instead of the configured LongCat host
+func WithUpstreamOverride(ctx context.Context, baseURL *url.URL) context.Context {
+	return context.WithValue(ctx, upstreamOverrideKey{}, baseURL)
+}
+
+// resolveUpstreamURL applies any per-request upstream override to reqUrl
+func resolveUpstreamURL(ctx context.Context, reqUrl string) string {
+	baseURL, ok := ctx.Value(upstreamOverrideKey{}).(*url.URL)
+	if !ok {
+		return reqUrl
+	}
+	u, err := url.Parse(reqUrl)
+	if err != nil {
+		return reqUrl
+	}
+	u.Scheme = baseURL.Scheme
+	u.Host = baseURL.Host
+	return u.String()
+}
+
 // LongCatRequest represents a request to the LongCat API
 type LongCatRequest struct {
 	Content        string `json:"content"`
@@ -26,6 +430,15 @@ type LongCatRequest struct {
 	SearchEnabled  int    `json:"searchEnabled"`
 	Regenerate     int    `json:"regenerate"`
 	ConversationId string `json:"conversationId,omitempty"`
+	MaxTokens      int    `json:"maxTokens,omitempty"`
+	// Messages carries the full history when FORWARD_MESSAGES is enabled
+	Messages []LongCatMessage `json:"messages,omitempty"`
+}
+
+// LongCatMessage is one turn of the history sent in messages mode
+type LongCatMessage struct {
+	Role    string `json:"role"` // system, user or assistant
+	Content string `json:"content"`
 }
 
 // LongCatClient handles unified HTTP requests to LongCat server
@@ -33,7 +446,12 @@ type LongCatClient struct {
 	client     *http.Client
 	longCatURL string
 	sessionURL string
-	headers    map[string]string
+	// headers are shared by all requests and never modified after
+	// construction; per-request values are added in requestHeaders
+	headers   http.Header
+	lastTrace atomic.Int64 // Last m-traceid handed out
+	sessions  sessionPool  // Idle sessions, see SESSION_POOL_SIZE
+	breaker   circuitBreaker
 }
 
 func NewLongCatClient() *LongCatClient {
@@ -43,12 +461,11 @@ func NewLongCatClient() *LongCatClient {
 		},
 		longCatURL: config.AppConfig.LongCatAPIURL,
 		sessionURL: config.AppConfig.LongCatSessionURL,
-		headers: map[string]string{
+		headers: newHeader(map[string]string{
 			"accept":             "text/event-stream,application/json",
 			"accept-language":    "en,zh-Hans-CN;q=0.9,zh-CN;q=0.8,zh;q=0.7,en-GB;q=0.6,en-US;q=0.5,zh-TW;q=0.4",
 			"content-type":       "application/json",
 			"m-appkey":           "fe_com.sankuai.friday.fe.longcat",
-			"m-traceid":          fmt.Sprintf("%d", time.Now().UnixNano()),
 			"origin":             "https://longcat.chat",
 			"sec-ch-ua":          `"Not(A:Brand";v="99", "Microsoft Edge";v="133", "Chromium";v="133"`,
 			"sec-ch-ua-mobile":   "?0",
@@ -59,18 +476,102 @@ func NewLongCatClient() *LongCatClient {
 			"user-agent":         "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.0.0 Safari/537.36 Edg/133.0.0.0",
 			"x-client-language":  "en",
 			"x-requested-with":   "XMLHttpRequest",
-		},
+		}),
+	}
+}
+
+func newHeader(values map[string]string) http.Header {
+	header := make(http.Header, len(values))
+	for k, v := range values {
+		header.Set(k, v)
+	}
+	return header
+}
+
+// requestHeaders returns a fresh header set for one request, carrying its
+// own m-traceid
+func (c *LongCatClient) requestHeaders() http.Header {
+	header := c.headers.Clone()
+	header.Set("m-traceid", strconv.FormatInt(c.nextTraceID(), 10))
+	return header
+}
+
+// nextTraceID returns a nanosecond timestamp, bumped past the previous ID so
+// concurrent requests never share one
+func (c *LongCatClient) nextTraceID() int64 {
+	for {
+		last := c.lastTrace.Load()
+		next := max(time.Now().UnixNano(), last+1)
+		if c.lastTrace.CompareAndSwap(last, next) {
+			return next
+		}
 	}
 }
 
-// CreateSession creates a new conversation session
+// sessionStatusError is a session-create rejection worth retrying, such as
+// a 429 or a 5xx
+type sessionStatusError struct {
+	status     int
+	retryAfter time.Duration // From the Retry-After header, if any
+}
+
+func (e *sessionStatusError) Error() string {
+	return fmt.Sprintf("session creation failed: HTTP %d", e.status)
+}
+
+// CreateSession creates a new conversation session. Rate limits, 5xx
+// responses and transport errors are retried with exponential backoff.
 func (c *LongCatClient) CreateSession(ctx context.Context) (string, error) {
+	backoff := time.Duration(config.AppConfig.SessionBackoffMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		id, err := c.createSession(ctx)
+		if err == nil || attempt >= config.AppConfig.SessionRetries || !retryableSessionError(err) {
+			return id, err
+		}
+
+		wait := backoff << attempt
+		var statusErr *sessionStatusError
+		if errors.As(err, &statusErr) && statusErr.retryAfter > wait {
+			wait = statusErr.retryAfter
+		}
+		logging.LogInfo("%v, retrying in %s (%d/%d)", err, wait, attempt+1, config.AppConfig.SessionRetries)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return "", err
+		}
+	}
+}
+
+// retryableSessionError reports whether a failed session-create may succeed
+// when tried again. Rejections in the response body, such as invalid
+// cookies, are final.
+func retryableSessionError(err error) bool {
+	var statusErr *sessionStatusError
+	var urlErr *url.Error
+	return errors.As(err, &statusErr) || errors.As(err, &urlErr) || errors.Is(err, ErrSessionTimeout)
+}
+
+// createSession makes a single session-create attempt, bounded by
+// SESSION_TIMEOUT_SECONDS rather than the longer generation timeout
+func (c *LongCatClient) createSession(parent context.Context) (id string, err error) {
+	timeout := time.Duration(config.AppConfig.SessionTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	defer func() {
+		// Report the dedicated timeout, not whichever call it interrupted
+		if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			err = &UpstreamError{fmt.Errorf("%w after %s", ErrSessionTimeout, timeout)}
+		}
+	}()
+
 	sessionReq := struct {
 		Model   string `json:"model"`
 		AgentID string `json:"agentId"`
 	}{
 		Model:   "",
-		AgentID: "",
+		AgentID: Agent(ctx),
 	}
 
 	resp, err := c.sendRequest(ctx, c.sessionURL, sessionReq)
@@ -79,6 +580,14 @@ func (c *LongCatClient) CreateSession(ctx context.Context) (string, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		statusErr := &sessionStatusError{status: resp.StatusCode}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			statusErr.retryAfter = time.Duration(secs) * time.Second
+		}
+		return "", &UpstreamError{statusErr}
+	}
+
 	var sessionResp struct {
 		Code    int    `json:"code"`
 		Message string `json:"message"`
@@ -87,18 +596,54 @@ func (c *LongCatClient) CreateSession(ctx context.Context) (string, error) {
 		} `json:"data"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&sessionResp); err != nil {
-		return "", fmt.Errorf("failed to decode session response: %w", err)
+		return "", &UpstreamError{fmt.Errorf("failed to decode session response: %w", err)}
 	}
 
 	if sessionResp.Code != 0 {
-		return "", fmt.Errorf("session creation failed: %s", sessionResp.Message)
+		return "", &UpstreamError{fmt.Errorf("session creation failed: %s", sessionResp.Message)}
 	}
 
 	return sessionResp.Data.ConversationID, nil
 }
 
+// Warmup opens a connection to the LongCat host so the first real request
+// does not pay the TLS handshake cost. When validateCookies is set it also
+// creates a throwaway session to verify the configured cookies.
+func (c *LongCatClient) Warmup(ctx context.Context, validateCookies bool) error {
+	u, err := url.Parse(c.longCatURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse LongCat URL: %w", err)
+	}
+	origin := fmt.Sprintf("%s://%s/", u.Scheme, u.Host)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodHead, origin, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create warmup request: %w", err)
+	}
+	httpReq.Header.Set("user-agent", c.headers.Get("user-agent"))
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", origin, err)
+	}
+	resp.Body.Close()
+
+	if validateCookies {
+		id, err := c.CreateSession(ctx)
+		if err != nil {
+			return fmt.Errorf("cookie validation failed: %w", err)
+		}
+		c.RecycleSession(id)
+	}
+
+	return nil
+}
+
 // SendRequest sends a unified request to LongCat server
 func (c *LongCatClient) SendRequest(ctx context.Context, longCatReq LongCatRequest) (*http.Response, error) {
+	// Remember the prompt size so usage can be reported before LongCat sends token counts
+	model, _ := ctx.Value(modelKey{}).(string)
+	ctx = context.WithValue(ctx, promptTokensKey{}, tokenizerFor(model).CountTokens(longCatReq.Content))
 	return c.sendRequest(ctx, c.longCatURL, longCatReq)
 }
 
@@ -107,23 +652,24 @@ func (c *LongCatClient) sendRequest(ctx context.Context, reqUrl string, longCatR
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
-	fmt.Println("LongCat request body:", string(body))
+	logging.LogBody(ctx, "LongCat request body: %s", string(body))
 
+	reqUrl = resolveUpstreamURL(ctx, reqUrl)
 	httpReq, err := http.NewRequestWithContext(ctx, "POST", reqUrl, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	for k, v := range c.headers {
-		httpReq.Header.Set(k, v)
-	}
+	httpReq.Header = c.requestHeaders()
+	setTraceHeaders(ctx, httpReq.Header)
 	httpReq.Header.Set("referer", "https://longcat.chat/t")
 	httpReq.Header.Set("referrer-policy", "strict-origin-when-cross-origin")
 
+	current := config.CurrentCookies()
 	cookies := []*http.Cookie{
-		{Name: "_lxsdk_cuid", Value: config.AppConfig.Cookies.LxsdkCuid},
-		{Name: "passport_token_key", Value: config.AppConfig.Cookies.PassportToken},
-		{Name: "_lxsdk_s", Value: config.AppConfig.Cookies.LxsdkS},
+		{Name: "_lxsdk_cuid", Value: current.LxsdkCuid},
+		{Name: "passport_token_key", Value: current.PassportToken},
+		{Name: "_lxsdk_s", Value: current.LxsdkS},
 	}
 
 	for _, cookie := range cookies {
@@ -132,9 +678,18 @@ func (c *LongCatClient) sendRequest(ctx context.Context, reqUrl string, longCatR
 
 	httpReq.Header.Set("Connection", "keep-alive")
 
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
 	resp, err := c.client.Do(httpReq)
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up; that says nothing about LongCat's health
+		c.breaker.forget()
+	} else {
+		c.breaker.record(err != nil || resp.StatusCode >= 500)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return nil, &UpstreamError{fmt.Errorf("failed to make request: %w", err)}
 	}
 
 	return resp, nil
@@ -151,6 +706,8 @@ type APIService interface {
 	// HandleNonStreamingResponse handles non-streaming HTTP responses
 	HandleNonStreamingResponse(w http.ResponseWriter, chunks <-chan interface{}, errs <-chan error) error
 
-	// HandleStreamingResponse handles streaming HTTP responses using Server-Sent Events
-	HandleStreamingResponse(w http.ResponseWriter, flusher http.Flusher, chunks <-chan interface{}, errs <-chan error) error
+	// HandleStreamingResponse handles streaming HTTP responses using Server-Sent Events.
+	// ctx is the upstream request's context, which names the response before
+	// the first chunk arrives.
+	HandleStreamingResponse(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, chunks <-chan interface{}, errs <-chan error) error
 }
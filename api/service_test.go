@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+func TestScanSSELines(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"lf", "data: a\n\ndata: b\n", []string{"data: a", "", "data: b"}},
+		{"crlf", "data: a\r\n\r\n", []string{"data: a", ""}},
+		{"bare cr", "data: a\rdata: b\r", []string{"data: a", "data: b"}},
+		{"no trailing newline", "data: a", []string{"data: a"}},
+		{"mixed", "id: 1\r\ndata: a\rdata: b\n", []string{"id: 1", "data: a", "data: b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One byte at a time, so a \r\n split across reads is exercised
+			if got := scanAll(iotest.OneByteReader(strings.NewReader(tt.input))); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("lines = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSEData(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   string
+		wantOK bool
+	}{
+		{"data: {}", "{}", true},
+		{"data:{}", "{}", true},
+		{"\ufeffdata: [DONE]", "[DONE]", true},
+		{"event: message", "", false},
+		{": keepalive", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, ok := sseData(tt.line)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("sseData(%q) = %q, %v, want %q, %v", tt.line, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// scanAll splits what r yields into lines with scanSSELines
+func scanAll(r io.Reader) []string {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanSSELines)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// flushCounter records what an sseWriter wrote and how often it flushed
+type flushCounter struct {
+	strings.Builder
+	flushes int
+}
+
+func (f *flushCounter) Flush() { f.flushes++ }
+
+func TestSSEWriterMergesText(t *testing.T) {
+	text := func(key string) func(string) []byte {
+		return func(text string) []byte { return []byte(key + ":" + text) }
+	}
+	tests := []struct {
+		name        string
+		coalesceMs  int
+		write       func(sse *sseWriter)
+		want        []string
+		wantFlushes int
+	}{
+		{"not coalescing", 0, func(sse *sseWriter) {
+			sse.sendText("delta", "0", "a", text("0"))
+			sse.sendText("delta", "0", "b", text("0"))
+		}, []string{"0:a", "0:b"}, 2},
+		{"same key", 1000, func(sse *sseWriter) {
+			sse.sendText("delta", "0", "a", text("0"))
+			sse.sendText("delta", "0", "b", text("0"))
+			sse.sendText("delta", "0", "c", text("0"))
+		}, []string{"0:abc"}, 1},
+		{"key changes", 1000, func(sse *sseWriter) {
+			sse.sendText("delta", "0", "a", text("0"))
+			sse.sendText("delta", "1", "b", text("1"))
+		}, []string{"0:a", "1:b"}, 1},
+		{"other event between", 1000, func(sse *sseWriter) {
+			sse.sendText("delta", "0", "a", text("0"))
+			sse.send("stop", []byte("stop"))
+			sse.sendText("delta", "0", "b", text("0"))
+		}, []string{"0:a", "stop", "0:b"}, 1},
+	}
+	saved := *config.AppConfig
+	defer func() { *config.AppConfig = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.CoalesceMillis = tt.coalesceMs
+			config.AppConfig.CoalesceBytes = 1 << 20
+			w := &flushCounter{}
+			sse := newSSEWriter(w, w)
+			tt.write(sse)
+			sse.close()
+
+			var got []string
+			for _, line := range strings.Split(w.String(), "\n") {
+				if data, ok := strings.CutPrefix(line, "data: "); ok {
+					got = append(got, data)
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || w.flushes != tt.wantFlushes {
+				t.Fatalf("events = %q after %d flushes, want %q after %d", got, w.flushes, tt.want, tt.wantFlushes)
+			}
+		})
+	}
+}
+
+func FuzzScanSSELines(f *testing.F) {
+	f.Add("data: a\n\ndata: b\n")
+	f.Add("id: 1\r\ndata: a\r\n\r\n")
+	f.Add("data: a\rdata: b")
+	f.Add("\ufeffdata: [DONE]\r")
+	f.Fuzz(func(t *testing.T, input string) {
+		if len(input) > bufio.MaxScanTokenSize/2 {
+			t.Skip("longer than a scanner token")
+		}
+		lines := scanAll(iotest.HalfReader(strings.NewReader(input)))
+		// Lines never hold a line break, and rejoining them only loses the
+		// breaks themselves
+		stripped := strings.NewReplacer("\r", "", "\n", "").Replace(input)
+		if joined := strings.Join(lines, ""); joined != stripped {
+			t.Fatalf("lines %q do not rejoin to %q", lines, stripped)
+		}
+		for _, line := range lines {
+			if strings.ContainsAny(line, "\r\n") {
+				t.Fatalf("line %q holds a line break", line)
+			}
+			sseData(line)
+		}
+	})
+}
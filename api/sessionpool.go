@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
+)
+
+// pooledSessionMaxAge bounds how long an unused session is handed out, in
+// case LongCat expires idle sessions
+const pooledSessionMaxAge = 5 * time.Minute
+
+// sessionPool keeps a few idle LongCat sessions so bursts of new
+// conversations do not all wait on session-create. It is refilled one
+// session at a time in the background.
+type sessionPool struct {
+	mu        sync.Mutex
+	sessions  []pooledSession
+	refilling bool
+}
+
+type pooledSession struct {
+	id      string
+	created time.Time
+}
+
+// take returns the most recently created idle session that is still fresh
+func (p *sessionPool) take() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.sessions) > 0 {
+		session := p.sessions[len(p.sessions)-1]
+		p.sessions = p.sessions[:len(p.sessions)-1]
+		if time.Since(session.created) < pooledSessionMaxAge {
+			return session.id, true
+		}
+	}
+	return "", false
+}
+
+// put adds an idle session, dropping the oldest when the pool is full
+func (p *sessionPool) put(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sessions = append(p.sessions, pooledSession{id: id, created: time.Now()})
+	if extra := len(p.sessions) - config.AppConfig.SessionPoolSize; extra > 0 {
+		p.sessions = p.sessions[extra:]
+	}
+}
+
+// NewSession returns a session for a new conversation, reusing an idle one
+// from the pool when SESSION_POOL_SIZE is set. The pool only holds sessions
+// on the default agent.
+func (c *LongCatClient) NewSession(ctx context.Context) (string, error) {
+	if config.AppConfig.SessionPoolSize <= 0 || Agent(ctx) != "" {
+		return c.CreateSession(ctx)
+	}
+	defer c.refillSessions()
+
+	if id, ok := c.sessions.take(); ok {
+		logging.LogDebug("Reusing pooled session %s", id)
+		return id, nil
+	}
+	return c.CreateSession(ctx)
+}
+
+// RecycleSession offers a session that was created but never used, such as
+// one from a cookie check, to the pool
+func (c *LongCatClient) RecycleSession(id string) {
+	if config.AppConfig.SessionPoolSize > 0 && id != "" {
+		c.sessions.put(id)
+	}
+}
+
+// refillSessions tops the pool up in the background unless a refill is
+// already running
+func (c *LongCatClient) refillSessions() {
+	c.sessions.mu.Lock()
+	if c.sessions.refilling {
+		c.sessions.mu.Unlock()
+		return
+	}
+	c.sessions.refilling = true
+	c.sessions.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.sessions.mu.Lock()
+			c.sessions.refilling = false
+			c.sessions.mu.Unlock()
+		}()
+
+		for {
+			c.sessions.mu.Lock()
+			full := len(c.sessions.sessions) >= config.AppConfig.SessionPoolSize
+			c.sessions.mu.Unlock()
+			if full {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.AppConfig.Timeout)*time.Second)
+			id, err := c.CreateSession(ctx)
+			cancel()
+			if err != nil {
+				logging.LogDebug("Failed to refill session pool: %v", err)
+				return
+			}
+			c.sessions.put(id)
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// ResponseFormat is the OpenAI response_format parameter
+type ResponseFormat struct {
+	Type       string            `json:"type"` // text, json_object or json_schema
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat is a structured outputs schema. LongCat cannot constrain
+// its decoding, so the schema is passed on as an instruction and the reply
+// is checked against it afterwards.
+type JSONSchemaFormat struct {
+	Name   string                 `json:"name"`
+	Schema map[string]interface{} `json:"schema"`
+	Strict bool                   `json:"strict,omitempty"`
+}
+
+// Instruction is the prompt text asking LongCat to follow the schema
+func (f *JSONSchemaFormat) Instruction() string {
+	schema, _ := json.Marshal(f.Schema)
+	return fmt.Sprintf("Respond only with JSON that conforms to the following JSON schema, without code fences or any other text:\n%s", schema)
+}
+
+// Check parses content, tolerating a surrounding Markdown code fence, and
+// validates it against the schema. It returns the bare JSON text.
+func (f *JSONSchemaFormat) Check(content string) (string, error) {
+	content = strings.TrimSpace(content)
+	if body, ok := strings.CutPrefix(content, "```"); ok {
+		// Drop the language tag, if any
+		if end := strings.IndexFunc(body, unicode.IsSpace); end > 0 && !strings.ContainsAny(body[:end], "{[\"") {
+			body = body[end:]
+		}
+		if body, ok = strings.CutSuffix(strings.TrimSpace(body), "```"); ok {
+			content = strings.TrimSpace(body)
+		}
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		return "", fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	if err := (schemaValidator{root: f.Schema}).validate(f.Schema, value, "$"); err != nil {
+		return "", fmt.Errorf("response does not match json_schema %q: %w", f.Name, err)
+	}
+	return content, nil
+}
+
+// CheckRefs reports a $ref in the schema that is unresolvable or cyclic
+func (f *JSONSchemaFormat) CheckRefs() error {
+	return schemaValidator{root: f.Schema}.checkRefs(f.Schema)
+}
+
+type responseSchemaKey struct{}
+
+// WithResponseSchema returns a context whose OpenAI response is checked
+// against format once complete
+func WithResponseSchema(ctx context.Context, format *JSONSchemaFormat) context.Context {
+	return context.WithValue(ctx, responseSchemaKey{}, format)
+}
+
+// responseSchemaFor returns the schema chosen for resp's request, if any
+func responseSchemaFor(resp *http.Response) *JSONSchemaFormat {
+	if resp.Request == nil {
+		return nil
+	}
+	format, _ := resp.Request.Context().Value(responseSchemaKey{}).(*JSONSchemaFormat)
+	return format
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+// Tokenizer counts tokens in text when LongCat does not report usage itself
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+// tokenizers are the tokenizers selectable through TOKENIZER and TOKENIZER_MODELS
+var tokenizers = map[string]Tokenizer{
+	"approx": approxTokenizer{},
+	"words":  wordTokenizer{},
+}
+
+// tokenizerFor returns the tokenizer configured for model
+func tokenizerFor(model string) Tokenizer {
+	name, ok := config.AppConfig.TokenizerModels[model]
+	if !ok {
+		name = config.AppConfig.Tokenizer
+	}
+	if tokenizer, ok := tokenizers[name]; ok {
+		return tokenizer
+	}
+	return approxTokenizer{}
+}
+
+// approxTokenizer counts about four bytes per token for ASCII text and one
+// token per character otherwise
+type approxTokenizer struct{}
+
+func (approxTokenizer) CountTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// wordTokenizer approximates BPE tokenizers such as cl100k: text is split
+// into words, digit groups and punctuation the way their pre-tokenizers do.
+// Common words are a single token and longer ones one more per six letters;
+// CJK characters are a token each.
+type wordTokenizer struct{}
+
+func (wordTokenizer) CountTokens(text string) int {
+	tokens := 0
+	letters, digits := 0, 0 // length of the current word and digit group
+	flush := func() {
+		if letters > 0 {
+			tokens += (letters + 5) / 6
+		}
+		if digits > 0 {
+			tokens++
+		}
+		letters, digits = 0, 0
+	}
+
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			tokens++
+		case unicode.IsLetter(r) || unicode.IsMark(r):
+			if digits > 0 {
+				flush()
+			}
+			letters++
+		case unicode.IsDigit(r):
+			// Numbers are split into groups of up to three digits
+			if letters > 0 || digits == 3 {
+				flush()
+			}
+			digits++
+		case unicode.IsSpace(r):
+			// A space is usually merged into the following word
+			flush()
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
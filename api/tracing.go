@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TraceContext is a request's W3C trace context, forwarded on its LongCat
+// calls so traces through the gateway stitch together
+type TraceContext struct {
+	TraceParent string
+	TraceState  string
+}
+
+type traceContextKey struct{}
+
+// WithTraceContext returns a context carrying the trace context from an
+// incoming traceparent and tracestate. A missing or malformed traceparent
+// starts a new trace, and its tracestate is dropped as the spec requires.
+func WithTraceContext(ctx context.Context, traceParent, traceState string) context.Context {
+	trace := TraceContext{TraceParent: traceParent, TraceState: traceState}
+	if !validTraceParent(traceParent) {
+		trace = TraceContext{TraceParent: newTraceParent()}
+	}
+	return context.WithValue(ctx, traceContextKey{}, trace)
+}
+
+// TraceContextFrom returns the trace context carried by ctx, if any
+func TraceContextFrom(ctx context.Context) (TraceContext, bool) {
+	trace, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return trace, ok
+}
+
+// setTraceHeaders forwards ctx's trace context and derives m-traceid from
+// its trace ID, so LongCat's own trace lines up with the caller's
+func setTraceHeaders(ctx context.Context, header http.Header) {
+	trace, ok := TraceContextFrom(ctx)
+	if !ok {
+		return
+	}
+	header.Set("traceparent", trace.TraceParent)
+	if trace.TraceState != "" {
+		header.Set("tracestate", trace.TraceState)
+	}
+	// m-traceid is a positive decimal int64, so it takes the low 63 bits
+	if low, err := strconv.ParseUint(traceID(trace.TraceParent)[16:], 16, 64); err == nil {
+		header.Set("m-traceid", strconv.FormatUint(low&math.MaxInt64, 10))
+	}
+}
+
+// traceID returns the 32 hex digit trace ID of a valid traceparent
+func traceID(traceParent string) string {
+	return traceParent[3:35]
+}
+
+// validTraceParent checks the version-trace_id-parent_id-flags format.
+// Versions after 00 may append fields, which are ignored.
+func validTraceParent(traceParent string) bool {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 4 || !isLowerHex(parts[0], 2) || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return false
+	}
+	return isLowerHex(parts[1], 32) && strings.Trim(parts[1], "0") != "" &&
+		isLowerHex(parts[2], 16) && strings.Trim(parts[2], "0") != "" &&
+		isLowerHex(parts[3], 2)
+}
+
+func isLowerHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newTraceParent starts a trace with random trace and parent IDs. It is not
+// marked sampled, since the gateway records no spans itself.
+func newTraceParent() string {
+	var ids [24]byte
+	rand.Read(ids[:])
+	return "00-" + hex.EncodeToString(ids[:16]) + "-" + hex.EncodeToString(ids[16:]) + "-00"
+}
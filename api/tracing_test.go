@@ -0,0 +1,36 @@
+package api
+
+import "testing"
+
+func TestValidTraceParent(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceParent string
+		want        bool
+	}{
+		{"version 00", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"newer version with extra fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"version 00 with extra fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"version ff", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"upper-case hex", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero parent ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"short trace ID", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false},
+		{"bad flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1", false},
+		{"too few fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validTraceParent(tt.traceParent); got != tt.want {
+				t.Fatalf("validTraceParent(%q) = %v, want %v", tt.traceParent, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTraceParentIsValid(t *testing.T) {
+	if traceParent := newTraceParent(); !validTraceParent(traceParent) {
+		t.Fatalf("newTraceParent() = %q, which is not a valid traceparent", traceParent)
+	}
+}
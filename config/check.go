@@ -0,0 +1,147 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// invalidEnv collects the variables the getEnvAs helpers could not parse
+var invalidEnv []string
+
+// Check reports every incoherent setting at once, so a bad configuration
+// fails at startup rather than on the first request that depends on it
+func (c *Config) Check() error {
+	problems := append([]string(nil), invalidEnv...)
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(c.ServerPort); err != nil || port < 1 || port > 65535 {
+		add("SERVER_PORT must be a port number between 1 and 65535, got %q", c.ServerPort)
+	}
+	if c.Timeout <= 0 {
+		add("TIMEOUT_SECONDS must be greater than 0, got %d", c.Timeout)
+	}
+	if c.SessionTimeout <= 0 {
+		add("SESSION_TIMEOUT_SECONDS must be greater than 0, got %d", c.SessionTimeout)
+	}
+	for name, value := range map[string]string{"LONGCAT_API_URL": c.LongCatAPIURL, "LONGCAT_SESSION_URL": c.LongCatSessionURL} {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("%s must be an http or https URL, got %q", name, value)
+		}
+	}
+	// The LongCat client honours the standard proxy variables
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if value := os.Getenv(name); value != "" && !validProxyURL(value) {
+			add("%s must be a proxy URL such as http://proxy:3128, got %q", name, value)
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		add("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	} else if c.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			add("TLS_CERT_FILE and TLS_KEY_FILE cannot be loaded: %v", err)
+		}
+	}
+
+	for alias, model := range c.ModelAliases {
+		if alias == "" || model == "" {
+			add("MODEL_ALIASES entry %q=%q needs both an alias and a model", alias, model)
+		} else if _, chained := c.ModelAliases[model]; chained && model != alias {
+			add("MODEL_ALIASES maps %s to %s, which is itself an alias; aliases are not followed", alias, model)
+		}
+	}
+
+	for name, value := range map[string]int{
+		"MAX_CONCURRENT_REQUESTS":     c.MaxConcurrent,
+		"MAX_STREAMS_PER_KEY":         c.MaxStreamsPerKey,
+		"MAX_CONVERSATION_TOKENS":     c.MaxConvTokens,
+		"CIRCUIT_BREAKER_FAILURES":    c.BreakerFailures,
+		"RESPONSE_CACHE_TTL":          c.ResponseCacheTTL,
+		"MAX_RESPONSE_BYTES":          c.MaxResponseBytes,
+		"READ_HEADER_TIMEOUT_SECONDS": c.ReadHeaderTimeout,
+		"READ_TIMEOUT_SECONDS":        c.ReadTimeout,
+		"WRITE_TIMEOUT_SECONDS":       c.WriteTimeout,
+		"IDLE_TIMEOUT_SECONDS":        c.IdleTimeout,
+	} {
+		if value < 0 {
+			add("%s must not be negative, got %d", name, value)
+		}
+	}
+	if c.BreakerFailures > 0 && c.BreakerCooldown <= 0 {
+		add("CIRCUIT_BREAKER_COOLDOWN_SECONDS must be greater than 0 when CIRCUIT_BREAKER_FAILURES is set, got %d", c.BreakerCooldown)
+	}
+	if c.ResponseCacheTTL > 0 && c.ResponseCacheSize <= 0 {
+		add("RESPONSE_CACHE_SIZE must be greater than 0 when RESPONSE_CACHE_TTL is set, got %d", c.ResponseCacheSize)
+	}
+	if c.LogSampleRate < 0 || c.LogSampleRate > 1 {
+		add("LOG_SAMPLE_RATE must be between 0.0 and 1.0, got %g", c.LogSampleRate)
+	}
+	if c.MirrorSampleRate < 0 || c.MirrorSampleRate > 1 {
+		add("MIRROR_SAMPLE_RATE must be between 0.0 and 1.0, got %g", c.MirrorSampleRate)
+	}
+	if c.MirrorURL != "" {
+		if u, err := url.Parse(c.MirrorURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("MIRROR_URL must be an http or https URL")
+		}
+	}
+
+	for name, option := range map[string]struct {
+		value   string
+		allowed []string
+	}{
+		"MESSAGE_NAME_MODE":         {c.MessageNameMode, []string{"prefix", "ignore"}},
+		"TOKENIZER":                 {c.Tokenizer, []string{"approx", "words"}},
+		"TRAILING_WHITESPACE":       {c.TrailingSpace, []string{"keep", "trim", "newline"}},
+		"DUPLICATE_MESSAGES":        {c.DuplicateMessages, []string{"dedupe", "append"}},
+		"REASONING_FIELD":           {c.ReasoningField, []string{"reasoning", "reasoning_content", "both"}},
+		"CLAUDE_EMPTY_CONTENT":      {c.ClaudeEmptyBlock, []string{"text", "none"}},
+		"SECRETS_PROVIDER":          {c.SecretsProvider, []string{"", "env", "file", "vault"}},
+		"PROMPT_TRANSFORM_ON_ERROR": {c.TransformOnError, []string{"fail", "passthrough"}},
+		"PARTIAL_FINISH_REASON":     {c.PartialFinish, []string{"length", "timeout"}},
+	} {
+		if !contains(option.allowed, option.value) {
+			add("%s must be one of %s, got %q", name, strings.Join(option.allowed, ", "), option.value)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	// Sorted, since several checks range over maps
+	sort.Strings(problems)
+	return errors.New("invalid configuration:\n  - " + strings.Join(problems, "\n  - "))
+}
+
+// validProxyURL mirrors http.ProxyFromEnvironment, which reads a value
+// without a scheme as an http proxy
+func validProxyURL(value string) bool {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		u, err = url.Parse("http://" + value)
+	}
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return true
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
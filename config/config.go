@@ -1,10 +1,13 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -14,6 +17,90 @@ type Config struct {
 	LongCatSessionURL string
 	ServerPort        string
 	Timeout           int
+	Warmup            bool
+	WarmupCookies     bool
+	ClaudePingSeconds int
+	MaxStreamSeconds  int
+	UseKeychain       bool
+	StatelessMode     bool
+	StatelessAppend   bool
+	DebugAPIKey       string
+	DefaultMaxTokens  int
+	HardMaxTokens     int
+	SSERetryMillis    int
+	AllowUpstreamURL  bool
+	UpstreamAllowlist []string
+	PluginInfo        bool
+	ConfigFallbackDir string
+	EmptyResponseMsg  string
+	EmptyResponseErr  bool
+	MaxConcurrent     int
+	AnyContentType    bool
+	ForwardMessages   bool
+	ModelAliases      map[string]string
+	AllowedModels     []string
+	ResumeSeconds     int
+	ResumeMaxBytes    int
+	SerializeTurns    bool
+	SystemTemplate    string
+	EmptyRetries      int
+	TLSCertFile       string
+	TLSKeyFile        string
+	H2C               bool
+	MaxConvTokens     int
+	MessageNameMode   string
+	CancelPrevious    bool
+	StrictMaxTokens   bool
+	Tokenizer         string
+	TokenizerModels   map[string]string
+	ExposeLongCatIDs  bool
+	CookieStatusSecs  int
+	TrailingSpace     string
+	LogSampleRate     float64
+	UpstreamAs502     bool
+	SessionRetries    int
+	SessionBackoffMs  int
+	SessionTimeout    int
+	SessionPoolSize   int
+	ContentDenylist   map[string]string
+	ContentAllowlist  []string
+	FinishReasonMap   map[string]string
+	FewShotExamples   []FewShotExample
+	CoalesceMillis    int
+	CoalesceBytes     int
+	DuplicateMessages string
+	RoleEveryChunk    bool
+	ServiceTier       string
+	ResponseCacheTTL  int
+	ResponseCacheSize int
+	ModelDefaults     map[string]ModelDefault
+	ReasoningField    string
+	MaxStreamsPerKey  int
+	APIKeys           []string
+	BreakerFailures   int
+	BreakerCooldown   int
+	SecretsProvider   string
+	SecretsFile       string
+	VaultAddr         string
+	VaultToken        string
+	VaultPath         string
+	SecretsRefresh    int
+	ClaudeEmptyBlock  string
+	QueryOverrides    bool
+	StreamUsage       bool
+	TransformFile     string
+	TransformOnError  string
+	PartialOnTimeout  bool
+	PartialFinish     string
+	AnthropicBetas    []string
+	MaxResponseBytes  int
+	MirrorURL         string
+	MirrorSampleRate  float64
+	ReadHeaderTimeout int
+	ReadTimeout       int
+	WriteTimeout      int
+	IdleTimeout       int
+	KeepAlive         bool
 	Cookies           CookieConfig
 }
 
@@ -40,6 +127,90 @@ func LoadConfig() {
 		LongCatSessionURL: getEnv("LONGCAT_SESSION_URL", "https://longcat.chat/api/v1/session-create"),
 		ServerPort:        getEnv("SERVER_PORT", "8082"),
 		Timeout:           getEnvAsInt("TIMEOUT_SECONDS", 30),
+		Warmup:            getEnvAsBool("WARMUP", false),
+		WarmupCookies:     getEnvAsBool("WARMUP_VALIDATE_COOKIES", false),
+		ClaudePingSeconds: getEnvAsInt("CLAUDE_PING_INTERVAL_SECONDS", 10),
+		MaxStreamSeconds:  getEnvAsInt("MAX_STREAM_DURATION_SECONDS", 0),
+		UseKeychain:       getEnvAsBool("USE_KEYCHAIN", false),
+		StatelessMode:     getEnvAsBool("STATELESS_MODE", false),
+		StatelessAppend:   getEnvAsBool("STATELESS_APPEND_ASSISTANT", true),
+		DebugAPIKey:       getEnv("DEBUG_API_KEY", ""),
+		DefaultMaxTokens:  getEnvAsInt("DEFAULT_MAX_TOKENS", 0),
+		HardMaxTokens:     getEnvAsInt("HARD_MAX_TOKENS", 0),
+		SSERetryMillis:    getEnvAsInt("SSE_RETRY_MS", 0),
+		AllowUpstreamURL:  getEnvAsBool("ALLOW_UPSTREAM_OVERRIDE", false),
+		UpstreamAllowlist: getEnvAsList("UPSTREAM_OVERRIDE_ALLOWLIST"),
+		PluginInfo:        getEnvAsBool("PLUGIN_INFO_ENABLED", false),
+		ConfigFallbackDir: getEnv("CONFIG_FALLBACK_DIR", filepath.Join(os.TempDir(), "longcat-web-api")),
+		EmptyResponseMsg:  getEnv("EMPTY_RESPONSE_MESSAGE", "I apologize, but I'm unable to process your request at the moment."),
+		EmptyResponseErr:  getEnvAsBool("EMPTY_RESPONSE_AS_ERROR", false),
+		MaxConcurrent:     getEnvAsInt("MAX_CONCURRENT_REQUESTS", 0),
+		AnyContentType:    getEnvAsBool("ALLOW_ANY_CONTENT_TYPE", false),
+		ForwardMessages:   getEnvAsBool("FORWARD_MESSAGES", false),
+		ModelAliases:      getEnvAsMap("MODEL_ALIASES"),
+		AllowedModels:     getEnvAsList("ALLOWED_MODELS"),
+		ResumeSeconds:     getEnvAsInt("STREAM_RESUME_SECONDS", 0),
+		ResumeMaxBytes:    getEnvAsInt("STREAM_RESUME_MAX_BYTES", 1<<20),
+		SerializeTurns:    getEnvAsBool("SERIALIZE_CONVERSATION_TURNS", true),
+		SystemTemplate:    getEnv("SYSTEM_PROMPT_TEMPLATE", "{system}\n\n{prompt}"),
+		EmptyRetries:      getEnvAsInt("EMPTY_RESPONSE_RETRIES", 1),
+		TLSCertFile:       getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:        getEnv("TLS_KEY_FILE", ""),
+		H2C:               getEnvAsBool("H2C_ENABLED", false),
+		MaxConvTokens:     getEnvAsInt("MAX_CONVERSATION_TOKENS", 0),
+		MessageNameMode:   getEnv("MESSAGE_NAME_MODE", "prefix"),
+		CancelPrevious:    getEnvAsBool("CANCEL_PREVIOUS_TURN", true),
+		StrictMaxTokens:   getEnvAsBool("STRICT_MAX_TOKENS", true),
+		Tokenizer:         getEnv("TOKENIZER", "approx"),
+		TokenizerModels:   getEnvAsMap("TOKENIZER_MODELS"),
+		ExposeLongCatIDs:  getEnvAsBool("EXPOSE_LONGCAT_IDS", false),
+		CookieStatusSecs:  getEnvAsInt("COOKIE_STATUS_CACHE_SECONDS", 60),
+		TrailingSpace:     getEnv("TRAILING_WHITESPACE", "keep"),
+		LogSampleRate:     getEnvAsFloat("LOG_SAMPLE_RATE", 1.0),
+		UpstreamAs502:     getEnvAsBool("UPSTREAM_ERRORS_AS_502", true),
+		SessionRetries:    getEnvAsInt("SESSION_CREATE_RETRIES", 2),
+		SessionBackoffMs:  getEnvAsInt("SESSION_CREATE_BACKOFF_MS", 500),
+		SessionTimeout:    getEnvAsInt("SESSION_TIMEOUT_SECONDS", 10),
+		SessionPoolSize:   getEnvAsInt("SESSION_POOL_SIZE", 0),
+		ContentDenylist:   getEnvAsMap("CONTENT_DENYLIST"),
+		ContentAllowlist:  getEnvAsList("CONTENT_ALLOWLIST"),
+		FinishReasonMap:   lowerKeys(getEnvAsMap("FINISH_REASON_MAP")),
+		FewShotExamples:   getEnvAsFewShot("FEWSHOT_EXAMPLES"),
+		CoalesceMillis:    getEnvAsInt("STREAM_COALESCE_MS", 0),
+		CoalesceBytes:     getEnvAsInt("STREAM_COALESCE_BYTES", 512),
+		DuplicateMessages: getEnv("DUPLICATE_MESSAGES", "dedupe"),
+		RoleEveryChunk:    getEnvAsBool("EMIT_ROLE_EVERY_CHUNK", false),
+		ServiceTier:       getEnv("SERVICE_TIER", "default"),
+		ResponseCacheTTL:  getEnvAsInt("RESPONSE_CACHE_TTL", 0),
+		ResponseCacheSize: getEnvAsInt("RESPONSE_CACHE_SIZE", 1000),
+		ModelDefaults:     getEnvAsModelDefaults("MODEL_DEFAULTS"),
+		ReasoningField:    getEnv("REASONING_FIELD", "reasoning"),
+		MaxStreamsPerKey:  getEnvAsInt("MAX_STREAMS_PER_KEY", 0),
+		APIKeys:           getEnvAsList("API_KEYS"),
+		BreakerFailures:   getEnvAsInt("CIRCUIT_BREAKER_FAILURES", 0),
+		BreakerCooldown:   getEnvAsInt("CIRCUIT_BREAKER_COOLDOWN_SECONDS", 30),
+		SecretsProvider:   getEnv("SECRETS_PROVIDER", ""),
+		SecretsFile:       getEnv("SECRETS_FILE", ""),
+		VaultAddr:         getEnv("VAULT_ADDR", ""),
+		VaultToken:        getEnv("VAULT_TOKEN", ""),
+		VaultPath:         getEnv("VAULT_SECRET_PATH", ""),
+		SecretsRefresh:    getEnvAsInt("SECRETS_REFRESH_SECONDS", 0),
+		ClaudeEmptyBlock:  getEnv("CLAUDE_EMPTY_CONTENT", "text"),
+		QueryOverrides:    getEnvAsBool("ALLOW_QUERY_OVERRIDES", false),
+		StreamUsage:       getEnvAsBool("STREAM_USAGE_UPDATES", false),
+		TransformFile:     getEnv("PROMPT_TRANSFORM_FILE", ""),
+		TransformOnError:  getEnv("PROMPT_TRANSFORM_ON_ERROR", "fail"),
+		PartialOnTimeout:  getEnvAsBool("PARTIAL_ON_TIMEOUT", false),
+		PartialFinish:     getEnv("PARTIAL_FINISH_REASON", "length"),
+		AnthropicBetas:    getEnvAsList("ANTHROPIC_BETAS"),
+		MaxResponseBytes:  getEnvAsInt("MAX_RESPONSE_BYTES", 0),
+		MirrorURL:         getEnv("MIRROR_URL", ""),
+		MirrorSampleRate:  getEnvAsFloat("MIRROR_SAMPLE_RATE", 1.0),
+		ReadHeaderTimeout: getEnvAsInt("READ_HEADER_TIMEOUT_SECONDS", 10),
+		ReadTimeout:       getEnvAsInt("READ_TIMEOUT_SECONDS", 0),
+		WriteTimeout:      getEnvAsInt("WRITE_TIMEOUT_SECONDS", 0),
+		IdleTimeout:       getEnvAsInt("IDLE_TIMEOUT_SECONDS", 120),
+		KeepAlive:         getEnvAsBool("HTTP_KEEP_ALIVE", true),
 		Cookies: CookieConfig{
 			LxsdkCuid:     getEnv("COOKIE_LXSDK_CUID", ""),
 			PassportToken: getEnv("COOKIE_PASSPORT_TOKEN", ""),
@@ -53,13 +224,17 @@ func LoadConfig() {
 func validateConfig() {
 	// Don't fail immediately if cookies are missing
 	// The main function will handle prompting for cookies
-	if AppConfig.Cookies.LxsdkCuid == "" {
+	if AppConfig.SecretsProvider != "" {
+		return
+	}
+	cookies := CurrentCookies()
+	if cookies.LxsdkCuid == "" {
 		log.Println("Note: COOKIE_LXSDK_CUID is not set")
 	}
-	if AppConfig.Cookies.PassportToken == "" {
+	if cookies.PassportToken == "" {
 		log.Println("Note: COOKIE_PASSPORT_TOKEN is not set (will prompt for cookies)")
 	}
-	if AppConfig.Cookies.LxsdkS == "" {
+	if cookies.LxsdkS == "" {
 		log.Println("Note: COOKIE_LXSDK_S is not set")
 	}
 }
@@ -80,11 +255,119 @@ func getEnvAsInt(key string, defaultValue int) int {
 	value, err := strconv.Atoi(valueStr)
 	if err != nil {
 		log.Printf("Warning: Invalid integer value for %s, using default: %d", key, defaultValue)
+		invalidEnv = append(invalidEnv, fmt.Sprintf("%s must be an integer, got %q", key, valueStr))
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	valueStr := getEnv(key, "")
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		log.Printf("Warning: Invalid boolean value for %s, using default: %t", key, defaultValue)
+		invalidEnv = append(invalidEnv, fmt.Sprintf("%s must be true or false, got %q", key, valueStr))
 		return defaultValue
 	}
 	return value
 }
 
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	valueStr := getEnv(key, "")
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		log.Printf("Warning: Invalid float value for %s, using default: %g", key, defaultValue)
+		invalidEnv = append(invalidEnv, fmt.Sprintf("%s must be a number, got %q", key, valueStr))
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvAsList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// FewShotExample is one turn of FEWSHOT_EXAMPLES
+type FewShotExample struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// getEnvAsFewShot parses a JSON array of {"role", "content"} objects
+func getEnvAsFewShot(key string) []FewShotExample {
+	value := getEnv(key, "")
+	if value == "" {
+		return nil
+	}
+	var examples []FewShotExample
+	if err := json.Unmarshal([]byte(value), &examples); err != nil {
+		log.Printf("Warning: ignoring invalid %s: %v", key, err)
+		invalidEnv = append(invalidEnv, fmt.Sprintf("%s is not valid JSON: %v", key, err))
+		return nil
+	}
+	return examples
+}
+
+// ModelDefault holds the parameters MODEL_DEFAULTS applies to one model
+// when the client does not set them
+type ModelDefault struct {
+	Reasoning bool   `json:"reasoning,omitempty"`
+	Search    bool   `json:"search,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+	Agent     string `json:"agent,omitempty"` // LongCat agent ID for new sessions
+}
+
+// getEnvAsModelDefaults parses a JSON object mapping model names to defaults
+func getEnvAsModelDefaults(key string) map[string]ModelDefault {
+	value := getEnv(key, "")
+	if value == "" {
+		return nil
+	}
+	var defaults map[string]ModelDefault
+	if err := json.Unmarshal([]byte(value), &defaults); err != nil {
+		log.Printf("Warning: ignoring invalid %s: %v", key, err)
+		invalidEnv = append(invalidEnv, fmt.Sprintf("%s is not valid JSON: %v", key, err))
+		return nil
+	}
+	return defaults
+}
+
+// getEnvAsMap parses comma-separated key=value pairs
+func getEnvAsMap(key string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range getEnvAsList(key) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Printf("Warning: ignoring malformed %s entry %q", key, pair)
+			invalidEnv = append(invalidEnv, fmt.Sprintf("%s entry %q is not a key=value pair", key, pair))
+			continue
+		}
+		values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return values
+}
+
+// lowerKeys lowercases the keys of values, for maps looked up case-insensitively
+func lowerKeys(values map[string]string) map[string]string {
+	lowered := make(map[string]string, len(values))
+	for k, v := range values {
+		lowered[strings.ToLower(k)] = v
+	}
+	return lowered
+}
+
 func (c *Config) GetServerAddress() string {
 	return fmt.Sprintf(":%s", c.ServerPort)
 }
\ No newline at end of file
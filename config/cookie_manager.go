@@ -13,6 +13,8 @@ import (
 // CookieManager handles cookie parsing and storage
 type CookieManager struct {
 	configPath string
+	readOnly   bool            // No writable config directory was found
+	provider   SecretsProvider // SECRETS_PROVIDER, resolved on first use
 }
 
 // SavedConfig represents the configuration saved to file
@@ -26,13 +28,49 @@ func NewCookieManager() *CookieManager {
 	configDir := filepath.Join(homeDir, ".config", "longcat-web-api")
 	
 	// Create config directory if it doesn't exist
-	os.MkdirAll(configDir, 0755)
+	err := ensureWritableDir(configDir)
+	if err == nil {
+		return &CookieManager{
+			configPath: filepath.Join(configDir, "config.json"),
+		}
+	}
+	fmt.Printf("Warning: config directory %s is not writable: %v\n", configDir, err)
+	
+	// Fall back to the alternate directory, e.g. in containers with read-only homes
+	if AppConfig != nil && AppConfig.ConfigFallbackDir != "" {
+		if err := ensureWritableDir(AppConfig.ConfigFallbackDir); err == nil {
+			fmt.Printf("Warning: using fallback config directory %s\n", AppConfig.ConfigFallbackDir)
+			return &CookieManager{
+				configPath: filepath.Join(AppConfig.ConfigFallbackDir, "config.json"),
+			}
+		}
+	}
 	
+	fmt.Println("Warning: no writable config directory, cookies will not be saved (use COOKIE_* environment variables)")
 	return &CookieManager{
 		configPath: filepath.Join(configDir, "config.json"),
+		readOnly:   true,
 	}
 }
 
+// ensureWritableDir creates dir if needed and verifies files can be written to it
+func ensureWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".write-test-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// ConfigPath returns the path of the saved configuration file
+func (cm *CookieManager) ConfigPath() string {
+	return cm.configPath
+}
+
 // ParseRawCookies parses raw cookie string from browser
 func (cm *CookieManager) ParseRawCookies(rawCookies string) (CookieConfig, error) {
 	cookies := CookieConfig{}
@@ -74,6 +112,23 @@ func (cm *CookieManager) ParseRawCookies(rawCookies string) (CookieConfig, error
 
 // SaveCookies saves cookies to config file
 func (cm *CookieManager) SaveCookies(cookies CookieConfig) error {
+	if cm.readOnly && !keychainEnabled() {
+		return fmt.Errorf("no writable config directory, cookies are only kept for this session")
+	}
+	
+	// Keep the passport token out of the plaintext file when the keychain works
+	if keychainEnabled() {
+		if err := cm.SaveToKeychain(cookies); err != nil {
+			fmt.Printf("Warning: %v, falling back to config file\n", err)
+		} else {
+			fmt.Println("Passport token saved to system keychain")
+			cookies.PassportToken = ""
+		}
+		if cm.readOnly {
+			return fmt.Errorf("no writable config directory, only the passport token was saved")
+		}
+	}
+
 	config := SavedConfig{
 		Cookies: cookies,
 	}
@@ -94,15 +149,27 @@ func (cm *CookieManager) SaveCookies(cookies CookieConfig) error {
 
 // LoadCookies loads cookies from config file
 func (cm *CookieManager) LoadCookies() (CookieConfig, error) {
+	var config SavedConfig
 	data, err := ioutil.ReadFile(cm.configPath)
 	if err != nil {
-		return CookieConfig{}, err
+		if !keychainEnabled() {
+			return CookieConfig{}, err
+		}
+	} else {
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return CookieConfig{}, fmt.Errorf("failed to parse config file: %w", err)
+		}
 	}
 	
-	var config SavedConfig
-	err = json.Unmarshal(data, &config)
-	if err != nil {
-		return CookieConfig{}, fmt.Errorf("failed to parse config file: %w", err)
+	// The keychain takes precedence over a token stored in the file
+	if keychainEnabled() {
+		token, keychainErr := cm.LoadFromKeychain()
+		if keychainErr == nil && token != "" {
+			config.Cookies.PassportToken = token
+		} else if err != nil {
+			return CookieConfig{}, err
+		}
 	}
 	
 	return config.Cookies, nil
@@ -159,6 +226,11 @@ func (cm *CookieManager) PromptForCookies() (CookieConfig, error) {
 			cookies.LxsdkS[max(0, len(cookies.LxsdkS)-4):])
 	}
 	
+	if cm.readOnly && !keychainEnabled() {
+		fmt.Println("\nWarning: no writable config directory, these cookies are only kept for this session")
+		return cookies, nil
+	}
+	
 	// Ask if user wants to save
 	fmt.Print("\nSave these cookies for future use? (y/n): ")
 	response, _ := reader.ReadString('\n')
@@ -191,12 +263,26 @@ func max(a, b int) int {
 
 // GetCookies attempts to get cookies from various sources
 func (cm *CookieManager) GetCookies() (CookieConfig, error) {
+	// A configured secrets provider is the only source
+	if cm.provider == nil && AppConfig != nil && AppConfig.SecretsProvider != "" {
+		provider, err := NewSecretsProvider(AppConfig.SecretsProvider)
+		if err != nil {
+			return CookieConfig{}, err
+		}
+		cm.provider = provider
+	}
+	if cm.provider != nil {
+		return cm.provider.GetCookies()
+	}
+
 	// 1. Try environment variables first
-	if AppConfig != nil && AppConfig.Cookies.PassportToken != "" {
-		return AppConfig.Cookies, nil
+	if AppConfig != nil {
+		if cookies := CurrentCookies(); cookies.PassportToken != "" {
+			return cookies, nil
+		}
 	}
 	
-	// 2. Try loading from config file
+	// 2. Try loading from the keychain (if enabled) and config file
 	cookies, err := cm.LoadCookies()
 	if err == nil && cookies.PassportToken != "" {
 		fmt.Println("Loaded cookies from config file")
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	keychainService = "longcat-web-api"
+	keychainAccount = "passport_token_key"
+)
+
+// errKeychainUnavailable is returned when no supported keychain exists on this system
+var errKeychainUnavailable = errors.New("system keychain is not available")
+
+// keychainEnabled reports whether cookies should be kept in the system keychain
+func keychainEnabled() bool {
+	return AppConfig != nil && AppConfig.UseKeychain
+}
+
+// SaveToKeychain stores the passport token in the system keychain
+func (cm *CookieManager) SaveToKeychain(cookies CookieConfig) error {
+	if cookies.PassportToken == "" {
+		return fmt.Errorf("missing required cookie: passport_token_key")
+	}
+	if err := keychainSet(keychainService, keychainAccount, cookies.PassportToken); err != nil {
+		return fmt.Errorf("failed to save to keychain: %w", err)
+	}
+	return nil
+}
+
+// LoadFromKeychain retrieves the passport token from the system keychain
+func (cm *CookieManager) LoadFromKeychain() (string, error) {
+	token, err := keychainGet(keychainService, keychainAccount)
+	if err != nil {
+		return "", fmt.Errorf("failed to load from keychain: %w", err)
+	}
+	return token, nil
+}
+
+// DeleteFromKeychain removes the passport token from the system keychain
+func (cm *CookieManager) DeleteFromKeychain() error {
+	if err := keychainDelete(keychainService, keychainAccount); err != nil {
+		return fmt.Errorf("failed to delete from keychain: %w", err)
+	}
+	return nil
+}
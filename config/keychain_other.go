@@ -0,0 +1,15 @@
+//go:build !darwin && !linux && !windows
+
+package config
+
+func keychainSet(service, account, secret string) error {
+	return errKeychainUnavailable
+}
+
+func keychainGet(service, account string) (string, error) {
+	return "", errKeychainUnavailable
+}
+
+func keychainDelete(service, account string) error {
+	return errKeychainUnavailable
+}
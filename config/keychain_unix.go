@@ -0,0 +1,82 @@
+//go:build darwin || linux
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keychainSet stores a secret using macOS Keychain or libsecret
+func keychainSet(service, account, secret string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// security reads the command from stdin in interactive mode, so the
+		// secret never appears in the process list
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(securityCommand("add-generic-password", "-U", "-s", service, "-a", account, "-w", secret))
+	default:
+		cmd = exec.Command("secret-tool", "store", "--label="+service, "service", service, "account", account)
+		cmd.Stdin = strings.NewReader(secret)
+	}
+	return runKeychainCommand(cmd)
+}
+
+// keychainGet retrieves a secret using macOS Keychain or libsecret
+func keychainGet(service, account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	default:
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := runKeychainCommand(cmd); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// keychainDelete removes a secret using macOS Keychain or libsecret
+func keychainDelete(service, account string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "delete-generic-password", "-s", service, "-a", account)
+	default:
+		cmd = exec.Command("secret-tool", "clear", "service", service, "account", account)
+	}
+	return runKeychainCommand(cmd)
+}
+
+// securityCommand formats one line for security -i, double-quoting each
+// argument so spaces and quotes in a value survive its tokenizer
+func securityCommand(args ...string) string {
+	quoted := make([]string, len(args))
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	for i, arg := range args {
+		quoted[i] = `"` + escaper.Replace(arg) + `"`
+	}
+	return strings.Join(quoted, " ") + "\n"
+}
+
+func runKeychainCommand(cmd *exec.Cmd) error {
+	// exec.Command records a failed PATH lookup in cmd.Err
+	if cmd.Err != nil {
+		return errKeychainUnavailable
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
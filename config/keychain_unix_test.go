@@ -0,0 +1,25 @@
+//go:build darwin || linux
+
+package config
+
+import "testing"
+
+func TestSecurityCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"plain", []string{"add-generic-password", "-w", "token"}, `"add-generic-password" "-w" "token"` + "\n"},
+		{"spaces", []string{"-s", "long cat"}, `"-s" "long cat"` + "\n"},
+		{"quotes and backslashes", []string{`a"b\c`}, `"a\"b\\c"` + "\n"},
+		{"empty value", []string{"-a", ""}, `"-a" ""` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := securityCommand(tt.args...); got != tt.want {
+				t.Fatalf("securityCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
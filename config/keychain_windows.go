@@ -0,0 +1,112 @@
+//go:build windows
+
+package config
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+var (
+	advapi32       = syscall.NewLazyDLL("advapi32.dll")
+	procCredWriteW = advapi32.NewProc("CredWriteW")
+	procCredReadW  = advapi32.NewProc("CredReadW")
+	procCredDelete = advapi32.NewProc("CredDeleteW")
+	procCredFree   = advapi32.NewProc("CredFree")
+)
+
+// credential mirrors the Win32 CREDENTIALW structure
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+func credentialTarget(service, account string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(service + ":" + account)
+}
+
+// keychainSet stores a secret in Windows Credential Manager
+func keychainSet(service, account, secret string) error {
+	if err := procCredWriteW.Find(); err != nil {
+		return errKeychainUnavailable
+	}
+	target, err := credentialTarget(service, account)
+	if err != nil {
+		return err
+	}
+	userName, err := syscall.UTF16PtrFromString(account)
+	if err != nil {
+		return err
+	}
+
+	blob := []byte(secret)
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            credPersistLocalMachine,
+		UserName:           userName,
+	}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+
+	ret, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0)
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+// keychainGet retrieves a secret from Windows Credential Manager
+func keychainGet(service, account string) (string, error) {
+	if err := procCredReadW.Find(); err != nil {
+		return "", errKeychainUnavailable
+	}
+	target, err := credentialTarget(service, account)
+	if err != nil {
+		return "", err
+	}
+
+	var cred *credential
+	ret, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ret == 0 {
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	return string(blob), nil
+}
+
+// keychainDelete removes a secret from Windows Credential Manager
+func keychainDelete(service, account string) error {
+	if err := procCredDelete.Find(); err != nil {
+		return errKeychainUnavailable
+	}
+	target, err := credentialTarget(service, account)
+	if err != nil {
+		return err
+	}
+
+	ret, _, err := procCredDelete.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0)
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretsProvider supplies the LongCat cookies from an external source,
+// selected with SECRETS_PROVIDER
+type SecretsProvider interface {
+	GetCookies() (CookieConfig, error)
+}
+
+// NewSecretsProvider returns the provider with the given name: env, file or
+// vault
+func NewSecretsProvider(name string) (SecretsProvider, error) {
+	switch name {
+	case "env":
+		return envSecrets{}, nil
+	case "file":
+		if AppConfig.SecretsFile == "" {
+			return nil, fmt.Errorf("SECRETS_FILE is required for the file secrets provider")
+		}
+		return fileSecrets{path: AppConfig.SecretsFile}, nil
+	case "vault":
+		if AppConfig.VaultAddr == "" || AppConfig.VaultPath == "" {
+			return nil, fmt.Errorf("VAULT_ADDR and VAULT_SECRET_PATH are required for the vault secrets provider")
+		}
+		return vaultSecrets{
+			addr:   strings.TrimRight(AppConfig.VaultAddr, "/"),
+			token:  AppConfig.VaultToken,
+			path:   strings.Trim(AppConfig.VaultPath, "/"),
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown secrets provider %q", name)
+}
+
+// envSecrets reads the COOKIE_* environment variables
+type envSecrets struct{}
+
+func (envSecrets) GetCookies() (CookieConfig, error) {
+	cookies := CookieConfig{
+		LxsdkCuid:     os.Getenv("COOKIE_LXSDK_CUID"),
+		PassportToken: os.Getenv("COOKIE_PASSPORT_TOKEN"),
+		LxsdkS:        os.Getenv("COOKIE_LXSDK_S"),
+	}
+	if cookies.PassportToken == "" {
+		return CookieConfig{}, fmt.Errorf("COOKIE_PASSPORT_TOKEN is not set")
+	}
+	return cookies, nil
+}
+
+// fileSecrets reads a file in the format of the saved configuration, or one
+// holding just the passport token, such as a mounted Kubernetes secret
+type fileSecrets struct {
+	path string
+}
+
+func (s fileSecrets) GetCookies() (CookieConfig, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return CookieConfig{}, fmt.Errorf("failed to read secrets file: %w", err)
+	}
+	var saved SavedConfig
+	if err := json.Unmarshal(data, &saved); err != nil {
+		saved.Cookies = CookieConfig{PassportToken: strings.TrimSpace(string(data))}
+	}
+	if saved.Cookies.PassportToken == "" {
+		return CookieConfig{}, fmt.Errorf("secrets file %s has no passport token", s.path)
+	}
+	return saved.Cookies, nil
+}
+
+// vaultSecrets reads a HashiCorp Vault KV secret with the keys
+// passport_token_key, _lxsdk_cuid and _lxsdk_s. Both KV v1 paths and v2
+// paths (mount/data/name) work.
+type vaultSecrets struct {
+	addr   string
+	token  string
+	path   string
+	client *http.Client
+}
+
+func (s vaultSecrets) GetCookies() (CookieConfig, error) {
+	req, err := http.NewRequest(http.MethodGet, s.addr+"/v1/"+s.path, nil)
+	if err != nil {
+		return CookieConfig{}, fmt.Errorf("failed to create Vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return CookieConfig{}, fmt.Errorf("failed to read Vault secret: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return CookieConfig{}, fmt.Errorf("Vault returned %s for %s", resp.Status, s.path)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return CookieConfig{}, fmt.Errorf("failed to parse Vault response: %w", err)
+	}
+	// KV v2 nests the secret under data.data
+	values := map[string]string{}
+	if nested, ok := body.Data["data"]; ok {
+		if err := json.Unmarshal(nested, &values); err != nil {
+			return CookieConfig{}, fmt.Errorf("failed to parse Vault secret: %w", err)
+		}
+	} else {
+		for key, raw := range body.Data {
+			var value string
+			if json.Unmarshal(raw, &value) == nil {
+				values[key] = value
+			}
+		}
+	}
+
+	cookies := CookieConfig{
+		LxsdkCuid:     values["_lxsdk_cuid"],
+		PassportToken: values["passport_token_key"],
+		LxsdkS:        values["_lxsdk_s"],
+	}
+	if cookies.PassportToken == "" {
+		return CookieConfig{}, fmt.Errorf("Vault secret %s has no passport_token_key", s.path)
+	}
+	return cookies, nil
+}
+
+// cookiesMu guards AppConfig.Cookies once the server may rotate them
+var cookiesMu sync.RWMutex
+
+// CurrentCookies returns the cookies to send to LongCat
+func CurrentCookies() CookieConfig {
+	cookiesMu.RLock()
+	defer cookiesMu.RUnlock()
+	return AppConfig.Cookies
+}
+
+// SetCookies replaces the cookies sent to LongCat
+func SetCookies(cookies CookieConfig) {
+	cookiesMu.Lock()
+	defer cookiesMu.Unlock()
+	AppConfig.Cookies = cookies
+}
+
+// RefreshCookies fetches the cookies from provider every interval, so a
+// rotated token is picked up without a restart. A failed fetch keeps the
+// current cookies.
+func RefreshCookies(provider SecretsProvider, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cookies, err := provider.GetCookies()
+		if err != nil {
+			log.Printf("Warning: failed to refresh cookies: %v", err)
+			continue
+		}
+		if cookies != CurrentCookies() {
+			SetCookies(cookies)
+			log.Println("Cookies rotated by the secrets provider")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSecrets hands out a queue of results, repeating the last one
+type fakeSecrets struct {
+	mu      sync.Mutex
+	results []fakeResult
+	calls   int
+}
+
+type fakeResult struct {
+	cookies CookieConfig
+	err     error
+}
+
+func (f *fakeSecrets) GetCookies() (CookieConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := f.results[min(f.calls, len(f.results)-1)]
+	f.calls++
+	return result.cookies, result.err
+}
+
+func TestRefreshCookies(t *testing.T) {
+	saved := CurrentCookies()
+	defer SetCookies(saved)
+
+	initial := CookieConfig{PassportToken: "token-1", LxsdkCuid: "cuid"}
+	rotated := CookieConfig{PassportToken: "token-2", LxsdkCuid: "cuid"}
+	provider := &fakeSecrets{results: []fakeResult{
+		{err: errors.New("vault unavailable")}, // A failed fetch keeps the current cookies
+		{cookies: rotated},
+		// RefreshCookies cannot be stopped; failing from here on keeps it
+		// from touching the cookies once the test restores them
+		{err: errors.New("done")},
+	}}
+
+	SetCookies(initial)
+	go RefreshCookies(provider, 5*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for CurrentCookies() != rotated {
+		if time.Now().After(deadline) {
+			t.Fatalf("cookies = %+v, want the rotated %+v", CurrentCookies(), rotated)
+		}
+		if current := CurrentCookies(); current != initial && current != rotated {
+			t.Fatalf("cookies = %+v during refresh, want %+v or %+v", current, initial, rotated)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCookieManagerGetCookiesUsesProvider(t *testing.T) {
+	saved := CurrentCookies()
+	defer SetCookies(saved)
+	// Cookies already in the environment must not shadow the provider
+	SetCookies(CookieConfig{PassportToken: "from-env"})
+
+	tests := []struct {
+		name    string
+		result  fakeResult
+		want    CookieConfig
+		wantErr bool
+	}{
+		{"provider cookies", fakeResult{cookies: CookieConfig{PassportToken: "from-provider"}}, CookieConfig{PassportToken: "from-provider"}, false},
+		{"provider error", fakeResult{err: errors.New("no secret")}, CookieConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &CookieManager{provider: &fakeSecrets{results: []fakeResult{tt.result}}}
+			got, err := cm.GetCookies()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetCookies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("GetCookies() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
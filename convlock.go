@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+const conversationLockShards = 32
+
+// conversationLocks serializes turns on the same LongCat conversation while
+// letting different conversations run in parallel. Locks are spread over
+// shards to keep the bookkeeping off a single global mutex.
+type conversationLocks struct {
+	shards [conversationLockShards]conversationLockShard
+}
+
+type conversationLockShard struct {
+	mu    sync.Mutex
+	locks map[string]*conversationLock
+}
+
+// conversationLock is a channel-based mutex so waiting can be abandoned
+type conversationLock struct {
+	ch   chan struct{}
+	refs int // holders plus waiters; the lock is dropped when this reaches zero
+}
+
+func newConversationLocks() *conversationLocks {
+	cl := &conversationLocks{}
+	for i := range cl.shards {
+		cl.shards[i].locks = make(map[string]*conversationLock)
+	}
+	return cl
+}
+
+func (cl *conversationLocks) shard(conversationID string) *conversationLockShard {
+	h := fnv.New32a()
+	h.Write([]byte(conversationID))
+	return &cl.shards[h.Sum32()%conversationLockShards]
+}
+
+// Lock waits until no other turn holds conversationID or ctx is done. The
+// returned function unlocks it and must be called exactly once.
+func (cl *conversationLocks) Lock(ctx context.Context, conversationID string) (func(), error) {
+	shard := cl.shard(conversationID)
+
+	shard.mu.Lock()
+	lock := shard.locks[conversationID]
+	if lock == nil {
+		lock = &conversationLock{ch: make(chan struct{}, 1)}
+		shard.locks[conversationID] = lock
+	}
+	lock.refs++
+	shard.mu.Unlock()
+
+	done := func() {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(shard.locks, conversationID)
+		}
+	}
+
+	select {
+	case lock.ch <- struct{}{}:
+		return func() {
+			<-lock.ch
+			done()
+		}, nil
+	case <-ctx.Done():
+		done()
+		return nil, ctx.Err()
+	}
+}
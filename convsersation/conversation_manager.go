@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/JessonChan/longcat-web-api/config"
 	"github.com/JessonChan/longcat-web-api/types"
 )
 
@@ -17,24 +18,36 @@ type ConversationEntry struct {
 	LastOriginal   []types.Message // Store last assistant response for disambiguation
 	LastAccessed   time.Time
 	CreatedAt      time.Time
+	Metadata       map[string]string // Client-supplied metadata from the latest request
+	ResponseIDs    []string          // Response IDs issued for this conversation
+	TokensUsed     int               // Total tokens reported across all turns
+	Agent          string            // LongCat agent the conversation runs on, "" for the default
+	Owner          string            // Client identity allowed to continue the conversation by ID
 }
 
 // ConversationManager handles mapping with robust matching
 type ConversationManager struct {
-	mu            sync.RWMutex
-	conversations map[string]*ConversationEntry   // fingerprint -> entry
-	messageIndex  map[string][]*ConversationEntry // message content hash -> list of conversations containing it
-	maxAge        time.Duration
+	mu               sync.RWMutex
+	conversations    map[string]*ConversationEntry   // fingerprint -> entry
+	byConversationID map[string]*ConversationEntry   // conversation ID -> entry
+	messageIndex     map[string][]*ConversationEntry // message content hash -> list of conversations containing it
+	responses        map[string]string               // response ID -> conversation ID
+	maxAge           time.Duration
+	stop             chan struct{} // Closed by Stop to end the cleanup goroutine
+	stopOnce         sync.Once
 }
 
 func NewConversationManager() *ConversationManager {
 	cm := &ConversationManager{
-		conversations: make(map[string]*ConversationEntry),
-		messageIndex:  make(map[string][]*ConversationEntry),
-		maxAge:        24 * time.Hour, // Conversations expire after 24 hours
+		conversations:    make(map[string]*ConversationEntry),
+		byConversationID: make(map[string]*ConversationEntry),
+		messageIndex:     make(map[string][]*ConversationEntry),
+		responses:        make(map[string]string),
+		maxAge:           24 * time.Hour, // Conversations expire after 24 hours
+		stop:             make(chan struct{}),
 	}
 
-	// Start cleanup goroutine
+	// Start cleanup goroutine; Stop ends it
 	go cm.cleanupExpired()
 
 	return cm
@@ -43,6 +56,9 @@ func NewConversationManager() *ConversationManager {
 // hashMessage creates a hash for a single message
 func (cm *ConversationManager) hashMessage(msg types.Message) string {
 	content := fmt.Sprintf("%s:%s", msg.Role, msg.Content)
+	if msg.Name != "" {
+		content = fmt.Sprintf("%s(%s):%s", msg.Role, msg.Name, msg.Content)
+	}
 	hash := sha256.Sum256([]byte(content))
 	return fmt.Sprintf("%x", hash)
 }
@@ -64,8 +80,20 @@ func (cm *ConversationManager) GenerateFingerprint(messages []types.Message) str
 	return fmt.Sprintf("%x", finalHash)
 }
 
-// FindConversation implements len-2 prefix matching logic
-func (cm *ConversationManager) FindConversation(messages []types.Message) (string, bool) {
+// agentFingerprint namespaces a fingerprint by LongCat agent so matching
+// never crosses agents. The default agent keeps the plain fingerprint.
+func (cm *ConversationManager) agentFingerprint(agent string, messages []types.Message) string {
+	fingerprint := cm.GenerateFingerprint(messages)
+	if agent == "" {
+		return fingerprint
+	}
+	hash := sha256.Sum256([]byte(agent + "\x00" + fingerprint))
+	return fmt.Sprintf("%x", hash)
+}
+
+// FindConversation implements len-2 prefix matching logic among the
+// conversations of agent
+func (cm *ConversationManager) FindConversation(agent string, messages []types.Message) (string, bool) {
 	// only one message, no need to match
 	if len(messages) < 2 {
 		return "", false
@@ -77,7 +105,7 @@ func (cm *ConversationManager) FindConversation(messages []types.Message) (strin
 		return "", false
 	}
 
-	fingerprint := cm.GenerateFingerprint(messages)
+	fingerprint := cm.agentFingerprint(agent, messages)
 
 	// 1. Try exact match first
 	if entry, exists := cm.conversations[fingerprint]; exists {
@@ -91,7 +119,7 @@ func (cm *ConversationManager) FindConversation(messages []types.Message) (strin
 		newMessages := messages[len(messages)-2:]
 
 		// Find conversations with matching prefix
-		matchingConversations := cm.findConversationsWithPrefix(prefix)
+		matchingConversations := cm.findConversationsWithPrefix(agent, prefix)
 
 		if len(matchingConversations) == 1 {
 			// Single match, use it
@@ -110,12 +138,12 @@ func (cm *ConversationManager) FindConversation(messages []types.Message) (strin
 	return "", false
 }
 
-// findConversationsWithPrefix finds all conversations that have the exact prefix
-func (cm *ConversationManager) findConversationsWithPrefix(prefix []types.Message) []*ConversationEntry {
+// findConversationsWithPrefix finds all conversations of agent that have the exact prefix
+func (cm *ConversationManager) findConversationsWithPrefix(agent string, prefix []types.Message) []*ConversationEntry {
 	var matches []*ConversationEntry
 
 	for _, entry := range cm.conversations {
-		if cm.hasExactPrefix(entry.Messages, prefix) {
+		if entry.Agent == agent && cm.hasExactPrefix(entry.Messages, prefix) {
 			matches = append(matches, entry)
 		}
 	}
@@ -171,28 +199,76 @@ func (cm *ConversationManager) disambiguateByLastOriginal(conversations []*Conve
 
 // messagesEqual compares two messages
 func (cm *ConversationManager) messagesEqual(a, b types.Message) bool {
-	return a.Role == b.Role && a.Content == b.Content
+	return a.Role == b.Role && a.Name == b.Name && a.Content == b.Content
 }
 
-// SetConversation stores a new conversation
-func (cm *ConversationManager) SetConversation(messages []types.Message, conversationID string) {
+// SetConversation stores a new conversation on agent
+func (cm *ConversationManager) SetConversation(agent string, messages []types.Message, conversationID string) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	fingerprint := cm.GenerateFingerprint(messages)
+	fingerprint := cm.agentFingerprint(agent, messages)
 	entry := &ConversationEntry{
 		ConversationID: conversationID,
 		Messages:       messages,
 		LastAccessed:   time.Now(),
 		CreatedAt:      time.Now(),
+		Agent:          agent,
+	}
+
+	// Drop the ID mapping and index entries of any entry this fingerprint replaces
+	if previous, exists := cm.conversations[fingerprint]; exists {
+		if cm.byConversationID[previous.ConversationID] == previous {
+			delete(cm.byConversationID, previous.ConversationID)
+		}
+		cm.unindexEntry(previous)
 	}
 
 	cm.conversations[fingerprint] = entry
+	cm.byConversationID[conversationID] = entry
 
 	// Update message index for efficient lookup
+	cm.indexEntry(entry, messages)
+}
+
+// indexEntry adds entry to the index of each message, at most once per message
+func (cm *ConversationManager) indexEntry(entry *ConversationEntry, messages []types.Message) {
 	for _, msg := range messages {
 		msgHash := cm.hashMessage(msg)
-		cm.messageIndex[msgHash] = append(cm.messageIndex[msgHash], entry)
+		entries := cm.messageIndex[msgHash]
+		indexed := false
+		for _, e := range entries {
+			if e == entry {
+				indexed = true
+				break
+			}
+		}
+		if !indexed {
+			cm.messageIndex[msgHash] = append(entries, entry)
+		}
+	}
+}
+
+// unindexEntry removes entry from the message index. Entries are matched by
+// pointer so other conversations sharing a message or ID keep their lookups.
+func (cm *ConversationManager) unindexEntry(entry *ConversationEntry) {
+	for _, msg := range entry.Messages {
+		msgHash := cm.hashMessage(msg)
+		entries := cm.messageIndex[msgHash]
+
+		// Remove this entry from the list
+		var filtered []*ConversationEntry
+		for _, e := range entries {
+			if e != entry {
+				filtered = append(filtered, e)
+			}
+		}
+
+		if len(filtered) == 0 {
+			delete(cm.messageIndex, msgHash)
+		} else {
+			cm.messageIndex[msgHash] = filtered
+		}
 	}
 }
 
@@ -202,20 +278,18 @@ func (cm *ConversationManager) UpdateConversation(conversationID string, newMess
 	defer cm.mu.Unlock()
 
 	// Find the existing conversation
-	var existingEntry *ConversationEntry
-	for _, entry := range cm.conversations {
-		if entry.ConversationID == conversationID {
-			existingEntry = entry
-			break
-		}
-	}
-
+	existingEntry := cm.byConversationID[conversationID]
 	if existingEntry == nil {
 		return
 	}
 
 	// Only append messages that don't already exist in the conversation
-	uniqueMessages := cm.filterDuplicateMessages(existingEntry.Messages, newMessages)
+	var uniqueMessages []types.Message
+	if config.AppConfig.DuplicateMessages == "append" {
+		uniqueMessages = cm.trimOverlap(existingEntry.Messages, newMessages)
+	} else {
+		uniqueMessages = cm.filterDuplicateMessages(existingEntry.Messages, newMessages)
+	}
 	if len(uniqueMessages) == 0 {
 		// No new messages to add, just update access time
 		existingEntry.LastAccessed = time.Now()
@@ -226,20 +300,23 @@ func (cm *ConversationManager) UpdateConversation(conversationID string, newMess
 	extendedMessages := append(existingEntry.Messages, uniqueMessages...)
 
 	// Remove old fingerprint
-	oldFingerprint := cm.GenerateFingerprint(existingEntry.Messages)
+	oldFingerprint := cm.agentFingerprint(existingEntry.Agent, existingEntry.Messages)
 	delete(cm.conversations, oldFingerprint)
 
-	// Add with new fingerprint
-	newFingerprint := cm.GenerateFingerprint(extendedMessages)
+	// Add with new fingerprint, replacing any other entry that already has it
+	newFingerprint := cm.agentFingerprint(existingEntry.Agent, extendedMessages)
+	if other, exists := cm.conversations[newFingerprint]; exists && other != existingEntry {
+		if cm.byConversationID[other.ConversationID] == other {
+			delete(cm.byConversationID, other.ConversationID)
+		}
+		cm.unindexEntry(other)
+	}
 	existingEntry.Messages = extendedMessages
 	existingEntry.LastAccessed = time.Now()
 	cm.conversations[newFingerprint] = existingEntry
 
 	// Update message index
-	for _, msg := range uniqueMessages {
-		msgHash := cm.hashMessage(msg)
-		cm.messageIndex[msgHash] = append(cm.messageIndex[msgHash], existingEntry)
-	}
+	cm.indexEntry(existingEntry, uniqueMessages)
 }
 
 // filterDuplicateMessages returns only messages that don't already exist in the conversation
@@ -262,12 +339,60 @@ func (cm *ConversationManager) filterDuplicateMessages(existing, new []types.Mes
 	return unique
 }
 
+// trimOverlap drops the leading messages of new that repeat the end of
+// existing and returns the rest. Unlike filterDuplicateMessages, a message
+// that matches an earlier turn, such as a second "yes", is kept as a new turn.
+func (cm *ConversationManager) trimOverlap(existing, new []types.Message) []types.Message {
+	for overlap := min(len(existing), len(new)); overlap > 0; overlap-- {
+		tail := existing[len(existing)-overlap:]
+		matched := true
+		for i := range tail {
+			if !cm.messagesEqual(tail[i], new[i]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return new[overlap:]
+		}
+	}
+	return new
+}
+
+// Clear removes every conversation, index entry and response link at once
+// and returns how many conversations were dropped. Requests never see a
+// partly cleared store, since they share the manager's lock.
+func (cm *ConversationManager) Clear() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cleared := len(cm.byConversationID)
+	cm.conversations = make(map[string]*ConversationEntry)
+	cm.byConversationID = make(map[string]*ConversationEntry)
+	cm.messageIndex = make(map[string][]*ConversationEntry)
+	cm.responses = make(map[string]string)
+	return cleared
+}
+
+// Stop ends the background cleanup of expired conversations. The manager
+// keeps working afterwards, but entries no longer expire. It is safe to call
+// more than once.
+func (cm *ConversationManager) Stop() {
+	cm.stopOnce.Do(func() { close(cm.stop) })
+}
+
 // cleanupExpired removes old conversations
 func (cm *ConversationManager) cleanupExpired() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-cm.stop:
+			return
+		}
+
 		cm.mu.Lock()
 		now := time.Now()
 
@@ -283,26 +408,15 @@ func (cm *ConversationManager) cleanupExpired() {
 		for _, fingerprint := range toDelete {
 			entry := cm.conversations[fingerprint]
 			delete(cm.conversations, fingerprint)
+			if cm.byConversationID[entry.ConversationID] == entry {
+				delete(cm.byConversationID, entry.ConversationID)
+			}
+			for _, responseID := range entry.ResponseIDs {
+				delete(cm.responses, responseID)
+			}
 
 			// Clean up message index
-			for _, msg := range entry.Messages {
-				msgHash := cm.hashMessage(msg)
-				entries := cm.messageIndex[msgHash]
-
-				// Remove this entry from the list
-				var filtered []*ConversationEntry
-				for _, e := range entries {
-					if e.ConversationID != entry.ConversationID {
-						filtered = append(filtered, e)
-					}
-				}
-
-				if len(filtered) == 0 {
-					delete(cm.messageIndex, msgHash)
-				} else {
-					cm.messageIndex[msgHash] = filtered
-				}
-			}
+			cm.unindexEntry(entry)
 		}
 
 		cm.mu.Unlock()
@@ -315,14 +429,7 @@ func (cm *ConversationManager) UpdateLastOriginal(conversationID string, assista
 	defer cm.mu.Unlock()
 
 	// Find the existing conversation
-	var existingEntry *ConversationEntry
-	for _, entry := range cm.conversations {
-		if entry.ConversationID == conversationID {
-			existingEntry = entry
-			break
-		}
-	}
-
+	existingEntry := cm.byConversationID[conversationID]
 	if existingEntry == nil {
 		return
 	}
@@ -332,13 +439,122 @@ func (cm *ConversationManager) UpdateLastOriginal(conversationID string, assista
 	existingEntry.LastAccessed = time.Now()
 }
 
+// AddTokenUsage adds the tokens spent on one turn to a conversation's total
+func (cm *ConversationManager) AddTokenUsage(conversationID string, tokens int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if entry := cm.byConversationID[conversationID]; entry != nil {
+		entry.TokensUsed += tokens
+	}
+}
+
+// ReplaceConversationID moves a conversation onto a new LongCat session ID
+func (cm *ConversationManager) ReplaceConversationID(oldID, newID string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	entry := cm.byConversationID[oldID]
+	if entry == nil {
+		return
+	}
+	delete(cm.byConversationID, oldID)
+	entry.ConversationID = newID
+	cm.byConversationID[newID] = entry
+	for _, responseID := range entry.ResponseIDs {
+		cm.responses[responseID] = newID
+	}
+}
+
+// SetMetadata records client-supplied metadata for a conversation
+func (cm *ConversationManager) SetMetadata(conversationID string, metadata map[string]string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if entry := cm.byConversationID[conversationID]; entry != nil {
+		entry.Metadata = metadata
+	}
+}
+
+// SetOwner records which client may continue a conversation by its ID
+func (cm *ConversationManager) SetOwner(conversationID, owner string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if entry := cm.byConversationID[conversationID]; entry != nil {
+		entry.Owner = owner
+	}
+}
+
+// RememberResponse records which conversation produced a response so a later
+// request can continue it through previous_response_id
+func (cm *ConversationManager) RememberResponse(responseID, conversationID string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	entry := cm.byConversationID[conversationID]
+	if entry == nil {
+		return
+	}
+	cm.responses[responseID] = conversationID
+	entry.ResponseIDs = append(entry.ResponseIDs, responseID)
+}
+
+// ConversationForResponse returns the conversation that produced a response
+func (cm *ConversationManager) ConversationForResponse(responseID string) (string, bool) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	conversationID, exists := cm.responses[responseID]
+	return conversationID, exists
+}
+
+// GetConversation returns a snapshot of the entry for a conversation ID
+func (cm *ConversationManager) GetConversation(conversationID string) (ConversationEntry, bool) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	entry, exists := cm.byConversationID[conversationID]
+	if !exists {
+		return ConversationEntry{}, false
+	}
+
+	snapshot := *entry
+	snapshot.Messages = append([]types.Message(nil), entry.Messages...)
+	snapshot.LastOriginal = append([]types.Message(nil), entry.LastOriginal...)
+	snapshot.ResponseIDs = append([]string(nil), entry.ResponseIDs...)
+	return snapshot, true
+}
+
+// ReconstructHistory fills in assistant turns the client left out, using the
+// responses recorded for earlier requests with the same history on agent
+func (cm *ConversationManager) ReconstructHistory(agent string, messages []types.Message) []types.Message {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	var history []types.Message
+	for i, msg := range messages {
+		history = append(history, msg)
+
+		// Consecutive user messages mean the assistant reply in between is missing
+		if msg.Role != "user" || i+1 >= len(messages) || messages[i+1].Role != "user" {
+			continue
+		}
+		if entry, exists := cm.conversations[cm.agentFingerprint(agent, history)]; exists && len(entry.LastOriginal) > 0 {
+			history = append(history, entry.LastOriginal...)
+		}
+	}
+
+	return history
+}
+
 // GetStats returns statistics about the conversation manager
 func (cm *ConversationManager) GetStats() map[string]interface{} {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 
 	return map[string]interface{}{
-		"total_conversations": len(cm.conversations),
+		"total_conversations": len(cm.byConversationID),
 		"indexed_messages":    len(cm.messageIndex),
 		"max_age_hours":       cm.maxAge.Hours(),
 	}
@@ -0,0 +1,194 @@
+package conversation
+
+import (
+	"testing"
+
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/types"
+)
+
+func user(content string) types.Message { return types.Message{Role: "user", Content: content} }
+func assistant(content string) types.Message {
+	return types.Message{Role: "assistant", Content: content}
+}
+
+func newTestManager(t *testing.T) *ConversationManager {
+	t.Helper()
+	cm := NewConversationManager()
+	t.Cleanup(cm.Stop)
+	return cm
+}
+
+func TestMessageIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(cm *ConversationManager)
+		want  map[string][]string // message content -> IDs of the conversations indexed under it
+	}{
+		{
+			"repeated message indexed once",
+			func(cm *ConversationManager) {
+				cm.SetConversation("", []types.Message{user("yes"), assistant("ok"), user("yes")}, "c1")
+			},
+			map[string][]string{"yes": {"c1"}, "ok": {"c1"}},
+		},
+		{
+			"shared message lists both conversations",
+			func(cm *ConversationManager) {
+				cm.SetConversation("", []types.Message{user("hi"), assistant("a")}, "c1")
+				cm.SetConversation("", []types.Message{user("hi"), assistant("b")}, "c2")
+			},
+			map[string][]string{"hi": {"c1", "c2"}, "a": {"c1"}, "b": {"c2"}},
+		},
+		{
+			"replaced fingerprint is unindexed",
+			func(cm *ConversationManager) {
+				cm.SetConversation("", []types.Message{user("hi")}, "c1")
+				cm.SetConversation("", []types.Message{user("hi")}, "c2")
+			},
+			map[string][]string{"hi": {"c2"}},
+		},
+		{
+			"update indexes the new turns",
+			func(cm *ConversationManager) {
+				cm.SetConversation("", []types.Message{user("hi")}, "c1")
+				cm.UpdateConversation("c1", []types.Message{user("hi"), assistant("hello"), user("bye")})
+			},
+			map[string][]string{"hi": {"c1"}, "hello": {"c1"}, "bye": {"c1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestManager(t)
+			tt.setup(cm)
+
+			if len(cm.messageIndex) != len(tt.want) {
+				t.Fatalf("index holds %d messages, want %d", len(cm.messageIndex), len(tt.want))
+			}
+			for _, entries := range cm.messageIndex {
+				if len(entries) == 0 {
+					t.Fatal("index holds a message with no conversations")
+				}
+			}
+			for content, wantIDs := range tt.want {
+				var ids []string
+				for _, role := range []string{"user", "assistant"} {
+					for _, entry := range cm.messageIndex[cm.hashMessage(types.Message{Role: role, Content: content})] {
+						ids = append(ids, entry.ConversationID)
+					}
+				}
+				if len(ids) != len(wantIDs) {
+					t.Fatalf("%q indexed under %v, want %v", content, ids, wantIDs)
+				}
+				for i := range ids {
+					if ids[i] != wantIDs[i] {
+						t.Fatalf("%q indexed under %v, want %v", content, ids, wantIDs)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateConversationDuplicates(t *testing.T) {
+	history := []types.Message{user("ready?"), assistant("yes"), user("go on")}
+	tests := []struct {
+		name       string
+		duplicates string
+		messages   []types.Message
+		want       []string
+	}{
+		{"filter drops a repeated turn", "filter", []types.Message{assistant("yes"), user("go on"), assistant("done"), user("go on")}, []string{"ready?", "yes", "go on", "done"}},
+		{"append keeps a repeated turn", "append", []types.Message{assistant("yes"), user("go on"), assistant("done"), user("go on")}, []string{"ready?", "yes", "go on", "done", "go on"}},
+		{"append with full resend", "append", append(append([]types.Message{}, history...), assistant("yes")), []string{"ready?", "yes", "go on", "yes"}},
+		{"nothing new", "append", []types.Message{user("go on")}, []string{"ready?", "yes", "go on"}},
+	}
+	saved := config.AppConfig.DuplicateMessages
+	defer func() { config.AppConfig.DuplicateMessages = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.DuplicateMessages = tt.duplicates
+			cm := newTestManager(t)
+			cm.SetConversation("", append([]types.Message{}, history...), "c1")
+			cm.UpdateConversation("c1", tt.messages)
+
+			entry, ok := cm.GetConversation("c1")
+			if !ok {
+				t.Fatal("conversation c1 is gone")
+			}
+			var got []string
+			for _, msg := range entry.Messages {
+				got = append(got, msg.Content)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("messages = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("messages = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTrimOverlap(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []types.Message
+		new      []types.Message
+		want     int // Messages of new that are kept
+	}{
+		{"no overlap", []types.Message{user("a")}, []types.Message{user("b")}, 1},
+		{"empty existing", nil, []types.Message{user("a")}, 1},
+		{"empty new", []types.Message{user("a")}, nil, 0},
+		{"last message repeated", []types.Message{user("a"), assistant("b")}, []types.Message{assistant("b"), user("c")}, 1},
+		{"longest overlap wins", []types.Message{user("a"), user("a")}, []types.Message{user("a"), user("a"), user("b")}, 1},
+		{"earlier match is a new turn", []types.Message{user("yes"), assistant("ok")}, []types.Message{user("yes")}, 1},
+		{"role must match", []types.Message{user("a")}, []types.Message{assistant("a")}, 1},
+		{"fully repeated", []types.Message{user("a"), assistant("b")}, []types.Message{user("a"), assistant("b")}, 0},
+	}
+	cm := &ConversationManager{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cm.trimOverlap(tt.existing, tt.new)
+			if len(got) != tt.want {
+				t.Fatalf("trimOverlap() = %v, want the last %d of %v", got, tt.want, tt.new)
+			}
+			if tt.want > 0 && &got[0] != &tt.new[len(tt.new)-tt.want] {
+				t.Fatalf("trimOverlap() = %v, want a suffix of %v", got, tt.new)
+			}
+		})
+	}
+}
+
+func TestClear(t *testing.T) {
+	cm := newTestManager(t)
+	first := []types.Message{user("hi"), assistant("hello"), user("bye")}
+	cm.SetConversation("", first, "c1")
+	cm.SetConversation("agent", []types.Message{user("hi")}, "c2")
+	cm.RememberResponse("resp-1", "c1")
+
+	if cleared := cm.Clear(); cleared != 2 {
+		t.Fatalf("Clear() = %d, want 2", cleared)
+	}
+	if len(cm.conversations) != 0 || len(cm.byConversationID) != 0 || len(cm.messageIndex) != 0 || len(cm.responses) != 0 {
+		t.Fatalf("Clear() left %d fingerprints, %d IDs, %d index entries and %d responses",
+			len(cm.conversations), len(cm.byConversationID), len(cm.messageIndex), len(cm.responses))
+	}
+	if _, ok := cm.FindConversation("", first); ok {
+		t.Fatal("FindConversation() matched a cleared conversation")
+	}
+	if _, ok := cm.ConversationForResponse("resp-1"); ok {
+		t.Fatal("ConversationForResponse() found a cleared response")
+	}
+	if cleared := cm.Clear(); cleared != 0 {
+		t.Fatalf("second Clear() = %d, want 0", cleared)
+	}
+
+	// The manager keeps working after a clear
+	cm.SetConversation("", first, "c3")
+	if id, ok := cm.FindConversation("", first); !ok || id != "c3" {
+		t.Fatalf("FindConversation() = %q, %v after Clear, want c3", id, ok)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
+)
+
+// CookieStatusResponse is returned by GET /admin/cookie-status
+type CookieStatusResponse struct {
+	Valid     bool      `json:"valid"`
+	CheckedAt time.Time `json:"checked_at"`
+	Detail    string    `json:"detail"`
+}
+
+// cookieStatus caches the result of the last cookie probe so monitoring
+// does not create a LongCat session on every poll
+type cookieStatus struct {
+	mu   sync.Mutex
+	last *CookieStatusResponse
+}
+
+// handleCookieStatus serves GET /admin/cookie-status. Like the other debug
+// endpoints it is only enabled when DEBUG_API_KEY is configured.
+func (h *UnifiedHandler) handleCookieStatus(w http.ResponseWriter, r *http.Request) {
+	if config.AppConfig.DebugAPIKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isDebugAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Holding the lock through the probe makes concurrent polls share one check
+	h.cookieStatus.mu.Lock()
+	defer h.cookieStatus.mu.Unlock()
+
+	maxAge := time.Duration(config.AppConfig.CookieStatusSecs) * time.Second
+	if last := h.cookieStatus.last; last == nil || time.Since(last.CheckedAt) >= maxAge {
+		// Creating a session is the cheapest request that requires valid cookies
+		status := &CookieStatusResponse{Valid: true, CheckedAt: time.Now(), Detail: "session created"}
+		if id, err := h.longCatClient.CreateSession(r.Context()); err != nil {
+			logging.LogInfo("Cookie check failed: %v", err)
+			status.Valid = false
+			status.Detail = err.Error()
+		} else {
+			h.longCatClient.RecycleSession(id)
+		}
+		h.cookieStatus.last = status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.cookieStatus.last)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+// daemonChildEnv marks the detached child so it doesn't daemonize again
+const daemonChildEnv = "LONGCAT_DAEMON_CHILD"
+
+// isDaemonChild reports whether this process was started by daemonize
+func isDaemonChild() bool {
+	return os.Getenv(daemonChildEnv) == "1"
+}
+
+// daemonize re-executes the binary detached from the terminal. The child
+// can't prompt for cookies, so the resolved cookies are passed in its environment.
+func daemonize() (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", os.DevNull, err)
+	}
+	defer devNull.Close()
+
+	cookies := config.CurrentCookies()
+	env := append(os.Environ(),
+		daemonChildEnv+"=1",
+		"COOKIE_LXSDK_CUID="+cookies.LxsdkCuid,
+		"COOKIE_PASSPORT_TOKEN="+cookies.PassportToken,
+		"COOKIE_LXSDK_S="+cookies.LxsdkS,
+	)
+
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{devNull, devNull, devNull},
+		Sys:   detachedProcAttr(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to start background process: %w", err)
+	}
+
+	pid := process.Pid
+	process.Release()
+	return pid, nil
+}
+
+// writePIDFile records the current process ID, refusing to clobber a running instance
+func writePIDFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && processExists(pid) {
+			return fmt.Errorf("PID file %s points to running process %d", path, pid)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		return fmt.Errorf("failed to write PID file: %w", err)
+	}
+	return nil
+}
+
+// removePIDFile deletes the PID file if it still belongs to this process
+func removePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(path)
+	}
+}
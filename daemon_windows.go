@@ -0,0 +1,27 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const createNewProcessGroup = 0x00000200
+const detachedProcess = 0x00000008
+
+// detachedProcAttr starts the child without a console
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: createNewProcessGroup | detachedProcess}
+}
+
+// processExists reports whether a process with the given PID is alive
+func processExists(pid int) bool {
+	// FindProcess opens a handle on Windows and fails for unknown PIDs
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
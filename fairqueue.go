@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+// fairQueue limits concurrent upstream requests and, when all slots are busy,
+// admits waiting requests round-robin across API keys so one tenant cannot
+// starve the others
+type fairQueue struct {
+	mu      sync.Mutex
+	slots   int
+	active  int
+	waiting map[string][]chan struct{} // key -> waiters in arrival order
+	order   []string                   // keys with waiters, in round-robin order
+}
+
+func newFairQueue(slots int) *fairQueue {
+	return &fairQueue{
+		slots:   slots,
+		waiting: make(map[string][]chan struct{}),
+	}
+}
+
+// Acquire blocks until a slot is available for key or ctx is done. The
+// returned function releases the slot and must be called exactly once.
+func (q *fairQueue) Acquire(ctx context.Context, key string) (func(), error) {
+	if q == nil || q.slots <= 0 {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	if q.active < q.slots && len(q.order) == 0 {
+		q.active++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+
+	ready := make(chan struct{})
+	if len(q.waiting[key]) == 0 {
+		q.order = append(q.order, key)
+	}
+	q.waiting[key] = append(q.waiting[key], ready)
+	q.mu.Unlock()
+
+	select {
+	case <-ready:
+		return q.release, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		removed := q.removeWaiter(key, ready)
+		q.mu.Unlock()
+		if !removed {
+			// The slot was handed over while we were giving up
+			q.release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release hands the slot to the next waiting key, or frees it
+func (q *fairQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.order) == 0 {
+		q.active--
+		return
+	}
+
+	key := q.order[0]
+	q.order = q.order[1:]
+	waiters := q.waiting[key]
+	next := waiters[0]
+	if len(waiters) > 1 {
+		q.waiting[key] = waiters[1:]
+		q.order = append(q.order, key)
+	} else {
+		delete(q.waiting, key)
+	}
+	close(next)
+}
+
+// removeWaiter drops a waiter that gave up; it reports false if the waiter
+// had already been admitted
+func (q *fairQueue) removeWaiter(key string, ready chan struct{}) bool {
+	waiters := q.waiting[key]
+	for i, waiter := range waiters {
+		if waiter != ready {
+			continue
+		}
+		waiters = append(waiters[:i], waiters[i+1:]...)
+		if len(waiters) > 0 {
+			q.waiting[key] = waiters
+			return true
+		}
+		delete(q.waiting, key)
+		for j, k := range q.order {
+			if k == key {
+				q.order = append(q.order[:j], q.order[j+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Depths returns the number of waiting requests per key
+func (q *fairQueue) Depths() map[string]int {
+	depths := make(map[string]int)
+	if q == nil {
+		return depths
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key, waiters := range q.waiting {
+		depths[key] = len(waiters)
+	}
+	return depths
+}
+
+// Active returns the number of requests currently holding a slot
+func (q *fairQueue) Active() int {
+	if q == nil {
+		return 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active
+}
+
+// anonymousClient is the queueKey of every request without a key listed
+// in API_KEYS
+const anonymousClient = "anonymous"
+
+// queueKey identifies the tenant of a request by a digest of its API key, so
+// raw keys never show up in queue stats. Only keys listed in API_KEYS are
+// trusted; any other key could be made up to pass as another tenant or as
+// many, so those requests all share anonymousClient.
+func queueKey(r *http.Request) string {
+	key := requestAPIKey(r)
+	if !allowedAPIKey(key) {
+		return anonymousClient
+	}
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("key-%x", sum[:4])
+}
+
+// allowedAPIKey reports whether key is listed in API_KEYS
+func allowedAPIKey(key string) bool {
+	allowed := false
+	for _, listed := range config.AppConfig.APIKeys {
+		if key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(listed)) == 1 {
+			allowed = true
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+// waitFor polls until cond holds, since queue waiters enqueue on their own goroutines
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		arrival []string // Keys queued behind a busy slot, in arrival order
+		want    []string // Order they are admitted
+	}{
+		{"single key keeps arrival order", []string{"a", "a", "a"}, []string{"a", "a", "a"}},
+		{"keys alternate", []string{"a", "a", "a", "b", "b"}, []string{"a", "b", "a", "b", "a"}},
+		{"late key joins the rotation", []string{"a", "a", "b", "c"}, []string{"a", "b", "c", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newFairQueue(1)
+			release, err := q.Acquire(context.Background(), "holder")
+			if err != nil {
+				t.Fatalf("Acquire() error = %v", err)
+			}
+
+			admitted := make(chan string)
+			releases := make(chan func())
+			for i, key := range tt.arrival {
+				go func() {
+					release, err := q.Acquire(context.Background(), key)
+					if err != nil {
+						t.Errorf("Acquire(%s) error = %v", key, err)
+						return
+					}
+					admitted <- key
+					releases <- release
+				}()
+				waitFor(t, "waiter to queue", func() bool {
+					waiting := 0
+					for _, depth := range q.Depths() {
+						waiting += depth
+					}
+					return waiting == i+1
+				})
+			}
+
+			// Each admitted request releases its slot to the next in turn
+			release()
+			for i, want := range tt.want {
+				if got := <-admitted; got != want {
+					t.Fatalf("admission %d went to %s, want %s", i, got, want)
+				}
+				(<-releases)()
+			}
+			if active := q.Active(); active != 0 {
+				t.Fatalf("Active() = %d after every release, want 0", active)
+			}
+		})
+	}
+}
+
+func TestFairQueueCancel(t *testing.T) {
+	q := newFairQueue(1)
+	release, _ := q.Acquire(context.Background(), "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := q.Acquire(ctx, "b")
+		done <- err
+	}()
+	waitFor(t, "waiter to queue", func() bool { return q.Depths()["b"] == 1 })
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled Acquire() error = %v, want context.Canceled", err)
+	}
+	if depths := q.Depths(); len(depths) != 0 {
+		t.Fatalf("Depths() = %v after cancel, want none", depths)
+	}
+
+	release()
+	if active := q.Active(); active != 0 {
+		t.Fatalf("Active() = %d after release, want 0", active)
+	}
+	if _, err := q.Acquire(context.Background(), "c"); err != nil {
+		t.Fatalf("Acquire() after cancel error = %v", err)
+	}
+}
+
+func TestFairQueueUnlimited(t *testing.T) {
+	for _, q := range []*fairQueue{nil, newFairQueue(0)} {
+		for i := 0; i < 3; i++ {
+			release, err := q.Acquire(context.Background(), "a")
+			if err != nil {
+				t.Fatalf("Acquire() on an unlimited queue error = %v", err)
+			}
+			defer release()
+		}
+		if active := q.Active(); active != 0 {
+			t.Fatalf("Active() = %d on an unlimited queue, want 0", active)
+		}
+	}
+}
+
+func TestQueueKey(t *testing.T) {
+	withKey := func(header, value string) *http.Request {
+		r, _ := http.NewRequest(http.MethodPost, "/v1/messages", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		return r
+	}
+	saved := config.AppConfig.APIKeys
+	defer func() { config.AppConfig.APIKeys = saved }()
+	config.AppConfig.APIKeys = nil
+	if got := queueKey(withKey("x-api-key", "sk-1")); got != anonymousClient {
+		t.Fatalf("queueKey() without API_KEYS = %q, want %s", got, anonymousClient)
+	}
+
+	config.AppConfig.APIKeys = []string{"sk-1", "sk-2"}
+	bearer, xAPIKey := queueKey(withKey("Authorization", "Bearer sk-1")), queueKey(withKey("x-api-key", "sk-1"))
+	if got := queueKey(withKey("", "")); got != anonymousClient {
+		t.Fatalf("queueKey() without a key = %q, want %s", got, anonymousClient)
+	}
+	if got := queueKey(withKey("x-api-key", "sk-3")); got != anonymousClient {
+		t.Fatalf("queueKey() for an unlisted key = %q, want %s", got, anonymousClient)
+	}
+	if bearer != xAPIKey {
+		t.Fatalf("queueKey() = %q for a bearer token and %q for x-api-key, want the same", bearer, xAPIKey)
+	}
+	if other := queueKey(withKey("x-api-key", "sk-2")); other == bearer {
+		t.Fatalf("queueKey() = %q for two different keys", other)
+	}
+	if len(bearer) != len("key-")+8 {
+		t.Fatalf("queueKey() = %q, want key- and 8 hex digits", bearer)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errTurnSuperseded cancels a turn when a newer one arrives for its conversation
+var errTurnSuperseded = errors.New("superseded by a newer turn on the same conversation")
+
+// inflightTurns tracks the running turn of each conversation so a new turn,
+// such as a resend after "stop generation", can cancel the one before it
+type inflightTurns struct {
+	mu    sync.Mutex
+	turns map[string]*inflightTurn
+}
+
+type inflightTurn struct {
+	cancel context.CancelCauseFunc
+}
+
+func newInflightTurns() *inflightTurns {
+	return &inflightTurns{turns: make(map[string]*inflightTurn)}
+}
+
+// begin cancels any turn still running on conversationID and records cancel
+// as the current one. The returned function must be called when the turn ends.
+func (t *inflightTurns) begin(conversationID string, cancel context.CancelCauseFunc) func() {
+	turn := &inflightTurn{cancel: cancel}
+
+	t.mu.Lock()
+	if previous := t.turns[conversationID]; previous != nil {
+		previous.cancel(errTurnSuperseded)
+	}
+	t.turns[conversationID] = turn
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.turns[conversationID] == turn {
+			delete(t.turns, conversationID)
+		}
+	}
+}
+
+// superseded reports whether ctx was cancelled by a newer turn
+func superseded(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errTurnSuperseded)
+}
+
+// detachFromClient returns a context that outlives the client connection but
+// is still cancelled when the turn is superseded or aborted
+func detachFromClient(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		if superseded(ctx) || aborted(ctx) {
+			cancel(context.Cause(ctx))
+		}
+	})
+	return detached, func() {
+		stop()
+		cancel(nil)
+	}
+}
@@ -1,13 +1,20 @@
 package logging
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
 	"os"
 )
 
 // VerboseMode controls logging output - will be set by main package
 var VerboseMode bool
 
+// sampleRate is the fraction of requests whose bodies LogBody prints
+var sampleRate = 1.0
+
+type sampledKey struct{}
+
 // LogDebug prints debug messages only in verbose mode
 func LogDebug(format string, args ...interface{}) {
 	if VerboseMode {
@@ -22,6 +29,30 @@ func LogInfo(format string, args ...interface{}) {
 	}
 }
 
+// LogBody prints request and response bodies in verbose mode, but only for
+// the requests picked by the sample rate
+func LogBody(ctx context.Context, format string, args ...interface{}) {
+	if sampled, ok := ctx.Value(sampledKey{}).(bool); ok && !sampled {
+		return
+	}
+	LogDebug(format, args...)
+}
+
+// WithRequestID returns a context carrying whether the request's bodies are
+// logged. The choice hashes the request ID, so it is the same for every log
+// line of a request.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	h := fnv.New64a()
+	h.Write([]byte(requestID))
+	sampled := float64(h.Sum64()%10000) < sampleRate*10000
+	return context.WithValue(ctx, sampledKey{}, sampled)
+}
+
+// SetSampleRate sets the fraction of requests whose bodies are logged
+func SetSampleRate(rate float64) {
+	sampleRate = rate
+}
+
 // LogError prints error messages (always shown)
 func LogError(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, "[ERROR] "+format+"\n", args...)
@@ -1,14 +1,24 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/JessonChan/longcat-web-api/api"
 	"github.com/JessonChan/longcat-web-api/config"
@@ -47,72 +57,123 @@ type UnifiedHandler struct {
 	openAIService       api.APIService
 	claudeService       api.APIService
 	conversationManager *conversation.ConversationManager
+	queue               *fairQueue
+	streams             *streamBuffers
+	turnLocks           *conversationLocks
+	inflight            *inflightTurns
+	aborts              *abortableStreams
+	policy              *contentPolicy
+	transform           *promptTransform
+	cache               *responseCache
+	mirror              *requestMirror
+	keyStreams          *keyStreams
+	cookieStatus        cookieStatus
+	stats               *gatewayStats
 	verbose             bool
+	handler             http.Handler // Everything, starting with CORS preflight
+	api                 http.Handler // The API endpoints behind their request checks
 }
 
 func NewUnifiedHandler(verbose bool) *UnifiedHandler {
 	longCatClient := api.NewLongCatClient()
-	return &UnifiedHandler{
+	h := &UnifiedHandler{
 		longCatClient:       longCatClient,
 		openAIService:       api.NewOpenAIService(longCatClient),
 		claudeService:       api.NewClaudeService(longCatClient),
 		conversationManager: conversation.NewConversationManager(),
+		queue:               newFairQueue(config.AppConfig.MaxConcurrent),
+		streams:             newStreamBuffers(),
+		turnLocks:           newConversationLocks(),
+		inflight:            newInflightTurns(),
+		aborts:              newAbortableStreams(),
+		policy:              newContentPolicy(),
+		transform:           newPromptTransform(),
+		cache:               newResponseCache(),
+		mirror:              newRequestMirror(),
+		keyStreams:          newKeyStreams(),
+		stats:               newGatewayStats(),
 		verbose:             verbose,
 	}
+	h.handler = chain(http.HandlerFunc(h.route), corsPreflight)
+	h.api = chain(http.HandlerFunc(h.serveAPI),
+		headProbe, requirePost, requireAPIKey, requireJSON, traceContext, upstreamOverride,
+		h.readRequest, h.selectModel, checkOptions, h.screenPrompt, h.limitStreams, h.mirrorRequests,
+		h.continueThread, h.serveFromCache, h.lockConversation, h.waitForSlot)
+	return h
 }
 
 func (h *UnifiedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r)
+}
 
-	// Handle CORS preflight requests
-	if r.Method == http.MethodOptions {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key, anthropic-version")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-		w.WriteHeader(http.StatusOK)
+// route dispatches the debug and admin endpoints and sends API requests
+// through their middleware chain
+func (h *UnifiedHandler) route(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/v1/conversations/") {
+		h.handleConversationMessages(w, r)
 		return
 	}
 
-	if r.URL.Path != "/v1/chat/completions" && r.URL.Path != "/v1/messages" {
-		logging.LogDebug("%s not found", r.URL.Path)
-		http.NotFound(w, r)
+	if strings.HasPrefix(r.URL.Path, "/v1/streams/") {
+		h.handleStreamResume(w, r)
 		return
 	}
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	for _, endpoint := range []string{"/v1/chat/completions", "/v1/messages"} {
+		if strings.HasPrefix(r.URL.Path, endpoint+"/") {
+			h.handleAbortStream(w, r, endpoint)
+			return
+		}
+	}
+
+	if r.URL.Path == "/admin/stats" {
+		h.handleStats(w, r)
 		return
 	}
 
-	bs, errBs := io.ReadAll(r.Body)
-	if errBs != nil {
-		http.Error(w, fmt.Sprintf("Invalid request: %v", errBs), http.StatusBadRequest)
+	if r.URL.Path == "/admin/conversations/clear" {
+		h.handleClearConversations(w, r)
 		return
 	}
-	r.Body = io.NopCloser(bytes.NewReader(bs))
-	logging.LogDebug("Request Body: %s %s", string(bs), r.URL.Path)
 
-	// Select appropriate service based on endpoint
-	var service api.APIService
-	switch r.URL.Path {
-	case "/v1/chat/completions":
-		service = h.openAIService
-	case "/v1/messages":
-		service = h.claudeService
+	if r.URL.Path == "/admin/cookie-status" {
+		h.handleCookieStatus(w, r)
+		return
 	}
 
-	// Determine conversation ID based on message history
-	var conversationID string
+	if r.URL.Path == "/admin/queue" {
+		h.handleQueueStats(w, r)
+		return
+	}
 
-	// Extract messages from request to generate fingerprint
-	messages, err := extractMessagesFromRequest(bs, r.URL.Path)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to parse messages: %v", err), http.StatusBadRequest)
+	if r.URL.Path != "/v1/chat/completions" && r.URL.Path != "/v1/messages" {
+		logging.LogDebug("%s not found", r.URL.Path)
+		http.NotFound(w, r)
 		return
 	}
-	// Check if we have an existing conversation for this message history
-	if existingConvID, exists := h.conversationManager.FindConversation(messages); exists {
-		conversationID = existingConvID
+
+	h.api.ServeHTTP(w, r)
+}
+
+// serveAPI records the turn and answers an OpenAI or Claude API request
+// that has passed every stage of the API chain
+func (h *UnifiedHandler) serveAPI(w http.ResponseWriter, r *http.Request) {
+	call := apiCallFrom(r.Context())
+	conversationID, messages := call.conversationID, call.messages
+	switch {
+	case call.newSession:
+		h.conversationManager.SetConversation(call.agent, messages, conversationID)
+		h.conversationManager.SetOwner(conversationID, queueKey(r))
+		if statelessTurns() {
+			logging.LogInfo("Created stateless conversation: %s", conversationID)
+		} else {
+			logging.LogInfo("Created new conversation: %s", conversationID)
+		}
+	case call.threadID != "":
+		h.conversationManager.UpdateConversation(conversationID, messages)
+		logging.LogInfo("Continuing explicit thread: %s", conversationID)
+	default:
+		// Reuse the existing conversation for this message history
 		logging.LogInfo("Using existing conversation: %s", conversationID)
 
 		// Update conversation with new messages (len-2 portion)
@@ -121,106 +182,645 @@ func (h *UnifiedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			h.conversationManager.UpdateConversation(conversationID, newMessages)
 			logging.LogInfo("Updated conversation with new messages")
 		}
-	} else {
-		// Create new conversation session
-		newConvID, err := h.longCatClient.CreateSession(r.Context())
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to create session: %v", err), http.StatusInternalServerError)
-			return
-		}
-		conversationID = newConvID
-		h.conversationManager.SetConversation(messages, conversationID)
-		logging.LogInfo("Created new conversation: %s", conversationID)
 	}
+	if metadata := extractMetadata(call.req); len(metadata) > 0 {
+		h.conversationManager.SetMetadata(conversationID, metadata)
+	}
+
+	// The response ID can be sent back as previous_response_id to continue this thread
+	h.conversationManager.RememberResponse(call.responseID, conversationID)
+	r = r.WithContext(api.WithResponseID(r.Context(), call.responseID))
+	w.Header().Set("X-Conversation-ID", conversationID)
+
 	// Create LongCat request from extracted messages
-	longCatReq, err := createLongCatRequest(messages, conversationID)
+	system := ""
+	if call.newSession {
+		system = extractSystemPrompt(call.req)
+	}
+	longCatReq, err := createLongCatRequest(messages, system, conversationID, call.newSession, call.maxTokens)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create LongCat request: %v", err), http.StatusBadRequest)
 		return
 	}
+	longCatReq.ReasonEnabled = call.reasonEnabled
+	longCatReq.SearchEnabled = call.searchEnabled
+	if call.schema != nil {
+		withInstruction(&longCatReq, call.schema.Instruction())
+	}
 
-	// Determine if streaming is requested
-	streaming := h.isStreamingRequest(bs, r.URL.Path)
+	// Let the response continue a trailing assistant message instead of
+	// treating it as the prompt
+	if prefill := assistantPrefill(messages); prefill != "" && !config.AppConfig.StatelessMode {
+		r = r.WithContext(api.WithPrefill(r.Context(), prefill))
+	}
 
-	if !streaming {
-		h.handleNonStreaming(w, r, service, longCatReq)
+	if !call.streaming {
+		h.handleNonStreaming(w, r, call.service, longCatReq)
 		return
 	}
 
-	h.handleStreaming(w, r, service, longCatReq)
+	h.handleStreaming(w, r, call.service, longCatReq)
 }
 
-// extractAssistantMessagesFromResponse extracts assistant messages from API responses
-func extractAssistantMessagesFromResponse(response interface{}) []types.Message {
-	var messages []types.Message
+// checkContentType rejects bodies that are declared as something other than
+// JSON, unless ALLOW_ANY_CONTENT_TYPE is set. A missing Content-Type is
+// accepted; such bodies still have to parse as JSON.
+func checkContentType(r *http.Request) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" || config.AppConfig.AnyContentType {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/json" {
+		return fmt.Errorf("expected Content-Type: application/json, got %q", contentType)
+	}
+	return nil
+}
 
-	switch r := response.(type) {
-	case *api.ChatCompletionResponse:
-		// OpenAI response
-		if len(r.Choices) > 0 {
-			choice := r.Choices[0]
-			messages = append(messages, types.Message{
-				Role:    "assistant",
-				Content: choice.Delta.Content,
-			})
-		}
-	case *api.ClaudeAPIResponse:
-		// Claude response
-		if len(r.Content) > 0 {
-			for _, content := range r.Content {
-				if content.Type == "text" {
-					messages = append(messages, types.Message{
-						Role:    "assistant",
-						Content: content.Text,
-					})
-				}
+// apiRequest is a client request body decoded once, for the endpoint it
+// was sent to. Exactly one of openai and claude is set.
+type apiRequest struct {
+	path   string
+	openai *api.ChatCompletionRequest
+	claude *api.ClaudeAPIRequest
+}
+
+// parseAPIRequest decodes requestBody as the request type of path
+func parseAPIRequest(requestBody []byte, path string) (*apiRequest, error) {
+	req := &apiRequest{path: path}
+	var err error
+	switch path {
+	case "/v1/chat/completions":
+		req.openai = &api.ChatCompletionRequest{}
+		err = json.Unmarshal(requestBody, req.openai)
+	case "/v1/messages":
+		req.claude = &api.ClaudeAPIRequest{}
+		err = json.Unmarshal(requestBody, req.claude)
+	default:
+		err = fmt.Errorf("unsupported endpoint")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// extractModel returns the model name the client asked for
+func extractModel(req *apiRequest) string {
+	if req.claude != nil {
+		return req.claude.Model
+	}
+	return req.openai.Model
+}
+
+// checkModel validates the requested model against ALLOWED_MODELS, if set,
+// and logs which upstream model an alias from MODEL_ALIASES maps to. LongCat
+// serves a single model, so the mapping only decides what is accepted;
+// responses echo the name the client used.
+func checkModel(model string) error {
+	upstream, aliased := config.AppConfig.ModelAliases[model]
+	if aliased {
+		logging.LogDebug("Model alias %s -> %s", model, upstream)
+	}
+	if len(config.AppConfig.AllowedModels) == 0 || aliased {
+		return nil
+	}
+	for _, allowed := range config.AppConfig.AllowedModels {
+		if model == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("The model '%s' does not exist or you do not have access to it.", model)
+}
+
+// checkModalities rejects OpenAI requests asking for output other than text
+func checkModalities(req *apiRequest) error {
+	if req.openai == nil {
+		return nil
+	}
+	for _, modality := range req.openai.Modalities {
+		if modality != "text" {
+			return fmt.Errorf("Unsupported modality '%s': only text output is supported.", modality)
+		}
+	}
+	if audio := req.openai.Audio; len(audio) > 0 && string(audio) != "null" {
+		return errors.New("Audio output is not supported: only text output is supported.")
+	}
+	return nil
+}
+
+// acceptedBetas returns the anthropic-beta features of r that the gateway
+// implements and ANTHROPIC_BETAS allows, counting each requested one for
+// /admin/stats
+func (h *UnifiedHandler) acceptedBetas(r *http.Request) []string {
+	var accepted []string
+	for _, beta := range api.ParseBetas(r.Header) {
+		if !slices.Contains(api.SupportedBetas, beta) {
+			h.stats.recordBeta("unsupported")
+			logging.LogDebug("Ignoring unsupported anthropic-beta %q", beta)
+			continue
+		}
+		h.stats.recordBeta(beta)
+		if allowed := config.AppConfig.AnthropicBetas; len(allowed) == 0 || slices.Contains(allowed, beta) {
+			accepted = append(accepted, beta)
+		}
+	}
+	return accepted
+}
+
+// checkMaxTokens enforces that Claude requests carry a positive max_tokens,
+// as the Anthropic API does, unless STRICT_MAX_TOKENS is disabled
+func checkMaxTokens(req *apiRequest) error {
+	if req.claude == nil || !config.AppConfig.StrictMaxTokens {
+		return nil
+	}
+	if req.claude.MaxTokens == nil {
+		return errors.New("max_tokens: Field required")
+	}
+	if *req.claude.MaxTokens <= 0 {
+		return fmt.Errorf("max_tokens: Input should be greater than or equal to 1, got %d", *req.claude.MaxTokens)
+	}
+	return nil
+}
+
+// checkChoiceCount rejects requests for more than one completion. Both
+// endpoints read n the same way, since LongCat returns a single reply.
+func checkChoiceCount(req *apiRequest) error {
+	var n *int
+	switch {
+	case req.openai != nil:
+		n = req.openai.N
+	case req.claude != nil:
+		n = req.claude.N
+	}
+	if n == nil || *n == 1 {
+		return nil
+	}
+	if *n < 1 {
+		return fmt.Errorf("n: Input should be greater than or equal to 1, got %d", *n)
+	}
+	return fmt.Errorf("n: Only one completion per request is supported, got %d", *n)
+}
+
+// writeAPIError writes an error body in the format of the API being served
+func writeAPIError(w http.ResponseWriter, path string, status int, code, message string) {
+	var body interface{}
+	if path == "/v1/messages" {
+		errType := "invalid_request_error"
+		switch {
+		case status == http.StatusUnauthorized:
+			errType = "authentication_error"
+		case status == http.StatusNotFound:
+			errType = "not_found_error"
+		case status == http.StatusTooManyRequests:
+			errType = "rate_limit_error"
+		case status == http.StatusGatewayTimeout:
+			errType = "timeout_error"
+		case status >= http.StatusInternalServerError:
+			errType = "api_error"
+		}
+		body = map[string]interface{}{
+			"type": "error",
+			"error": map[string]interface{}{
+				"type":    errType,
+				"message": message,
+			},
+		}
+	} else {
+		errType := "invalid_request_error"
+		switch {
+		case status == http.StatusTooManyRequests:
+			errType = code
+		case status >= http.StatusInternalServerError:
+			errType = "server_error"
+		}
+		body = map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": message,
+				"type":    errType,
+				"code":    code,
+			},
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeUpstreamError reports a failed upstream call. Failures caused by
+// LongCat get 502 Bad Gateway, unless UPSTREAM_ERRORS_AS_502 is disabled,
+// and an open circuit breaker gets 503; anything else is a gateway fault
+// and gets 500.
+func writeUpstreamError(w http.ResponseWriter, path string, err error) {
+	var upstreamErr *api.UpstreamError
+	status, code := http.StatusInternalServerError, "internal_error"
+	if errors.Is(err, api.ErrCircuitOpen) {
+		// Nothing was sent upstream; the breaker lets a request through again after its cool-down
+		w.Header().Set("Retry-After", strconv.Itoa(config.AppConfig.BreakerCooldown))
+		writeAPIError(w, path, http.StatusServiceUnavailable, "service_unavailable", err.Error())
+		return
+	}
+	if errors.Is(err, api.ErrSessionTimeout) {
+		writeAPIError(w, path, http.StatusGatewayTimeout, "session_timeout", err.Error())
+		return
+	}
+	if errors.Is(err, api.ErrEmptyResponse) ||
+		(errors.As(err, &upstreamErr) && config.AppConfig.UpstreamAs502) {
+		status, code = http.StatusBadGateway, "upstream_error"
+	}
+	writeAPIError(w, path, status, code, err.Error())
+}
+
+// parseUpstreamOverride validates an X-Upstream-URL value against
+// ALLOW_UPSTREAM_OVERRIDE and the host allowlist to prevent SSRF
+func parseUpstreamOverride(value string) (*url.URL, error) {
+	if !config.AppConfig.AllowUpstreamURL {
+		return nil, fmt.Errorf("upstream override is disabled")
+	}
+
+	baseURL, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", baseURL.Scheme)
+	}
+
+	for _, allowed := range config.AppConfig.UpstreamAllowlist {
+		if strings.EqualFold(baseURL.Host, allowed) || strings.EqualFold(baseURL.Hostname(), allowed) {
+			return baseURL, nil
+		}
+	}
+	return nil, fmt.Errorf("host %q is not in UPSTREAM_OVERRIDE_ALLOWLIST", baseURL.Host)
+}
+
+// ConversationDebugResponse is the stored state returned by the debug endpoint
+type ConversationDebugResponse struct {
+	ConversationID string            `json:"conversation_id"`
+	Messages       []types.Message   `json:"messages"`
+	LastOriginal   []types.Message   `json:"last_original"`
+	CreatedAt      time.Time         `json:"created_at"`
+	LastAccessed   time.Time         `json:"last_accessed"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	TokensUsed     int               `json:"tokens_used"`
+	Agent          string            `json:"agent,omitempty"`
+}
+
+// QueueStatsResponse is returned by GET /admin/queue
+type QueueStatsResponse struct {
+	MaxConcurrent int            `json:"max_concurrent"`
+	Active        int            `json:"active"`
+	Waiting       map[string]int `json:"waiting"`
+}
+
+// handleConversationMessages serves GET /v1/conversations/{id}/messages.
+// It is only enabled when DEBUG_API_KEY is configured.
+func (h *UnifiedHandler) handleConversationMessages(w http.ResponseWriter, r *http.Request) {
+	if config.AppConfig.DebugAPIKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, ok := strings.CutPrefix(r.URL.Path, "/v1/conversations/")
+	if ok {
+		id, ok = strings.CutSuffix(id, "/messages")
+	}
+	if !ok || id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isDebugAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	entry, exists := h.conversationManager.GetConversation(id)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Conversation %s not found", id), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConversationDebugResponse{
+		ConversationID: entry.ConversationID,
+		Messages:       entry.Messages,
+		LastOriginal:   entry.LastOriginal,
+		CreatedAt:      entry.CreatedAt,
+		LastAccessed:   entry.LastAccessed,
+		Metadata:       entry.Metadata,
+		TokensUsed:     entry.TokensUsed,
+		Agent:          entry.Agent,
+	})
+}
+
+// ClearConversationsResponse is returned by POST /admin/conversations/clear
+type ClearConversationsResponse struct {
+	Cleared int `json:"cleared"`
+}
+
+// handleClearConversations empties the conversation store, for when the
+// history matcher has got into a bad state. Like the other debug endpoints
+// it is only enabled when DEBUG_API_KEY is configured.
+func (h *UnifiedHandler) handleClearConversations(w http.ResponseWriter, r *http.Request) {
+	if config.AppConfig.DebugAPIKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isDebugAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cleared := h.conversationManager.Clear()
+	logging.LogInfo("Cleared %d conversations", cleared)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ClearConversationsResponse{Cleared: cleared})
+}
+
+// isDebugAuthorized checks the request carries DEBUG_API_KEY as a bearer token or x-api-key
+func isDebugAuthorized(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(requestAPIKey(r)), []byte(config.AppConfig.DebugAPIKey)) == 1
+}
+
+// requestAPIKey returns the API key sent as a bearer token or x-api-key
+func requestAPIKey(r *http.Request) string {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return bearer
+	}
+	return r.Header.Get("x-api-key")
+}
+
+// handleQueueStats reports upstream queue usage per API key. Like the other
+// admin endpoints it needs DEBUG_API_KEY.
+func (h *UnifiedHandler) handleQueueStats(w http.ResponseWriter, r *http.Request) {
+	if config.AppConfig.DebugAPIKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isDebugAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(QueueStatsResponse{
+		MaxConcurrent: config.AppConfig.MaxConcurrent,
+		Active:        h.queue.Active(),
+		Waiting:       h.queue.Depths(),
+	})
+}
+
+// startResponse sends longCatReq and converts the reply. When LongCat closes
+// the stream without any content, the request is retried on a fresh session
+// up to EMPTY_RESPONSE_RETRIES times before the empty-response handling applies.
+func (h *UnifiedHandler) startResponse(ctx context.Context, service api.APIService, longCatReq *api.LongCatRequest, stream bool) (*http.Response, <-chan interface{}, <-chan error, error) {
+	if cached, ok := cachedResponseFrom(ctx); ok {
+		resp := api.CachedResponse(ctx, cached.content, cached.usage)
+		chunks, errs := service.ConvertResponse(resp, stream)
+		return resp, chunks, errs, nil
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := h.longCatClient.SendRequest(ctx, *longCatReq)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		chunks, errs := service.ConvertResponse(resp, stream)
+		if attempt > config.AppConfig.EmptyRetries {
+			return resp, chunks, errs, nil
+		}
+
+		chunks, errs, _, empty := peekChunks(ctx, chunks, errs)
+		if !empty {
+			return resp, chunks, errs, nil
+		}
+
+		logging.LogInfo("Empty response for conversation %s, retrying on a fresh session (%d/%d)",
+			longCatReq.ConversationId, attempt, config.AppConfig.EmptyRetries)
+		conversationID, err := h.longCatClient.NewSession(ctx)
+		if err != nil {
+			logging.LogDebug("Failed to create retry session: %v", err)
+			return resp, chunks, errs, nil
+		}
+		h.conversationManager.ReplaceConversationID(longCatReq.ConversationId, conversationID)
+		longCatReq.ConversationId = conversationID
+	}
+}
+
+// peekChunks waits for the first chunk and reports whether the stream ended
+// without any chunk or error. The returned channels replay everything read
+// until ctx is done.
+func peekChunks(ctx context.Context, chunks <-chan interface{}, errs <-chan error) (<-chan interface{}, <-chan error, interface{}, bool) {
+	first, ok := <-chunks
+	if !ok {
+		// The converters close errs before chunks, so any error is already there
+		err := <-errs
+		replayErrs := make(chan error, 1)
+		replayErrs <- err
+		close(replayErrs)
+		return chunks, replayErrs, nil, err == nil
+	}
+
+	out := make(chan interface{}, cap(chunks))
+	go func() {
+		defer close(out)
+		if !sendChunk(ctx, out, first) {
+			drainChunks(chunks)
+			return
+		}
+		for chunk := range chunks {
+			if !sendChunk(ctx, out, chunk) {
+				drainChunks(chunks)
+				return
 			}
 		}
+	}()
+	return out, errs, first, false
+}
+
+// setLongCatIDHeaders reports where the reply sits in LongCat's message tree,
+// taken from the first chunk, when EXPOSE_LONGCAT_IDS is enabled
+func setLongCatIDHeaders(ctx context.Context, w http.ResponseWriter, chunks <-chan interface{}, errs <-chan error) (<-chan interface{}, <-chan error) {
+	if !config.AppConfig.ExposeLongCatIDs {
+		return chunks, errs
 	}
+	chunks, errs, first, _ := peekChunks(ctx, chunks, errs)
 
-	return messages
+	var messageID, parentID int
+	switch c := first.(type) {
+	case api.ChatCompletionChunk:
+		messageID, parentID = c.LongCatMessageID, c.LongCatParentID
+	case api.ClaudeStreamChunk:
+		messageID, parentID = c.LongCatMessageID, c.LongCatParentID
+	}
+	if messageID != 0 {
+		w.Header().Set("X-LongCat-Message-ID", strconv.Itoa(messageID))
+		w.Header().Set("X-LongCat-Parent-ID", strconv.Itoa(parentID))
+	}
+	return chunks, errs
+}
+
+// assistantTurn is what captureAssistantMessages collects from a response
+type assistantTurn struct {
+	messages []types.Message
+	usage    api.TokenInfo // Token usage of the turn, when the response reported it
+	partial  bool          // Cut short by PARTIAL_ON_TIMEOUT or MAX_RESPONSE_BYTES
+}
+
+// captureAssistantMessages forwards chunks unchanged while collecting the
+// assistant reply and its token usage. It stops forwarding once ctx is done,
+// since the handler reading the chunks has returned by then.
+func captureAssistantMessages(ctx context.Context, chunks <-chan interface{}) (<-chan interface{}, <-chan assistantTurn) {
+	out := make(chan interface{}, cap(chunks))
+	result := make(chan assistantTurn, 1)
+
+	go func() {
+		defer close(result)
+		var content strings.Builder
+		var turn assistantTurn
+		for chunk := range chunks {
+			content.WriteString(chunkText(chunk))
+			if usage, ok := chunkUsage(chunk); ok {
+				turn.usage = usage
+			}
+			if chunkPartial(chunk) {
+				turn.partial = true
+			}
+			if !sendChunk(ctx, out, chunk) {
+				drainChunks(chunks)
+				break
+			}
+		}
+		close(out)
+
+		if content.Len() > 0 {
+			turn.messages = []types.Message{{
+				Role:    "assistant",
+				Content: content.String(),
+			}}
+		}
+		result <- turn
+	}()
+
+	return out, result
+}
+
+// sendChunk delivers chunk on out, or reports false once ctx is done
+func sendChunk(ctx context.Context, out chan<- interface{}, chunk interface{}) bool {
+	select {
+	case out <- chunk:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// drainChunks discards the rest of a stream nobody reads any more, so the
+// converter feeding it can finish and release its upstream connection
+func drainChunks(chunks <-chan interface{}) {
+	for range chunks {
+	}
+}
+
+// chunkUsage returns the token usage carried by a final chunk
+func chunkUsage(chunk interface{}) (api.TokenInfo, bool) {
+	switch c := chunk.(type) {
+	case api.ChatCompletionChunk:
+		if c.Usage != nil {
+			return api.TokenInfo{
+				PromptTokens:     c.Usage.PromptTokens,
+				CompletionTokens: c.Usage.CompletionTokens,
+				TotalTokens:      c.Usage.TotalTokens,
+				HasTokens:        true,
+			}, true
+		}
+	case api.ClaudeStreamChunk:
+		if c.Type == "message_delta" && c.MessageDelta != nil {
+			usage := c.MessageDelta.Usage
+			return api.TokenInfo{
+				PromptTokens:     usage.InputTokens,
+				CompletionTokens: usage.OutputTokens,
+				TotalTokens:      usage.InputTokens + usage.OutputTokens,
+				HasTokens:        true,
+			}, true
+		}
+	}
+	return api.TokenInfo{}, false
+}
+
+// chunkPartial reports whether chunk belongs to a response cut short by
+// PARTIAL_ON_TIMEOUT or MAX_RESPONSE_BYTES
+func chunkPartial(chunk interface{}) bool {
+	switch c := chunk.(type) {
+	case api.ChatCompletionChunk:
+		return c.Partial
+	case api.ClaudeStreamChunk:
+		return c.Partial
+	}
+	return false
+}
+
+func chunkText(chunk interface{}) string {
+	switch c := chunk.(type) {
+	case api.ChatCompletionChunk:
+		// OpenAI chunk
+		if len(c.Choices) > 0 {
+			return c.Choices[0].Delta.Content
+		}
+	case api.ClaudeStreamChunk:
+		// Claude chunk
+		if c.Type == "content_block_delta" && c.Delta != nil {
+			return c.Delta.Text
+		}
+	}
+	return ""
 }
 
 // extractMessagesFromRequest extracts messages from OpenAI/Claude request
-func extractMessagesFromRequest(requestBody []byte, path string) ([]types.Message, error) {
-	switch path {
-	case "/v1/chat/completions":
-		var req api.ChatCompletionRequest
-		if err := json.Unmarshal(requestBody, &req); err != nil {
-			return nil, err
-		}
-		messages := []types.Message{}
-		for _, m := range req.Messages {
-			// LongCat not supporting system role
-			if m.Role != "user" {
+func extractMessagesFromRequest(req *apiRequest) []types.Message {
+	messages := []types.Message{}
+	switch {
+	case req.openai != nil:
+		for _, m := range req.openai.Messages {
+			// LongCat not supporting system role, unless the whole history is forwarded
+			if m.Role != "user" && !config.AppConfig.ForwardMessages {
 				continue
 			}
-			if str, ok := m.Content.(string); ok {
+			name := m.Name
+			if config.AppConfig.MessageNameMode == "ignore" {
+				name = ""
+			}
+			for _, part := range m.Parts {
+				if part.Type != "text" {
+					continue
+				}
 				messages = append(messages, types.Message{
-					Content: str,
+					Content: part.Text,
 					Role:    m.Role,
+					Name:    name,
 				})
 			}
-			if ls, ok := m.Content.([]interface{}); ok {
-				for _, v := range ls {
-					if vm, ok := v.(map[string]interface{}); ok {
-						messages = append(messages, types.Message{
-							Content: vm["text"].(string),
-							Role:    m.Role,
-						})
-					}
-				}
-			}
-		}
-		return messages, nil
-	case "/v1/messages":
-		var req api.ClaudeAPIRequest
-		if err := json.Unmarshal(requestBody, &req); err != nil {
-			return nil, err
 		}
-
+	case req.claude != nil:
 		// Convert Claude messages to our Message format
-		messages := []types.Message{}
 
 		// Handle system field (can be string or []ClaudeMessageContent)
 		// if req.System != nil {
@@ -245,7 +845,7 @@ func extractMessagesFromRequest(requestBody []byte, path string) ([]types.Messag
 		// 		}
 		// 	}
 		// }
-		for _, m := range req.Messages {
+		for _, m := range req.claude.Messages {
 			if str, ok := m.Content.(string); ok {
 				messages = append(messages, types.Message{
 					Content: str,
@@ -254,60 +854,259 @@ func extractMessagesFromRequest(requestBody []byte, path string) ([]types.Messag
 			}
 			if ls, ok := m.Content.([]interface{}); ok {
 				for _, v := range ls {
-					if vm, ok := v.(map[string]interface{}); ok {
-						messages = append(messages, types.Message{
-							Content: vm["text"].(string),
-							Role:    m.Role,
-						})
+					// Only text blocks carry prompt text; image and tool blocks are skipped
+					if vm, ok := v.(map[string]interface{}); ok && vm["type"] == "text" {
+						if text, ok := vm["text"].(string); ok {
+							messages = append(messages, types.Message{
+								Content: text,
+								Role:    m.Role,
+							})
+						}
 					}
 				}
 			}
 		}
-		return messages, nil
 	}
-	return nil, fmt.Errorf("unsupported endpoint")
+	return messages
 }
 
-func (h *UnifiedHandler) isStreamingRequest(requestBody []byte, path string) bool {
-	switch path {
-	case "/v1/chat/completions":
-		var req api.ChatCompletionRequest
-		if err := json.Unmarshal(requestBody, &req); err == nil {
-			return req.Stream
+// extractMaxTokens returns the output token limit requested by the client, or 0 if none
+func extractMaxTokens(req *apiRequest) int {
+	if req.claude != nil {
+		if req.claude.MaxTokens == nil {
+			return 0
 		}
-	case "/v1/messages":
-		var req api.ClaudeAPIRequest
-		if err := json.Unmarshal(requestBody, &req); err == nil {
-			return req.Stream
+		return *req.claude.MaxTokens
+	}
+	if req.openai.MaxCompletionTokens > 0 {
+		return req.openai.MaxCompletionTokens
+	}
+	return req.openai.MaxTokens
+}
+
+// extractIncludeUsage reports whether an OpenAI request sets
+// stream_options.include_usage, noting the stream options that are ignored
+func extractIncludeUsage(req *apiRequest) bool {
+	if req.openai == nil || req.openai.StreamOptions == nil {
+		return false
+	}
+	options := req.openai.StreamOptions
+	if len(options.Ignored) > 0 {
+		logging.LogDebug("Ignoring stream_options %s", strings.Join(options.Ignored, ", "))
+	}
+	return options.IncludeUsage
+}
+
+// allowsParallelToolCalls reports whether an OpenAI request permits more
+// than one tool call per response, which it does unless parallel_tool_calls
+// is false
+func allowsParallelToolCalls(req *apiRequest) bool {
+	if req.openai == nil || req.openai.ParallelToolCalls == nil {
+		return true
+	}
+	return *req.openai.ParallelToolCalls
+}
+
+// logIgnoredSampling notes sampling parameters LongCat cannot honour, so
+// their absence from the LongCat request is not mistaken for a bug
+func logIgnoredSampling(req *apiRequest) {
+	if req.claude != nil && req.claude.TopK != nil {
+		logging.LogDebug("Ignoring top_k=%d: LongCat does not support sampling parameters", *req.claude.TopK)
+	}
+}
+
+// extractReasonEnabled maps the OpenAI reasoning_effort parameter onto
+// LongCat's reasonEnabled flag. Requests without one use the model's
+// default, if it has one.
+func extractReasonEnabled(req *apiRequest, modelDefault bool) (int, error) {
+	fallback := 0
+	if modelDefault {
+		fallback = 1
+	}
+	if req.openai == nil {
+		return fallback, nil
+	}
+	switch effort := req.openai.ReasoningEffort; effort {
+	case "":
+		// OpenRouter clients switch reasoning with include_reasoning instead
+		if includesReasoning(req) {
+			return 1, nil
+		}
+		if req.openai.IncludeReasoning != nil {
+			return 0, nil
 		}
+		return fallback, nil
+	case "none":
+		return 0, nil
+	case "minimal", "low", "medium", "high":
+		return 1, nil
 	}
-	return false
+	return 0, fmt.Errorf("Invalid value for 'reasoning_effort': '%s'. Supported values are: 'none', 'minimal', 'low', 'medium', and 'high'.", req.openai.ReasoningEffort)
+}
+
+// applyQueryOverrides lets ?reason= and ?search= set LongCat's reasonEnabled
+// and searchEnabled flags for one request, when ALLOW_QUERY_OVERRIDES is
+// set. Other query parameters are ignored.
+func applyQueryOverrides(query url.Values, reasonEnabled, searchEnabled *int) error {
+	if !config.AppConfig.QueryOverrides {
+		return nil
+	}
+	overrides := []struct {
+		name string
+		flag *int
+	}{{"reason", reasonEnabled}, {"search", searchEnabled}}
+	for _, override := range overrides {
+		if !query.Has(override.name) {
+			continue
+		}
+		switch value := query.Get(override.name); value {
+		case "1", "true":
+			*override.flag = 1
+		case "0", "false":
+			*override.flag = 0
+		default:
+			return fmt.Errorf("Invalid value for query parameter '%s': '%s'. Supported values are: '0', '1', 'true' and 'false'.", override.name, value)
+		}
+	}
+	return nil
+}
+
+// includesReasoning reports whether an OpenAI request set OpenRouter's
+// include_reasoning flag
+func includesReasoning(req *apiRequest) bool {
+	return req.openai != nil && req.openai.IncludeReasoning != nil && *req.openai.IncludeReasoning
+}
+
+// extractResponseSchema returns the json_schema of an OpenAI response_format,
+// if one was requested
+func extractResponseSchema(req *apiRequest) (*api.JSONSchemaFormat, error) {
+	if req.openai == nil || req.openai.ResponseFormat == nil || req.openai.ResponseFormat.Type != "json_schema" {
+		return nil, nil
+	}
+	if format := req.openai.ResponseFormat.JSONSchema; format != nil && format.Schema != nil {
+		if err := format.CheckRefs(); err != nil {
+			return nil, fmt.Errorf("Invalid schema for response_format '%s': %v.", format.Name, err)
+		}
+		return format, nil
+	}
+	return nil, fmt.Errorf("Missing required parameter: 'response_format.json_schema.schema'.")
+}
+
+// resolveThread returns the conversation the client explicitly asked to
+// continue, via the X-Conversation-ID header or previous_response_id. Only
+// conversations owned by the caller can be continued; any other ID is
+// reported as unknown, the same as one the gateway has never seen.
+func (h *UnifiedHandler) resolveThread(r *http.Request, req *apiRequest) (string, error) {
+	owner := queueKey(r)
+	if conversationID := strings.TrimSpace(r.Header.Get("X-Conversation-ID")); conversationID != "" {
+		if !h.ownsConversation(conversationID, owner) {
+			return "", fmt.Errorf("Unknown conversation '%s' in X-Conversation-ID.", conversationID)
+		}
+		return conversationID, nil
+	}
+	if req.openai == nil || req.openai.PreviousResponseID == "" {
+		return "", nil
+	}
+	previous := req.openai.PreviousResponseID
+	conversationID, exists := h.conversationManager.ConversationForResponse(previous)
+	if !exists || !h.ownsConversation(conversationID, owner) {
+		return "", fmt.Errorf("Unknown conversation for previous_response_id '%s'.", previous)
+	}
+	return conversationID, nil
+}
+
+// ownsConversation reports whether the gateway knows conversationID and it
+// was started by owner
+func (h *UnifiedHandler) ownsConversation(conversationID, owner string) bool {
+	entry, exists := h.conversationManager.GetConversation(conversationID)
+	return exists && entry.Owner == owner
+}
+
+// findConversation matches messages against the conversations owned by
+// owner, so one client's history never continues another's session
+func (h *UnifiedHandler) findConversation(agent string, messages []types.Message, owner string) (string, bool) {
+	conversationID, exists := h.conversationManager.FindConversation(agent, messages)
+	if !exists || !h.ownsConversation(conversationID, owner) {
+		return "", false
+	}
+	return conversationID, true
+}
+
+// extractMetadata returns the OpenAI metadata map sent with the request, if any
+func extractMetadata(req *apiRequest) map[string]string {
+	if req.openai == nil {
+		return nil
+	}
+	return req.openai.Metadata
+}
+
+// resolveMaxTokens applies the model's default and then DEFAULT_MAX_TOKENS
+// when the client set no limit, and clamps the result to HARD_MAX_TOKENS
+func resolveMaxTokens(requested, modelDefault int) int {
+	maxTokens := requested
+	if maxTokens <= 0 {
+		maxTokens = modelDefault
+	}
+	if maxTokens <= 0 {
+		maxTokens = config.AppConfig.DefaultMaxTokens
+	}
+	if hardMax := config.AppConfig.HardMaxTokens; hardMax > 0 && (maxTokens <= 0 || maxTokens > hardMax) {
+		maxTokens = hardMax
+	}
+	return maxTokens
+}
+
+func (h *UnifiedHandler) isStreamingRequest(req *apiRequest) bool {
+	if req.claude != nil {
+		return req.claude.Stream
+	}
+	return req.openai.Stream
 }
 
 func (h *UnifiedHandler) handleNonStreaming(w http.ResponseWriter, r *http.Request, service api.APIService, longCatReq api.LongCatRequest) {
-	resp, err := h.longCatClient.SendRequest(r.Context(), longCatReq)
+	// Returning early, as on a response error, ends the goroutines relaying chunks
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	_, chunks, errs, err := h.startResponse(ctx, service, &longCatReq, false)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to make request: %v", err), http.StatusInternalServerError)
+		h.stats.upstreamErrors.Add(1)
+		writeUpstreamError(w, r.URL.Path, fmt.Errorf("Failed to make request: %w", err))
 		return
 	}
-
-	// Update LastOriginal with assistant response
-	assistantMessages := extractAssistantMessagesFromResponse(resp)
-	if len(assistantMessages) > 0 {
-		h.conversationManager.UpdateLastOriginal(longCatReq.ConversationId, assistantMessages)
-		logging.LogInfo("Updated LastOriginal for conversation %s", longCatReq.ConversationId)
+	if longCatReq.ConversationId != "" {
+		w.Header().Set("X-Conversation-ID", longCatReq.ConversationId)
 	}
+	chunks, errs = setLongCatIDHeaders(ctx, w, chunks, errs)
 
-	chunks, errs := service.ConvertResponse(resp, false)
+	chunks, assistant := captureAssistantMessages(ctx, chunks)
 
 	// Use the service's own handler method instead of type assertion
 	if err := service.HandleNonStreamingResponse(w, chunks, errs); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to handle response: %v", err), http.StatusInternalServerError)
+		h.stats.upstreamErrors.Add(1)
+		writeUpstreamError(w, r.URL.Path, fmt.Errorf("Failed to handle response: %w", err))
 		return
 	}
+
+	// Update LastOriginal with assistant response
+	turn := <-assistant
+	if len(turn.messages) > 0 {
+		h.conversationManager.UpdateLastOriginal(longCatReq.ConversationId, turn.messages)
+		logging.LogInfo("Updated LastOriginal for conversation %s", longCatReq.ConversationId)
+	}
+	h.conversationManager.AddTokenUsage(longCatReq.ConversationId, turn.usage.TotalTokens)
+	h.cache.store(r.Context(), turn)
+	h.mirror.send(r.Context(), turn)
 }
 
 func (h *UnifiedHandler) handleStreaming(w http.ResponseWriter, r *http.Request, service api.APIService, longCatReq api.LongCatRequest) {
+	// WRITE_TIMEOUT_SECONDS bounds non-streaming responses only; a stream may
+	// legitimately outlast it
+	if config.AppConfig.WriteTimeout > 0 {
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			logging.LogDebug("Cannot lift the write deadline for a stream: %v", err)
+		}
+	}
 	// Set SSE headers with CORS support
 	w.Header().Set("Content-Type", service.GetResponseContentType(true))
 	w.Header().Set("Cache-Control", "no-cache")
@@ -318,33 +1117,90 @@ func (h *UnifiedHandler) handleStreaming(w http.ResponseWriter, r *http.Request,
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key, anthropic-version")
 	w.Header().Set("Access-Control-Expose-Headers", "*")
 
-	resp, err := h.longCatClient.SendRequest(r.Context(), longCatReq)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to make request: %v", err), http.StatusInternalServerError)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
 		return
 	}
 
-	chunks, errs := service.ConvertResponse(resp, true)
+	// Accept: application/x-ndjson swaps SSE framing for one JSON object per line
+	ndjson := wantsNDJSON(r)
+	if ndjson {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w = &ndjsonWriter{ResponseWriter: w, flusher: flusher}
+		flusher = w.(http.Flusher)
+	}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+	// With resume enabled, the stream is buffered and generation outlives the
+	// client connection so a reconnect can replay what it missed. Resumed
+	// streams are replayed as SSE, so NDJSON responses are not buffered, and
+	// only their owner may resume them, so neither are anonymous ones.
+	ctx := r.Context()
+	owner := queueKey(r)
+	if responseID := api.ResponseID(ctx); config.AppConfig.ResumeSeconds > 0 && responseID != "" && !ndjson && owner != anonymousClient {
+		buf := h.streams.start(responseID, owner, service.GetResponseContentType(true))
+		defer h.streams.finish(responseID, buf)
+		detached, cancel := detachFromClient(ctx)
+		defer cancel()
+		ctx = detached
+		w = &recordingWriter{ResponseWriter: w, flusher: flusher, buf: buf}
+		flusher = w.(http.Flusher)
+		w.Header().Set("X-Response-ID", responseID)
+	}
+	// Returning early, as on an abort or MAX_STREAM_DURATION_SECONDS, ends
+	// the goroutines relaying chunks
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, chunks, errs, err := h.startResponse(ctx, service, &longCatReq, true)
+	if err != nil {
+		h.stats.upstreamErrors.Add(1)
+		writeUpstreamError(w, r.URL.Path, fmt.Errorf("Failed to make request: %w", err))
 		return
 	}
+	if longCatReq.ConversationId != "" {
+		w.Header().Set("X-Conversation-ID", longCatReq.ConversationId)
+	}
+	chunks, errs = setLongCatIDHeaders(ctx, w, chunks, errs)
+
+	chunks, assistant := captureAssistantMessages(ctx, chunks)
+
+	h.stats.activeStreams.Add(1)
+	defer h.stats.activeStreams.Add(-1)
 
 	// Use the service's own handler method instead of type assertion
-	if err := service.HandleStreamingResponse(w, flusher, chunks, errs); err != nil {
+	if err := service.HandleStreamingResponse(resp.Request.Context(), w, flusher, chunks, errs); err != nil {
+		if superseded(ctx) {
+			resp.Body.Close()
+			logging.LogInfo("Stream for conversation %s cancelled by a newer turn", longCatReq.ConversationId)
+			return
+		}
+		if aborted(ctx) {
+			resp.Body.Close()
+			logging.LogInfo("Stream for conversation %s aborted by the client", longCatReq.ConversationId)
+			return
+		}
+		if errors.Is(err, api.ErrMaxStreamDuration) {
+			// Release the upstream connection instead of waiting on a stuck stream
+			resp.Body.Close()
+			logging.LogInfo("Stream for conversation %s cut after %ds", longCatReq.ConversationId, config.AppConfig.MaxStreamSeconds)
+			return
+		}
+		h.stats.upstreamErrors.Add(1)
 		logging.LogDebug("Streaming error: %v", err)
 		// Error is already handled by the service implementation
 		return
 	}
 
 	// Update LastOriginal with assistant response after streaming completes
-	assistantMessages := extractAssistantMessagesFromResponse(resp)
-	if len(assistantMessages) > 0 {
-		h.conversationManager.UpdateLastOriginal(longCatReq.ConversationId, assistantMessages)
+	turn := <-assistant
+	if len(turn.messages) > 0 {
+		h.conversationManager.UpdateLastOriginal(longCatReq.ConversationId, turn.messages)
 		logging.LogInfo("Updated LastOriginal for conversation %s after streaming", longCatReq.ConversationId)
 	}
+	h.conversationManager.AddTokenUsage(longCatReq.ConversationId, turn.usage.TotalTokens)
+	h.cache.store(r.Context(), turn)
+	h.mirror.send(r.Context(), turn)
 }
 
 func main() {
@@ -354,6 +1210,8 @@ func main() {
 		clearCookies  = flag.Bool("clear-cookies", false, "Clear stored cookies")
 		showVersion   = flag.Bool("version", false, "Show version information")
 		verbose       = flag.Bool("verbose", false, "Enable verbose logging output")
+		daemon        = flag.Bool("daemon", false, "Run the server in the background")
+		pidFile       = flag.String("pid-file", "", "Write the server PID to this file")
 	)
 
 	flag.Usage = func() {
@@ -377,8 +1235,15 @@ func main() {
 	}
 
 	if *clearCookies {
-		homeDir, _ := os.UserHomeDir()
-		configPath := homeDir + "/.config/longcat-web-api/config.json"
+		if config.AppConfig.UseKeychain {
+			if err := config.NewCookieManager().DeleteFromKeychain(); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			} else {
+				fmt.Println("✓ Keychain entry cleared")
+			}
+		}
+
+		configPath := config.NewCookieManager().ConfigPath()
 
 		if err := os.Remove(configPath); err != nil {
 			if os.IsNotExist(err) {
@@ -398,20 +1263,60 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to update cookies: %v", err)
 		}
-		config.AppConfig.Cookies = cookies
+		config.SetCookies(cookies)
 		fmt.Println("✓ Cookies updated successfully")
 		// Continue to start the server with new cookies
 	}
 
+	// Report every configuration problem before doing any work
+	if err := config.AppConfig.Check(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	// Set global verbose mode
 	logging.SetVerboseMode(*verbose)
+	logging.SetSampleRate(config.AppConfig.LogSampleRate)
 
 	// Ensure cookies are configured before starting
 	ensureCookiesConfigured()
 
+	if *daemon && !isDaemonChild() {
+		pid, err := daemonize()
+		if err != nil {
+			log.Fatalf("Failed to start daemon: %v", err)
+		}
+		fmt.Printf("✓ Server started in background (PID %d)\n", pid)
+		return
+	}
+
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile); err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer removePIDFile(*pidFile)
+	}
+
 	handler := NewUnifiedHandler(*verbose)
 
+	// Optionally preconnect to LongCat before announcing readiness
+	if config.AppConfig.Warmup {
+		warmup(handler.longCatClient)
+	}
+
 	serverAddr := config.AppConfig.GetServerAddress()
+	// Under systemd socket activation the socket is already bound
+	listener, err := activatedListener()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if listener != nil {
+		serverAddr = listener.Addr().String()
+		if _, port, err := net.SplitHostPort(serverAddr); err == nil {
+			serverAddr = ":" + port
+		}
+		fmt.Println("✓ Using socket-activated listener")
+	}
 
 	// Always show basic startup info
 	fmt.Printf("\n=== LongCat API Wrapper ===\n")
@@ -422,21 +1327,86 @@ func main() {
 		fmt.Println("\nEndpoints:")
 		fmt.Println("  POST /v1/chat/completions (OpenAI compatible)")
 		fmt.Println("  POST /v1/messages (Claude compatible)")
-		fmt.Printf("\nServer ready at http://localhost%s\n\n", serverAddr)
+		if config.AppConfig.DebugAPIKey != "" {
+			fmt.Println("  GET  /v1/conversations/{id}/messages (debug)")
+		}
+		scheme := "http"
+		if config.AppConfig.TLSCertFile != "" {
+			scheme = "https"
+		}
+		fmt.Printf("\nServer ready at %s://localhost%s\n\n", scheme, serverAddr)
 	} else {
 		fmt.Println(" (Run with --verbose for detailed logging)")
 		fmt.Println()
 	}
 
-	if err := http.ListenAndServe(serverAddr, handler); err != nil {
+	// HTTP/2 is negotiated via ALPN under TLS; cleartext HTTP/2 (h2c) is
+	// opt-in for reverse proxies that speak it to their backends
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(config.AppConfig.H2C)
+
+	// READ_HEADER_TIMEOUT_SECONDS guards against slowloris clients. The read
+	// and write timeouts are lifted once a request is being answered, so
+	// they never cut a long generation or stream.
+	server := &http.Server{
+		Addr:              serverAddr,
+		Handler:           handler,
+		Protocols:         &protocols,
+		ReadHeaderTimeout: time.Duration(config.AppConfig.ReadHeaderTimeout) * time.Second,
+		ReadTimeout:       time.Duration(config.AppConfig.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(config.AppConfig.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(config.AppConfig.IdleTimeout) * time.Second,
+	}
+	server.SetKeepAlivesEnabled(config.AppConfig.KeepAlive)
+
+	// Shut down gracefully on SIGINT/SIGTERM so in-flight requests finish
+	// and deferred cleanup (such as PID file removal) runs
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		fmt.Println("\nShutting down...")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logging.LogError("Graceful shutdown failed: %v", err)
+		}
+		handler.conversationManager.Stop()
+	}()
+
+	switch {
+	case listener != nil && config.AppConfig.TLSCertFile != "":
+		err = server.ServeTLS(listener, config.AppConfig.TLSCertFile, config.AppConfig.TLSKeyFile)
+	case listener != nil:
+		err = server.Serve(listener)
+	case config.AppConfig.TLSCertFile != "":
+		err = server.ListenAndServeTLS(config.AppConfig.TLSCertFile, config.AppConfig.TLSKeyFile)
+	default:
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if *pidFile != "" {
+			removePIDFile(*pidFile)
+		}
 		log.Fatalf("Server error: %v", err)
 	}
+	<-shutdownDone
 }
 
 // ensureCookiesConfigured checks if cookies are available and prompts for them if not
 func ensureCookiesConfigured() {
+	if config.AppConfig.SecretsProvider != "" {
+		loadCookiesFromProvider()
+		return
+	}
+
 	// Check if cookies are already configured
-	if config.AppConfig.Cookies.PassportToken != "" {
+	if config.CurrentCookies().PassportToken != "" {
 		fmt.Println("✓ Cookies loaded from environment variables")
 		return
 	}
@@ -445,8 +1415,8 @@ func ensureCookiesConfigured() {
 	cookieManager := config.NewCookieManager()
 	cookies, err := cookieManager.LoadCookies()
 	if err == nil && cookies.PassportToken != "" {
-		config.AppConfig.Cookies = cookies
-		fmt.Println("✓ Cookies loaded from config file")
+		config.SetCookies(cookies)
+		fmt.Println("✓ Cookies loaded from saved configuration")
 		return
 	}
 
@@ -460,26 +1430,201 @@ func ensureCookiesConfigured() {
 	}
 
 	// Update AppConfig with obtained cookies
-	config.AppConfig.Cookies = cookies
+	config.SetCookies(cookies)
 	fmt.Println("✓ Cookies configured successfully")
 }
 
+// loadCookiesFromProvider fetches the cookies from SECRETS_PROVIDER and, when
+// SECRETS_REFRESH_SECONDS is set, keeps fetching them so rotations apply
+func loadCookiesFromProvider() {
+	provider, err := config.NewSecretsProvider(config.AppConfig.SecretsProvider)
+	if err != nil {
+		log.Fatalf("Invalid secrets provider: %v", err)
+	}
+	cookies, err := provider.GetCookies()
+	if err != nil {
+		log.Fatalf("Failed to obtain cookies from the %s secrets provider: %v", config.AppConfig.SecretsProvider, err)
+	}
+	config.SetCookies(cookies)
+	fmt.Printf("✓ Cookies loaded from the %s secrets provider\n", config.AppConfig.SecretsProvider)
+
+	if config.AppConfig.SecretsRefresh > 0 {
+		go config.RefreshCookies(provider, time.Duration(config.AppConfig.SecretsRefresh)*time.Second)
+	}
+}
+
+// warmup preconnects to LongCat; failures are logged but never fatal
+func warmup(client *api.LongCatClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.AppConfig.Timeout)*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := client.Warmup(ctx, config.AppConfig.WarmupCookies); err != nil {
+		logging.LogError("Warmup failed (continuing): %v", err)
+		return
+	}
+	fmt.Printf("✓ Warmup completed in %v\n", time.Since(start).Round(time.Millisecond))
+}
+
 // createLongCatRequest creates a LongCatRequest from the extracted messages and request data
-func createLongCatRequest(messages []types.Message, conversationID string) (api.LongCatRequest, error) {
+func createLongCatRequest(messages []types.Message, system, conversationID string, newSession bool, maxTokens int) (api.LongCatRequest, error) {
 	// Extract the last user message content as the primary content
 	var content string
-	if len(messages) > 0 {
+	if config.AppConfig.StatelessMode {
+		content = formatTranscript(withSystemMessage(system, withFewShot(messages)))
+	} else if len(messages) > 0 {
 		lastMsg := messages[len(messages)-1]
 		if lastMsg.Role == "user" {
-			content = lastMsg.Content
+			content = namedContent(lastMsg)
+		} else if prefill := assistantPrefill(messages); prefill != "" {
+			content = fmt.Sprintf("%s\n\nBegin your reply with exactly the following text and continue it:\n%s",
+				namedContent(messages[len(messages)-2]), prefill)
 		}
 	}
 
-	return api.LongCatRequest{
+	longCatReq := api.LongCatRequest{
 		Content:        content,
 		ConversationId: conversationID,
 		ReasonEnabled:  0,
 		SearchEnabled:  0,
 		Regenerate:     0,
-	}, nil
+		MaxTokens:      maxTokens,
+	}
+	if config.AppConfig.ForwardMessages {
+		// The system prompt travels as its own turn
+		longCatReq.Messages = toLongCatMessages(withSystemMessage(system, withFewShot(messages)))
+	} else if newSession && !config.AppConfig.StatelessMode && content != "" {
+		// Like the system prompt, the examples open the session once
+		if len(config.AppConfig.FewShotExamples) > 0 {
+			longCatReq.Content = formatTranscript(withFewShot([]types.Message{{Role: "user", Content: content}}))
+		}
+		if system != "" {
+			longCatReq.Content = applySystemTemplate(system, longCatReq.Content)
+		}
+	}
+	return longCatReq, nil
+}
+
+// withInstruction appends an instruction to the prompt LongCat will answer
+func withInstruction(longCatReq *api.LongCatRequest, instruction string) {
+	longCatReq.Content += "\n\n" + instruction
+	if n := len(longCatReq.Messages); n > 0 {
+		longCatReq.Messages[n-1].Content += "\n\n" + instruction
+	}
+}
+
+// withFewShot prepends the FEWSHOT_EXAMPLES turns. They are added only to
+// what is sent to LongCat, never to the messages used for fingerprinting.
+func withFewShot(messages []types.Message) []types.Message {
+	if len(config.AppConfig.FewShotExamples) == 0 {
+		return messages
+	}
+	examples := make([]types.Message, 0, len(config.AppConfig.FewShotExamples)+len(messages))
+	for _, example := range config.AppConfig.FewShotExamples {
+		examples = append(examples, types.Message{Role: example.Role, Content: example.Content})
+	}
+	return append(examples, messages...)
+}
+
+// withSystemMessage prepends the system prompt as a system-role message
+func withSystemMessage(system string, messages []types.Message) []types.Message {
+	if system == "" {
+		return messages
+	}
+	return append([]types.Message{{Role: "system", Content: system}}, messages...)
+}
+
+// applySystemTemplate combines the system prompt with the first prompt of a
+// session using SYSTEM_PROMPT_TEMPLATE
+func applySystemTemplate(system, prompt string) string {
+	return strings.NewReplacer("{system}", system, "{prompt}", prompt).Replace(config.AppConfig.SystemTemplate)
+}
+
+// extractSystemPrompt returns the Claude system prompt, from either the string
+// or the text-block form of the system field
+func extractSystemPrompt(req *apiRequest) string {
+	if req.claude == nil {
+		return ""
+	}
+
+	switch system := req.claude.System.(type) {
+	case string:
+		return system
+	case []interface{}:
+		var parts []string
+		for _, item := range system {
+			if itemMap, ok := item.(map[string]interface{}); ok && itemMap["type"] == "text" {
+				if itemText, ok := itemMap["text"].(string); ok {
+					parts = append(parts, itemText)
+				}
+			}
+		}
+		return strings.Join(parts, "\n\n")
+	}
+	return ""
+}
+
+// toLongCatMessages maps OpenAI/Claude messages onto LongCat's message schema
+func toLongCatMessages(messages []types.Message) []api.LongCatMessage {
+	longCatMessages := make([]api.LongCatMessage, 0, len(messages))
+	for _, msg := range messages {
+		role := msg.Role
+		switch role {
+		case "system", "user", "assistant":
+		case "developer":
+			role = "system"
+		default:
+			role = "user"
+		}
+		longCatMessages = append(longCatMessages, api.LongCatMessage{Role: role, Content: namedContent(msg)})
+	}
+	return longCatMessages
+}
+
+// assistantPrefill returns the trailing assistant message a client sent to
+// prefill the reply, as supported by the Claude Messages API
+func assistantPrefill(messages []types.Message) string {
+	if len(messages) < 2 {
+		return ""
+	}
+	last, prev := messages[len(messages)-1], messages[len(messages)-2]
+	if last.Role != "assistant" || prev.Role != "user" {
+		return ""
+	}
+	return strings.TrimRight(last.Content, " \n")
+}
+
+// formatTranscript flattens the message history into a single prompt for
+// stateless sessions, since LongCat only accepts one content string per turn
+func formatTranscript(messages []types.Message) string {
+	if len(messages) == 1 {
+		return namedContent(messages[0])
+	}
+
+	var transcript strings.Builder
+	for i, msg := range messages {
+		if i > 0 {
+			transcript.WriteString("\n\n")
+		}
+		switch msg.Role {
+		case "assistant":
+			transcript.WriteString("Assistant: ")
+		case "system":
+			transcript.WriteString("System: ")
+		default:
+			transcript.WriteString("User: ")
+		}
+		transcript.WriteString(namedContent(msg))
+	}
+
+	return transcript.String()
+}
+
+// namedContent prefixes a named participant's message with its name so
+// LongCat can tell speakers apart
+func namedContent(msg types.Message) string {
+	if msg.Name == "" {
+		return msg.Content
+	}
+	return fmt.Sprintf("%s: %s", msg.Name, msg.Content)
 }
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/api"
+	"github.com/JessonChan/longcat-web-api/config"
+	conversation "github.com/JessonChan/longcat-web-api/convsersation"
+	"github.com/JessonChan/longcat-web-api/types"
+)
+
+// fakeLongCat stands in for LongCat's session and chat endpoints, answering
+// every turn with reply and reporting totalTokens of usage
+type fakeLongCat struct {
+	reply       string
+	totalTokens int
+	sessions    atomic.Int32
+	chats       atomic.Int32
+	lastChat    atomic.Value // Body of the latest chat request
+}
+
+func (f *fakeLongCat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if strings.HasSuffix(r.URL.Path, "/session-create") {
+		n := f.sessions.Add(1)
+		fmt.Fprintf(w, `{"code":0,"message":"ok","data":{"conversationId":"conv-%d"}}`, n)
+		return
+	}
+	f.chats.Add(1)
+	f.lastChat.Store(string(body))
+	frame, _ := json.Marshal(map[string]interface{}{
+		"content":       f.reply,
+		"contentStatus": "FINISHED",
+		"lastOne":       true,
+		"choices":       []interface{}{map[string]interface{}{"finishReason": "stop"}},
+		"tokenInfo": map[string]interface{}{
+			"promptTokens":     f.totalTokens / 2,
+			"completionTokens": f.totalTokens - f.totalTokens/2,
+			"totalTokens":      f.totalTokens,
+			"hasTokens":        true,
+		},
+	})
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprintf(w, "data:%s\n\n", frame)
+}
+
+// newTestGateway returns a gateway whose LongCat requests go to upstream
+func newTestGateway(t *testing.T, upstream http.Handler) *UnifiedHandler {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	saved := *config.AppConfig
+	t.Cleanup(func() { *config.AppConfig = saved })
+	config.AppConfig.LongCatAPIURL = server.URL + "/api/v1/chat-completion"
+	config.AppConfig.LongCatSessionURL = server.URL + "/api/v1/session-create"
+	config.AppConfig.SessionPoolSize = 0
+	return NewUnifiedHandler(false)
+}
+
+// mustParse decodes body as a request to path
+func mustParse(t *testing.T, body, path string) *apiRequest {
+	t.Helper()
+	req, err := parseAPIRequest([]byte(body), path)
+	if err != nil {
+		t.Fatalf("parseAPIRequest(%s): %v", body, err)
+	}
+	return req
+}
+
+// postJSON sends body to the gateway and returns the recorded response
+func postJSON(h http.Handler, path, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestExtractResponseSchema(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantSchema bool
+		wantErr    string
+	}{
+		{"no response_format", `{"messages": []}`, false, ""},
+		{"json_object", `{"response_format": {"type": "json_object"}}`, false, ""},
+		{"valid schema", `{"response_format": {"type": "json_schema", "json_schema": {"name": "a", "schema": {"type": "object"}}}}`, true, ""},
+		{"missing schema", `{"response_format": {"type": "json_schema", "json_schema": {"name": "a"}}}`, false, "Missing required parameter"},
+		{"cyclic ref", `{"response_format": {"type": "json_schema", "json_schema": {"name": "a", "schema": {"$ref": "#"}}}}`, false, `cyclic $ref "#"`},
+		{"unresolvable ref", `{"response_format": {"type": "json_schema", "json_schema": {"name": "a", "schema": {"$ref": "#/$defs/x"}}}}`, false, `unresolvable $ref "#/$defs/x"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := extractResponseSchema(mustParse(t, tt.body, "/v1/chat/completions"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractResponseSchema() error = %v, want it to mention %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractResponseSchema() error = %v", err)
+			}
+			if (format != nil) != tt.wantSchema {
+				t.Fatalf("extractResponseSchema() = %v, wantSchema %v", format, tt.wantSchema)
+			}
+		})
+	}
+}
+
+func TestAllowsParallelToolCalls(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+		want bool
+	}{
+		{"unset", "/v1/chat/completions", `{}`, true},
+		{"true", "/v1/chat/completions", `{"parallel_tool_calls": true}`, true},
+		{"false", "/v1/chat/completions", `{"parallel_tool_calls": false}`, false},
+		{"claude endpoint", "/v1/messages", `{"parallel_tool_calls": false}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowsParallelToolCalls(mustParse(t, tt.body, tt.path)); got != tt.want {
+				t.Fatalf("allowsParallelToolCalls() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMalformedRequestBody(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"openai messages not a list", "/v1/chat/completions", `{"model": "LongCat-Flash", "messages": "hi"}`},
+		{"claude max_tokens not a number", "/v1/messages", `{"model": "LongCat-Flash", "max_tokens": "10", "messages": []}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeLongCat{reply: "Sure."}
+			h := newTestGateway(t, upstream)
+
+			w := postJSON(h, tt.path, tt.body, nil)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Failed to parse request") {
+				t.Fatalf("status %d %s, want a 400 parse error", w.Code, w.Body)
+			}
+			if upstream.sessions.Load() != 0 || upstream.chats.Load() != 0 {
+				t.Errorf("malformed request reached LongCat")
+			}
+		})
+	}
+}
+
+func TestMaxConversationTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		thread bool // Continue via X-Conversation-ID rather than history matching
+	}{
+		{"history matching", false},
+		{"explicit thread", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeLongCat{reply: "Sure.", totalTokens: 40}
+			h := newTestGateway(t, upstream)
+			config.AppConfig.MaxConvTokens = 100
+
+			// Each turn replays the history, as chat clients do
+			history := []map[string]string{}
+			var header http.Header
+			turn := func() *httptest.ResponseRecorder {
+				history = append(history, map[string]string{"role": "user", "content": fmt.Sprintf("question %d", len(history)/2+1)})
+				body, _ := json.Marshal(map[string]interface{}{"model": "LongCat-Flash", "messages": history})
+				w := postJSON(h, "/v1/chat/completions", string(body), header)
+				history = append(history, map[string]string{"role": "assistant", "content": "Sure."})
+				return w
+			}
+
+			// 40, 80 and 120 tokens: the third turn still starts under the limit
+			var conversationID string
+			for i := 1; i <= 3; i++ {
+				w := turn()
+				if w.Code != http.StatusOK {
+					t.Fatalf("turn %d: status %d: %s", i, w.Code, w.Body)
+				}
+				if i == 1 {
+					conversationID = w.Header().Get("X-Conversation-ID")
+					if tt.thread {
+						header = http.Header{"X-Conversation-Id": {conversationID}}
+					}
+				} else if got := w.Header().Get("X-Conversation-ID"); got != conversationID {
+					t.Fatalf("turn %d continued %s, want %s", i, got, conversationID)
+				}
+			}
+			entry, _ := h.conversationManager.GetConversation(conversationID)
+			if entry.TokensUsed != 120 {
+				t.Fatalf("TokensUsed = %d after three turns, want 120", entry.TokensUsed)
+			}
+
+			sessions, chats := upstream.sessions.Load(), upstream.chats.Load()
+			w := turn()
+			if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "insufficient_quota") {
+				t.Fatalf("fourth turn: status %d %s, want 429 insufficient_quota", w.Code, w.Body)
+			}
+			if upstream.sessions.Load() != sessions || upstream.chats.Load() != chats {
+				t.Errorf("capped turn reached LongCat: sessions %d->%d, chats %d->%d",
+					sessions, upstream.sessions.Load(), chats, upstream.chats.Load())
+			}
+			after, _ := h.conversationManager.GetConversation(conversationID)
+			if len(after.Messages) != len(entry.Messages) {
+				t.Errorf("capped turn was recorded: %d messages, want %d", len(after.Messages), len(entry.Messages))
+			}
+		})
+	}
+}
+
+func TestExplicitThreadOwner(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		previous   bool   // Continue via previous_response_id rather than X-Conversation-ID
+		thread     string // Conversation to continue, "" for the one the owner started
+		wantStatus int
+	}{
+		{"owner by header", "sk-owner", false, "", http.StatusOK},
+		{"owner by response id", "sk-owner", true, "", http.StatusOK},
+		{"other key by header", "sk-other", false, "", http.StatusBadRequest},
+		{"other key by response id", "sk-other", true, "", http.StatusBadRequest},
+		{"unknown conversation", "sk-owner", false, "conv-made-up", http.StatusBadRequest},
+		{"unknown response id", "sk-owner", true, "chatcmpl-made-up", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeLongCat{reply: "Sure."}
+			h := newTestGateway(t, upstream)
+			config.AppConfig.APIKeys = []string{"sk-owner", "sk-other"}
+
+			first := postJSON(h, "/v1/chat/completions", `{"model": "LongCat-Flash", "messages": [{"role": "user", "content": "hi"}]}`,
+				http.Header{"Authorization": {"Bearer sk-owner"}})
+			if first.Code != http.StatusOK {
+				t.Fatalf("first turn: status %d: %s", first.Code, first.Body)
+			}
+			var resp struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(first.Body.Bytes(), &resp)
+			conversationID := first.Header().Get("X-Conversation-ID")
+
+			header := http.Header{"Authorization": {"Bearer " + tt.key}}
+			body := `{"model": "LongCat-Flash", "messages": [{"role": "user", "content": "more"}]}`
+			if tt.previous {
+				id := resp.ID
+				if tt.thread != "" {
+					id = tt.thread
+				}
+				body = fmt.Sprintf(`{"model": "LongCat-Flash", "previous_response_id": %q, "messages": [{"role": "user", "content": "more"}]}`, id)
+			} else if tt.thread != "" {
+				header.Set("X-Conversation-ID", tt.thread)
+			} else {
+				header.Set("X-Conversation-ID", conversationID)
+			}
+			chats := upstream.chats.Load()
+			w := postJSON(h, "/v1/chat/completions", body, header)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if got := w.Header().Get("X-Conversation-ID"); got != conversationID {
+					t.Fatalf("continued %s, want %s", got, conversationID)
+				}
+				return
+			}
+			if !strings.Contains(w.Body.String(), "conversation_not_found") {
+				t.Errorf("body = %s, want conversation_not_found", w.Body)
+			}
+			if upstream.chats.Load() != chats {
+				t.Errorf("refused turn reached LongCat")
+			}
+			if _, exists := h.conversationManager.GetConversation(tt.thread); tt.thread != "" && exists {
+				t.Errorf("refused turn recorded conversation %s", tt.thread)
+			}
+		})
+	}
+}
+
+// gatedLongCat answers like fakeLongCat, but holds each chat request until
+// the test sends on release
+type gatedLongCat struct {
+	fakeLongCat
+	started chan struct{} // Receives once per chat request reaching LongCat
+	release chan struct{} // Each send lets one held request answer; closing it lets them all
+	active  atomic.Int32
+	overlap atomic.Bool // Set when two chat requests were in flight at once
+}
+
+func (g *gatedLongCat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/session-create") {
+		if g.active.Add(1) > 1 {
+			g.overlap.Store(true)
+		}
+		defer g.active.Add(-1)
+		select {
+		case g.started <- struct{}{}:
+		case <-g.release:
+		}
+		<-g.release
+	}
+	g.fakeLongCat.ServeHTTP(w, r)
+}
+
+func TestConcurrentTurnsWaitBeforeRecording(t *testing.T) {
+	upstream := &gatedLongCat{fakeLongCat: fakeLongCat{reply: "Sure."}, started: make(chan struct{}), release: make(chan struct{})}
+	h := newTestGateway(t, upstream)
+	config.AppConfig.SerializeTurns = true
+	config.AppConfig.CancelPrevious = false
+	// Let turns still held upstream finish if the test fails early
+	t.Cleanup(func() { close(upstream.release) })
+
+	const conversationID = "conv-thread"
+	h.conversationManager.SetConversation("", []types.Message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "Sure."}}, conversationID)
+	h.conversationManager.SetOwner(conversationID, anonymousClient)
+	turn := func(content string) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			body := fmt.Sprintf(`{"model": "LongCat-Flash", "messages": [{"role": "user", "content": %q}]}`, content)
+			done <- postJSON(h, "/v1/chat/completions", body, http.Header{"X-Conversation-Id": {conversationID}})
+		}()
+		return done
+	}
+	recorded := func(content string) bool {
+		entry, _ := h.conversationManager.GetConversation(conversationID)
+		for _, message := range entry.Messages {
+			if message.Content == content {
+				return true
+			}
+		}
+		return false
+	}
+	holders := func() int {
+		shard := h.turnLocks.shard(conversationID)
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		if lock := shard.locks[conversationID]; lock != nil {
+			return lock.refs
+		}
+		return 0
+	}
+
+	first := turn("first")
+	<-upstream.started
+	second := turn("second")
+	for deadline := time.Now().Add(5 * time.Second); holders() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("second turn never waited for the conversation")
+		}
+	}
+	if recorded("second") {
+		t.Fatal("second turn changed the history while the first was in flight")
+	}
+
+	upstream.release <- struct{}{}
+	if w := <-first; w.Code != http.StatusOK {
+		t.Fatalf("first turn: status %d: %s", w.Code, w.Body)
+	}
+	<-upstream.started
+	if !recorded("second") {
+		t.Fatal("second turn reached LongCat without being recorded")
+	}
+	upstream.release <- struct{}{}
+	if w := <-second; w.Code != http.StatusOK {
+		t.Fatalf("second turn: status %d: %s", w.Code, w.Body)
+	}
+	if upstream.overlap.Load() {
+		t.Fatal("both turns reached LongCat at once")
+	}
+}
+
+func TestQueueStatsEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		debugKey   string
+		sentKey    string
+		wantStatus int
+	}{
+		{"disabled without DEBUG_API_KEY", "/admin/queue", "", "", http.StatusNotFound},
+		{"missing key", "/admin/queue", "secret", "", http.StatusUnauthorized},
+		{"wrong key", "/admin/queue", "secret", "guess", http.StatusUnauthorized},
+		{"debug key", "/admin/queue", "secret", "secret", http.StatusOK},
+		{"old path is gone", "/v1/queue", "secret", "secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestGateway(t, &fakeLongCat{})
+			config.AppConfig.DebugAPIKey = tt.debugKey
+			config.AppConfig.MaxConcurrent = 4
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.sentKey != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.sentKey)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var stats QueueStatsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+				t.Fatalf("body %q: %v", w.Body, err)
+			}
+			if stats.MaxConcurrent != 4 {
+				t.Errorf("max_concurrent = %d, want 4", stats.MaxConcurrent)
+			}
+		})
+	}
+}
+
+func TestStatelessReconstruction(t *testing.T) {
+	tests := []struct {
+		name        string
+		appendReply bool
+		want        bool // Whether the second turn sends LongCat the first reply
+	}{
+		{"missing reply is restored", true, true},
+		{"restoring disabled", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeLongCat{reply: "The capital is Paris."}
+			h := newTestGateway(t, upstream)
+			config.AppConfig.StatelessMode = true
+			config.AppConfig.StatelessAppend = tt.appendReply
+
+			if w := postJSON(h, "/v1/chat/completions", `{"messages": [{"role": "user", "content": "Capital of France?"}]}`, nil); w.Code != http.StatusOK {
+				t.Fatalf("first turn: status %d: %s", w.Code, w.Body)
+			}
+			// The client resends the history without the reply it received
+			if w := postJSON(h, "/v1/chat/completions", `{"messages": [{"role": "user", "content": "Capital of France?"}, {"role": "user", "content": "And of Italy?"}]}`, nil); w.Code != http.StatusOK {
+				t.Fatalf("second turn: status %d: %s", w.Code, w.Body)
+			}
+			if got := strings.Contains(upstream.lastChat.Load().(string), upstream.reply); got != tt.want {
+				t.Fatalf("second turn sent the first reply = %v, want %v: %s", got, tt.want, upstream.lastChat.Load())
+			}
+			if sessions := upstream.sessions.Load(); sessions != 2 {
+				t.Fatalf("created %d sessions, want one per stateless turn", sessions)
+			}
+		})
+	}
+}
+
+func TestCaptureAssistantMessagesStopsWhenCancelled(t *testing.T) {
+	chunks := make(chan interface{})
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		defer close(chunks)
+		for i := 0; i < 100; i++ {
+			chunks <- api.ChatCompletionChunk{Choices: []api.Choice{{Delta: api.Delta{Content: "x"}}}}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out, result := captureAssistantMessages(ctx, chunks)
+	<-out
+	// The reader is gone after the first chunk
+	cancel()
+
+	select {
+	case <-produced:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the producer is still blocked after the reader left")
+	}
+	select {
+	case <-result:
+	case <-time.After(2 * time.Second):
+		t.Fatal("captureAssistantMessages did not finish after the reader left")
+	}
+}
+
+func TestPeekChunksStopsWhenCancelled(t *testing.T) {
+	chunks := make(chan interface{})
+	errs := make(chan error)
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		defer close(chunks)
+		for i := 0; i < 100; i++ {
+			chunks <- api.ChatCompletionChunk{Choices: []api.Choice{{Delta: api.Delta{Content: "x"}}}}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out, _, _, empty := peekChunks(ctx, chunks, errs)
+	if empty {
+		t.Fatal("peekChunks reported an empty stream")
+	}
+	<-out
+	// The reader is gone after the first chunk
+	cancel()
+
+	select {
+	case <-produced:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the producer is still blocked after the reader left")
+	}
+	select {
+	case _, ok := <-out:
+		for ok {
+			_, ok = <-out
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("peekChunks did not close its channel after the reader left")
+	}
+}
+
+// endlessLongCat streams ever longer content until the gateway hangs up
+type endlessLongCat struct{}
+
+func (endlessLongCat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	if strings.HasSuffix(r.URL.Path, "/session-create") {
+		fmt.Fprint(w, `{"code":0,"message":"ok","data":{"conversationId":"conv-endless"}}`)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	var content strings.Builder
+	for i := 0; ; i++ {
+		content.WriteString("word ")
+		frame, _ := json.Marshal(map[string]interface{}{"content": content.String(), "contentStatus": "GENERATING", "messageId": 1})
+		if _, err := fmt.Fprintf(w, "data:%s\n\n", frame); err != nil {
+			return
+		}
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestCancelledStreamReleasesGoroutines(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		retries    int
+		exposeIDs  bool
+		maxSeconds int // When set, the gateway cuts the stream instead of the client
+		clientBody string
+	}{
+		{"openai", "/v1/chat/completions", 0, false, 0, `{"stream": true, "messages": [{"role": "user", "content": "Count"}]}`},
+		{"openai with empty retry", "/v1/chat/completions", 1, false, 0, `{"stream": true, "messages": [{"role": "user", "content": "Count"}]}`},
+		{"openai with LongCat IDs", "/v1/chat/completions", 1, true, 0, `{"stream": true, "messages": [{"role": "user", "content": "Count"}]}`},
+		{"claude with empty retry", "/v1/messages", 1, true, 0, `{"stream": true, "max_tokens": 100, "messages": [{"role": "user", "content": "Count"}]}`},
+		{"openai cut by the gateway", "/v1/chat/completions", 1, true, 1, `{"stream": true, "messages": [{"role": "user", "content": "Count"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestGateway(t, endlessLongCat{})
+			config.AppConfig.EmptyRetries = tt.retries
+			config.AppConfig.ExposeLongCatIDs = tt.exposeIDs
+			config.AppConfig.MaxStreamSeconds = tt.maxSeconds
+			gateway := httptest.NewServer(h)
+			defer gateway.Close()
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+			baseline := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			req, _ := http.NewRequestWithContext(ctx, http.MethodPost, gateway.URL+tt.path, strings.NewReader(tt.clientBody))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if tt.maxSeconds > 0 {
+				// The handler returns while LongCat is still streaming
+				io.Copy(io.Discard, resp.Body)
+			} else {
+				// Read part of the stream, then hang up mid-response
+				if _, err := io.ReadFull(resp.Body, make([]byte, 256)); err != nil {
+					t.Fatalf("reading the stream: %v", err)
+				}
+			}
+			cancel()
+			resp.Body.Close()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for runtime.NumGoroutine() > baseline {
+				if time.Now().After(deadline) {
+					buf := make([]byte, 1<<16)
+					t.Fatalf("%d goroutines remain, baseline %d:\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// The conversation fingerprint and the LongCat content are both derived from
+// the messages extractMessagesFromRequest returns, so two requests that send
+// LongCat the same prompt must also match the same conversation, whichever
+// endpoint and content representation they use
+func TestFingerprintFollowsLongCatContent(t *testing.T) {
+	const (
+		openAIPath = "/v1/chat/completions"
+		claudePath = "/v1/messages"
+	)
+	type request struct{ path, body string }
+	tests := []struct {
+		name     string
+		a, b     request
+		wantSame bool
+	}{
+		{
+			"openai string and text part",
+			request{openAIPath, `{"messages": [{"role": "user", "content": "Hello"}]}`},
+			request{openAIPath, `{"messages": [{"role": "user", "content": [{"type": "text", "text": "Hello"}]}]}`},
+			true,
+		},
+		{
+			"openai image parts are not sent",
+			request{openAIPath, `{"messages": [{"role": "user", "content": "Hello"}]}`},
+			request{openAIPath, `{"messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "data:,"}}, {"type": "text", "text": "Hello"}]}]}`},
+			true,
+		},
+		{
+			"openai system message is not sent",
+			request{openAIPath, `{"messages": [{"role": "user", "content": "Hello"}]}`},
+			request{openAIPath, `{"messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Hello"}]}`},
+			true,
+		},
+		{
+			"openai name is sent",
+			request{openAIPath, `{"messages": [{"role": "user", "content": "Hello"}]}`},
+			request{openAIPath, `{"messages": [{"role": "user", "name": "ada", "content": "Hello"}]}`},
+			false,
+		},
+		{
+			"claude string and text block",
+			request{claudePath, `{"messages": [{"role": "user", "content": "Hello"}]}`},
+			request{claudePath, `{"messages": [{"role": "user", "content": [{"type": "text", "text": "Hello"}]}]}`},
+			true,
+		},
+		{
+			"claude image blocks are not sent",
+			request{claudePath, `{"messages": [{"role": "user", "content": "Hello"}]}`},
+			request{claudePath, `{"messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": ""}}, {"type": "text", "text": "Hello"}]}]}`},
+			true,
+		},
+		{
+			"same prompt on both endpoints",
+			request{openAIPath, `{"messages": [{"role": "user", "content": [{"type": "text", "text": "Hello"}]}]}`},
+			request{claudePath, `{"messages": [{"role": "user", "content": [{"type": "text", "text": "Hello"}]}]}`},
+			true,
+		},
+		{
+			"different prompt",
+			request{openAIPath, `{"messages": [{"role": "user", "content": "Hello"}]}`},
+			request{claudePath, `{"messages": [{"role": "user", "content": "Hello!"}]}`},
+			false,
+		},
+	}
+	manager := conversation.NewConversationManager()
+	derive := func(t *testing.T, req request) (fingerprint, content string) {
+		t.Helper()
+		messages := extractMessagesFromRequest(mustParse(t, req.body, req.path))
+		longCatReq, err := createLongCatRequest(messages, "", "conv-1", false, 0)
+		if err != nil {
+			t.Fatalf("createLongCatRequest: %v", err)
+		}
+		return manager.GenerateFingerprint(messages), longCatReq.Content
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fingerprintA, contentA := derive(t, tt.a)
+			fingerprintB, contentB := derive(t, tt.b)
+			if contentA == "" || contentB == "" {
+				t.Fatalf("empty LongCat content: %q, %q", contentA, contentB)
+			}
+			if (contentA == contentB) != tt.wantSame {
+				t.Errorf("LongCat content %q and %q, want same = %v", contentA, contentB, tt.wantSame)
+			}
+			if (fingerprintA == fingerprintB) != tt.wantSame {
+				t.Errorf("fingerprints equal = %v, want %v", fingerprintA == fingerprintB, tt.wantSame)
+			}
+		})
+	}
+}
+
+func FuzzExtractMessages(f *testing.F) {
+	f.Add(`{"model":"gpt-4","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}],"max_tokens":10}`)
+	f.Add(`{"model":"claude","system":[{"type":"text","text":"be brief"}],"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}],"thinking":{"type":"enabled","budget_tokens":1024}}`)
+	f.Add(`{"messages":[{"role":"assistant","content":null,"tool_calls":[{"id":"1","type":"function","function":{"name":"f","arguments":"{}"}}]}]}`)
+	f.Add(`{"messages":"not a list"}`)
+	f.Fuzz(func(t *testing.T, body string) {
+		for _, path := range []string{"/v1/chat/completions", "/v1/messages"} {
+			req, err := parseAPIRequest([]byte(body), path)
+			if err != nil {
+				continue
+			}
+			if !json.Valid([]byte(body)) {
+				t.Fatalf("%s: parseAPIRequest accepted invalid JSON %q", path, body)
+			}
+			if messages := extractMessagesFromRequest(req); messages == nil {
+				t.Fatalf("%s: extractMessagesFromRequest(%q) = nil", path, body)
+			}
+			extractSystemPrompt(req)
+			extractMaxTokens(req)
+			extractReasonEnabled(req, false)
+		}
+	})
+}
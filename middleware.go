@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/JessonChan/longcat-web-api/api"
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
+)
+
+// middleware wraps a handler with one cross-cutting concern
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h so that the first middleware runs first
+func chain(h http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// corsPreflight answers CORS preflight requests for any path
+func corsPreflight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key, anthropic-version, anthropic-beta, X-Conversation-ID, X-New-Conversation, X-LongCat-Agent, traceparent, tracestate")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// headProbe lets clients probe an API endpoint without sending a request
+func headProbe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// requirePost rejects methods other than POST
+func requirePost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAPIKey rejects requests without a key listed in API_KEYS, when
+// the list is configured
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(config.AppConfig.APIKeys) > 0 && !allowedAPIKey(requestAPIKey(r)) {
+			writeAPIError(w, r.URL.Path, http.StatusUnauthorized, "invalid_api_key", "Invalid or missing API key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireJSON enforces checkContentType
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkContentType(r); err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusUnsupportedMediaType, "unsupported_media_type", err.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// traceContext carries the caller's W3C trace context, or a new one, through
+// to the LongCat calls
+func traceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := api.WithTraceContext(r.Context(), r.Header.Get("traceparent"), r.Header.Get("tracestate"))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// upstreamOverride optionally redirects the request's LongCat calls to the
+// upstream named in X-Upstream-URL
+func upstreamOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if override := r.Header.Get("X-Upstream-URL"); override != "" {
+			baseURL, err := parseUpstreamOverride(override)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid X-Upstream-URL: %v", err), http.StatusBadRequest)
+				return
+			}
+			logging.LogInfo("Routing request to upstream override %s", baseURL.Host)
+			r = r.WithContext(api.WithUpstreamOverride(r.Context(), baseURL))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
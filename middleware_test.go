@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+func TestRequireJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		wantStatus  int
+		wantType    string // error.type in the JSON body
+	}{
+		{"json", "/v1/chat/completions", "application/json; charset=utf-8", http.StatusOK, ""},
+		{"no content type", "/v1/chat/completions", "", http.StatusOK, ""},
+		{"openai text/plain", "/v1/chat/completions", "text/plain", http.StatusUnsupportedMediaType, "invalid_request_error"},
+		{"claude form", "/v1/messages", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType, "invalid_request_error"},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader("{}"))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			requireJSON(next).ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantType == "" {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var body struct {
+				Type  string `json:"type"`
+				Error struct {
+					Type    string `json:"type"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not JSON: %v", w.Body, err)
+			}
+			if body.Error.Type != tt.wantType || !strings.Contains(body.Error.Message, tt.contentType) {
+				t.Errorf("error = %+v, want type %s naming %q", body.Error, tt.wantType, tt.contentType)
+			}
+			if tt.path == "/v1/messages" && body.Type != "error" {
+				t.Errorf("Claude error body type = %q, want error", body.Type)
+			}
+		})
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		keys       []string
+		header     string
+		value      string
+		wantStatus int
+		wantType   string // error.type in the JSON body
+	}{
+		{"no allowlist", "/v1/chat/completions", nil, "", "", http.StatusOK, ""},
+		{"listed bearer token", "/v1/chat/completions", []string{"sk-a", "sk-b"}, "Authorization", "Bearer sk-b", http.StatusOK, ""},
+		{"listed x-api-key", "/v1/messages", []string{"sk-a"}, "x-api-key", "sk-a", http.StatusOK, ""},
+		{"missing key", "/v1/chat/completions", []string{"sk-a"}, "", "", http.StatusUnauthorized, "invalid_request_error"},
+		{"unlisted key", "/v1/messages", []string{"sk-a"}, "x-api-key", "sk-z", http.StatusUnauthorized, "authentication_error"},
+	}
+	saved := config.AppConfig.APIKeys
+	defer func() { config.AppConfig.APIKeys = saved }()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.APIKeys = tt.keys
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader("{}"))
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			requireAPIKey(next).ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantType == "" {
+				return
+			}
+			var body struct {
+				Error struct {
+					Type string `json:"type"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Type != tt.wantType {
+				t.Fatalf("body %q, want error type %s", w.Body, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestAPIChainOrder(t *testing.T) {
+	const stream = `{"model": "LongCat-Flash", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`
+	tests := []struct {
+		name       string
+		key        string
+		header     http.Header
+		body       string
+		wantStatus int
+	}{
+		// The anonymous stream slot and the only upstream slot are both taken,
+		// so a stage running too late shows up as 429 or a request that never
+		// gets an answer
+		{"auth before stream limit", "sk-unlisted", nil, stream, http.StatusUnauthorized},
+		{"body before stream limit", "sk-a", nil, `{"messages": "hi", "stream": true}`, http.StatusBadRequest},
+		{"model before stream limit", "sk-a", nil, `{"model": "gpt-x", "stream": true, "messages": []}`, http.StatusNotFound},
+		{"options before stream limit", "sk-a", nil, `{"model": "LongCat-Flash", "stream": true, "n": 2, "messages": []}`, http.StatusBadRequest},
+		{"stream limit before queue", "sk-b", nil, stream, http.StatusTooManyRequests},
+		{"thread before queue", "sk-a", http.Header{"X-Conversation-Id": {"conv-made-up"}}, `{"model": "LongCat-Flash", "messages": []}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeLongCat{reply: "Sure."}
+			h := newTestGateway(t, upstream)
+			config.AppConfig.APIKeys = []string{"sk-a", "sk-b"}
+			config.AppConfig.AllowedModels = []string{"LongCat-Flash"}
+			config.AppConfig.MaxStreamsPerKey = 1
+			h.queue = newFairQueue(1)
+			releaseSlot, _ := h.queue.Acquire(context.Background(), "busy")
+			defer releaseSlot()
+			busy := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			busy.Header.Set("Authorization", "Bearer sk-b")
+			for _, key := range []string{anonymousClient, queueKey(busy)} {
+				releaseStream, _ := h.keyStreams.acquire(key)
+				defer releaseStream()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body)).WithContext(ctx)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if ctx.Err() != nil {
+				t.Fatalf("request waited in the queue instead of being answered with %d", tt.wantStatus)
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if upstream.sessions.Load() != 0 || upstream.chats.Load() != 0 {
+				t.Errorf("refused request reached LongCat")
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
+)
+
+// mirrorQueueSize bounds the records waiting for the MIRROR_URL sink; more
+// are dropped rather than held in memory
+const mirrorQueueSize = 256
+
+// mirrorRedactedFields are request body fields whose values never leave the
+// gateway, at any depth
+var mirrorRedactedFields = map[string]bool{
+	"api_key":       true,
+	"apikey":        true,
+	"access_token":  true,
+	"authorization": true,
+	"password":      true,
+	"secret":        true,
+}
+
+// requestMirror posts a sampled fraction of completed requests and their
+// responses to MIRROR_URL, for evaluation and analytics. Posting happens on
+// a background worker and never delays the client.
+type requestMirror struct {
+	client  *http.Client
+	records chan MirrorRecord
+}
+
+// MirrorRecord is the JSON body posted to MIRROR_URL
+type MirrorRecord struct {
+	RequestID string          `json:"request_id"`
+	Endpoint  string          `json:"endpoint"`
+	Model     string          `json:"model"`
+	Stream    bool            `json:"stream"`
+	Client    string          `json:"client"` // Hashed API key, as in /admin/queue
+	Request   json.RawMessage `json:"request"`
+	Response  string          `json:"response"`
+	Usage     MirrorUsage     `json:"usage"`
+	LatencyMs int64           `json:"latency_ms"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+type MirrorUsage struct {
+	PromptTokens     int  `json:"prompt_tokens"`
+	CompletionTokens int  `json:"completion_tokens"`
+	TotalTokens      int  `json:"total_tokens"`
+	Reported         bool `json:"reported"` // False when LongCat sent no counts
+}
+
+func newRequestMirror() *requestMirror {
+	m := &requestMirror{client: &http.Client{Timeout: 10 * time.Second}}
+	if config.AppConfig.MirrorURL != "" {
+		m.records = make(chan MirrorRecord, mirrorQueueSize)
+		go m.run()
+	}
+	return m
+}
+
+// mirroredRequest is what serveAPI knows about a sampled request
+type mirroredRequest struct {
+	record  MirrorRecord
+	started time.Time
+}
+
+type mirroredRequestKey struct{}
+
+// sample returns ctx marked for mirroring when MIRROR_URL is set and the
+// request falls within MIRROR_SAMPLE_RATE
+func (m *requestMirror) sample(ctx context.Context, r *http.Request, requestID, model string, stream bool, body []byte) context.Context {
+	if m.records == nil || rand.Float64() >= config.AppConfig.MirrorSampleRate {
+		return ctx
+	}
+	return context.WithValue(ctx, mirroredRequestKey{}, &mirroredRequest{
+		record: MirrorRecord{
+			RequestID: requestID,
+			Endpoint:  r.URL.Path,
+			Model:     model,
+			Stream:    stream,
+			Client:    queueKey(r),
+			Request:   redactJSON(body),
+		},
+		started: time.Now(),
+	})
+}
+
+// send queues the completed turn of a sampled request, dropping it when the
+// sink has fallen behind
+func (m *requestMirror) send(ctx context.Context, turn assistantTurn) {
+	mirrored, ok := ctx.Value(mirroredRequestKey{}).(*mirroredRequest)
+	if !ok {
+		return
+	}
+	record := mirrored.record
+	if len(turn.messages) > 0 {
+		record.Response = turn.messages[0].Content
+	}
+	record.Usage = MirrorUsage{
+		PromptTokens:     turn.usage.PromptTokens,
+		CompletionTokens: turn.usage.CompletionTokens,
+		TotalTokens:      turn.usage.TotalTokens,
+		Reported:         turn.usage.HasTokens,
+	}
+	record.LatencyMs = time.Since(mirrored.started).Milliseconds()
+	record.Timestamp = time.Now()
+
+	select {
+	case m.records <- record:
+	default:
+		logging.LogDebug("Mirror queue full, dropping request %s", record.RequestID)
+	}
+}
+
+// run posts queued records one at a time
+func (m *requestMirror) run() {
+	for record := range m.records {
+		body, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		resp, err := m.client.Post(config.AppConfig.MirrorURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logging.LogDebug("Failed to mirror request %s: %v", record.RequestID, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logging.LogDebug("Mirror sink answered %s for request %s", resp.Status, record.RequestID)
+		}
+	}
+}
+
+// redactJSON returns body with the values of mirrorRedactedFields replaced
+func redactJSON(body []byte) json.RawMessage {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil
+	}
+	redacted, _ := json.Marshal(redactValue(value))
+	return redacted
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if mirrorRedactedFields[strings.ToLower(key)] {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return value
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// wantsNDJSON reports whether the client asked for newline-delimited JSON
+// instead of SSE framing
+func wantsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// ndjsonWriter rewrites the SSE events written by the services as one bare
+// JSON object per line. Event names, IDs, comments and the [DONE] marker are
+// dropped; the last object is the one carrying the finish reason.
+type ndjsonWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+	pending []byte // partial event not yet terminated by a blank line
+}
+
+func (w *ndjsonWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		end := bytes.Index(w.pending, []byte("\n\n"))
+		if end < 0 {
+			break
+		}
+		frame := w.pending[:end]
+
+		var data [][]byte
+		for _, line := range bytes.Split(frame, []byte("\n")) {
+			if value, ok := bytes.CutPrefix(line, []byte("data: ")); ok {
+				data = append(data, value)
+			}
+		}
+		w.pending = w.pending[end+2:]
+
+		object := bytes.Join(data, []byte("\n"))
+		if len(object) == 0 || string(object) == "[DONE]" {
+			continue
+		}
+		if _, err := w.ResponseWriter.Write(append(object, '\n')); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *ndjsonWriter) Flush() {
+	w.flusher.Flush()
+}
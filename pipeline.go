@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/api"
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
+	"github.com/JessonChan/longcat-web-api/types"
+)
+
+// apiCall carries one API request through the stages of the API chain.
+// readRequest creates it; each later stage reads what the earlier ones
+// decided and fills in its own part.
+type apiCall struct {
+	body       []byte
+	req        *apiRequest
+	responseID string
+	service    api.APIService
+	streaming  bool
+
+	model    string
+	defaults config.ModelDefault
+	agent    string
+
+	reasonEnabled int
+	searchEnabled int
+	maxTokens     int
+	schema        *api.JSONSchemaFormat
+
+	messages []types.Message
+
+	threadID       string // Conversation the client named explicitly, if any
+	conversationID string
+	newSession     bool
+}
+
+type apiCallKey struct{}
+
+func withAPICall(ctx context.Context, call *apiCall) context.Context {
+	return context.WithValue(ctx, apiCallKey{}, call)
+}
+
+// apiCallFrom returns the call readRequest stored for the request
+func apiCallFrom(ctx context.Context) *apiCall {
+	call, _ := ctx.Value(apiCallKey{}).(*apiCall)
+	return call
+}
+
+// readRequest reads and decodes the request body and starts its apiCall
+func (h *UnifiedHandler) readRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, errBs := io.ReadAll(r.Body)
+		if errBs != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", errBs), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(bs))
+		// READ_TIMEOUT_SECONDS covers reading the request; a read deadline left
+		// in place would cancel the request while LongCat is still answering
+		if config.AppConfig.ReadTimeout > 0 {
+			if err := http.NewResponseController(w).SetReadDeadline(time.Time{}); err != nil {
+				logging.LogDebug("Cannot lift the read deadline: %v", err)
+			}
+		}
+
+		// The response ID doubles as the request ID that decides body logging
+		call := &apiCall{body: bs, responseID: api.NewChatCompletionID(), service: h.openAIService}
+		if r.URL.Path == "/v1/messages" {
+			call.responseID = api.NewMessageID()
+			call.service = h.claudeService
+		}
+		ctx := logging.WithRequestID(r.Context(), call.responseID)
+		logging.LogBody(ctx, "Request Body: %s %s", string(bs), r.URL.Path)
+		req, err := parseAPIRequest(bs, r.URL.Path)
+		if err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusBadRequest, "invalid_json", fmt.Sprintf("Failed to parse request: %v", err))
+			return
+		}
+		call.req = req
+		call.streaming = h.isStreamingRequest(req)
+		next.ServeHTTP(w, r.WithContext(withAPICall(ctx, call)))
+	})
+}
+
+// selectModel maps model aliases and enforces ALLOWED_MODELS before doing
+// any upstream work, then picks the model's defaults and LongCat agent
+func (h *UnifiedHandler) selectModel(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCallFrom(r.Context())
+		call.model = extractModel(call.req)
+		if err := checkModel(call.model); err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusNotFound, "model_not_found", err.Error())
+			return
+		}
+		if call.model != "" {
+			r = r.WithContext(api.WithModel(r.Context(), call.model))
+		}
+		// MODEL_DEFAULTS lets several model names behave differently on one LongCat endpoint
+		call.defaults = config.AppConfig.ModelDefaults[call.model]
+		// X-LongCat-Agent overrides the model's LongCat agent for one request
+		call.agent = call.defaults.Agent
+		if header := strings.TrimSpace(r.Header.Get("X-LongCat-Agent")); header != "" {
+			call.agent = header
+		}
+		if call.agent != "" {
+			r = r.WithContext(api.WithAgent(r.Context(), call.agent))
+		}
+		if r.URL.Path == "/v1/messages" {
+			if betas := h.acceptedBetas(r); len(betas) > 0 {
+				r = r.WithContext(api.WithBetas(r.Context(), betas))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkOptions validates the request's output options, such as modalities,
+// max_tokens and reasoning_effort, and resolves the LongCat flags they map to
+func checkOptions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCallFrom(r.Context())
+		if err := checkModalities(call.req); err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusBadRequest, "unsupported_value", err.Error())
+			return
+		}
+		if err := checkMaxTokens(call.req); err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusBadRequest, "invalid_value", err.Error())
+			return
+		}
+		if err := checkChoiceCount(call.req); err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusBadRequest, "invalid_value", err.Error())
+			return
+		}
+		logIgnoredSampling(call.req)
+		reasonEnabled, err := extractReasonEnabled(call.req, call.defaults.Reasoning)
+		if err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusBadRequest, "invalid_value", err.Error())
+			return
+		}
+		searchEnabled := 0
+		if call.defaults.Search {
+			searchEnabled = 1
+		}
+		if err := applyQueryOverrides(r.URL.Query(), &reasonEnabled, &searchEnabled); err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusBadRequest, "invalid_value", err.Error())
+			return
+		}
+		call.reasonEnabled, call.searchEnabled = reasonEnabled, searchEnabled
+		call.maxTokens = resolveMaxTokens(extractMaxTokens(call.req), call.defaults.MaxTokens)
+		if includesReasoning(call.req) {
+			r = r.WithContext(api.WithReasoningField(r.Context(), config.AppConfig.ReasoningField))
+		}
+		if extractIncludeUsage(call.req) {
+			r = r.WithContext(api.WithIncludeUsage(r.Context()))
+		}
+		if !allowsParallelToolCalls(call.req) {
+			r = r.WithContext(api.WithSerialToolCalls(r.Context()))
+		}
+		call.schema, err = extractResponseSchema(call.req)
+		if err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusBadRequest, "invalid_value", err.Error())
+			return
+		}
+		if call.schema != nil {
+			r = r.WithContext(api.WithResponseSchema(r.Context(), call.schema))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// screenPrompt extracts the messages of the request, applies
+// PROMPT_TRANSFORM_FILE and rejects prompts matching the content policy
+func (h *UnifiedHandler) screenPrompt(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCallFrom(r.Context())
+		// Extract messages from request to generate fingerprint
+		call.messages = extractMessagesFromRequest(call.req)
+		// PROMPT_TRANSFORM_FILE rewrites user messages before anything else sees them
+		if err := h.transform.apply(call.messages, r, call.model, extractMetadata(call.req)); err != nil {
+			logging.LogInfo("Prompt transform failed: %v", err)
+			writeAPIError(w, r.URL.Path, http.StatusInternalServerError, "transform_error", "The prompt transform template failed for this request.")
+			return
+		}
+		if category := h.policy.check(call.messages); category != "" {
+			logging.LogInfo("Rejected request matching content policy %q", category)
+			writeAPIError(w, r.URL.Path, http.StatusBadRequest, "content_policy_violation", "Your request was rejected by the content policy.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitStreams holds each API key to MAX_STREAMS_PER_KEY streams, counting
+// those still waiting for an upstream slot, and makes the streams of keys
+// from API_KEYS abortable. The count follows queueKey, so clients without a
+// key from API_KEYS share one limit however many keys they make up.
+func (h *UnifiedHandler) limitStreams(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCallFrom(r.Context())
+		if !call.streaming {
+			next.ServeHTTP(w, r)
+			return
+		}
+		release, ok := h.keyStreams.acquire(queueKey(r))
+		if !ok {
+			writeAPIError(w, r.URL.Path, http.StatusTooManyRequests, "streams_exhausted",
+				fmt.Sprintf("Too many concurrent streams for this API key; the limit is %d.", config.AppConfig.MaxStreamsPerKey))
+			return
+		}
+		defer release()
+
+		// DELETE /v1/chat/completions/{id} or /v1/messages/{id} aborts the
+		// stream; anonymous clients cannot be told apart, so theirs is not
+		// abortable
+		if key := queueKey(r); key != anonymousClient {
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
+			defer h.aborts.track(call.responseID, key, cancel)()
+			r = r.WithContext(ctx)
+		}
+		w.Header().Set("X-Response-ID", call.responseID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mirrorRequests marks a sample of requests for MIRROR_URL, which receives
+// them once they complete
+func (h *UnifiedHandler) mirrorRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCallFrom(r.Context())
+		next.ServeHTTP(w, r.WithContext(h.mirror.sample(r.Context(), r, call.responseID, call.model, call.streaming, call.body)))
+	})
+}
+
+// continueThread resolves the conversation named by X-Conversation-ID or
+// previous_response_id. An explicit thread ID bypasses fingerprint matching.
+func (h *UnifiedHandler) continueThread(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCallFrom(r.Context())
+		threadID, err := h.resolveThread(r, call.req)
+		if err != nil {
+			writeAPIError(w, r.URL.Path, http.StatusBadRequest, "conversation_not_found", err.Error())
+			return
+		}
+		call.threadID = threadID
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveFromCache answers repeated single-turn prompts from
+// RESPONSE_CACHE_TTL without touching LongCat
+func (h *UnifiedHandler) serveFromCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.cache.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		call := apiCallFrom(r.Context())
+		cacheKey := ""
+		if call.threadID == "" && call.schema == nil {
+			cacheKey = responseCacheKey(call.messages, extractSystemPrompt(call.req), call.model, call.agent, call.maxTokens, call.reasonEnabled, call.searchEnabled)
+		}
+		if cached, ok := h.cache.get(cacheKey); ok {
+			h.stats.cacheHits.Add(1)
+			w.Header().Set("X-Cache", "HIT")
+			r = r.WithContext(withCachedResponse(api.WithResponseID(r.Context(), call.responseID), cached))
+			if call.streaming {
+				h.handleStreaming(w, r, call.service, api.LongCatRequest{})
+			} else {
+				h.handleNonStreaming(w, r, call.service, api.LongCatRequest{})
+			}
+			return
+		}
+		if cacheKey != "" {
+			h.stats.cacheMisses.Add(1)
+			r = r.WithContext(withResponseCacheKey(r.Context(), cacheKey))
+		}
+		w.Header().Set("X-Cache", "MISS")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lockConversation works out which conversation the turn continues, or
+// starts a LongCat session for it, and holds that conversation for the rest
+// of the chain: nothing may change its history before the lock is taken
+func (h *UnifiedHandler) lockConversation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCallFrom(r.Context())
+		// X-New-Conversation: true always starts a fresh LongCat session, like a
+		// "new chat" button, even when the history matches an earlier one
+		reset := strings.EqualFold(r.Header.Get("X-New-Conversation"), "true")
+		if !statelessTurns() && !reset {
+			call.conversationID = call.threadID
+			if call.conversationID == "" {
+				call.conversationID, _ = h.findConversation(call.agent, call.messages, queueKey(r))
+			}
+		}
+
+		// Stop conversations that have spent their MAX_CONVERSATION_TOKENS
+		// budget, before the turn is recorded or a session is created for it
+		if limit := config.AppConfig.MaxConvTokens; limit > 0 && call.conversationID != "" {
+			if entry, exists := h.conversationManager.GetConversation(call.conversationID); exists && entry.TokensUsed >= limit {
+				logging.LogInfo("Conversation %s has used %d of %d tokens", call.conversationID, entry.TokensUsed, limit)
+				writeAPIError(w, r.URL.Path, http.StatusTooManyRequests, "insufficient_quota",
+					fmt.Sprintf("Conversation %s has used %d tokens, reaching its limit of %d.", call.conversationID, entry.TokensUsed, limit))
+				return
+			}
+		}
+
+		// The system prompt only needs to reach LongCat once per session
+		call.newSession = call.conversationID == ""
+		if call.newSession {
+			// Stateless turns get a fresh LongCat session carrying the full history
+			if statelessTurns() && config.AppConfig.StatelessAppend {
+				call.messages = h.conversationManager.ReconstructHistory(call.agent, call.messages)
+			}
+			newConvID, err := h.longCatClient.NewSession(r.Context())
+			if err != nil {
+				h.stats.upstreamErrors.Add(1)
+				writeUpstreamError(w, r.URL.Path, fmt.Errorf("Failed to create session: %w", err))
+				return
+			}
+			call.conversationID = newConvID
+		}
+
+		// A new turn replaces one still running on the same conversation
+		if config.AppConfig.CancelPrevious {
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
+			defer h.inflight.begin(call.conversationID, cancel)()
+			r = r.WithContext(ctx)
+		}
+
+		// Turns on one LongCat conversation must not interleave, so wait for
+		// the one in flight before recording this turn in the history
+		if config.AppConfig.SerializeTurns {
+			unlock, err := h.turnLocks.Lock(r.Context(), call.conversationID)
+			if err != nil {
+				logging.LogDebug("Request for conversation %s gave up waiting for its turn: %v", call.conversationID, err)
+				return
+			}
+			defer unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// waitForSlot waits for an upstream slot, taking turns with other API keys
+func (h *UnifiedHandler) waitForSlot(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := queueKey(r)
+		release, err := h.queue.Acquire(r.Context(), key)
+		if err != nil {
+			logging.LogDebug("Request for %s left the queue: %v", key, err)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statelessTurns reports whether every turn gets a fresh LongCat session
+// carrying the full history, under STATELESS_MODE or FORWARD_MESSAGES
+func statelessTurns() bool {
+	return config.AppConfig.StatelessMode || config.AppConfig.ForwardMessages
+}
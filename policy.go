@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"sort"
+
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/types"
+)
+
+// contentPolicy rejects prompts matching CONTENT_DENYLIST before they reach
+// LongCat. Messages matching a CONTENT_ALLOWLIST pattern are exempt.
+type contentPolicy struct {
+	deny  []policyRule
+	allow []*regexp.Regexp
+}
+
+type policyRule struct {
+	category string
+	pattern  *regexp.Regexp
+}
+
+// newContentPolicy compiles the configured patterns, exiting on invalid ones
+// so a typo cannot silently disable the policy
+func newContentPolicy() *contentPolicy {
+	policy := &contentPolicy{}
+	for category, pattern := range config.AppConfig.ContentDenylist {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("Invalid CONTENT_DENYLIST pattern for %s: %v", category, err)
+		}
+		policy.deny = append(policy.deny, policyRule{category: category, pattern: re})
+	}
+	// Map order is random; keep the reported category stable
+	sort.Slice(policy.deny, func(i, j int) bool { return policy.deny[i].category < policy.deny[j].category })
+
+	for _, pattern := range config.AppConfig.ContentAllowlist {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("Invalid CONTENT_ALLOWLIST pattern: %v", err)
+		}
+		policy.allow = append(policy.allow, re)
+	}
+	return policy
+}
+
+// check returns the category of the first denylist pattern matched by a
+// user message, or "" when the request is allowed
+func (p *contentPolicy) check(messages []types.Message) string {
+	if len(p.deny) == 0 {
+		return ""
+	}
+	for _, msg := range messages {
+		if msg.Role != "user" || p.allowed(msg.Content) {
+			continue
+		}
+		for _, rule := range p.deny {
+			if rule.pattern.MatchString(msg.Content) {
+				return rule.category
+			}
+		}
+	}
+	return ""
+}
+
+func (p *contentPolicy) allowed(content string) bool {
+	for _, re := range p.allow {
+		if re.MatchString(content) {
+			return true
+		}
+	}
+	return false
+}
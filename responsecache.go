@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/api"
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/types"
+)
+
+// responseCache keeps completed answers to single-turn prompts for
+// RESPONSE_CACHE_TTL seconds, so FAQ-style deployments answer repeated
+// questions without calling LongCat
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+// cachedResponse is a stored answer, replayed through api.CachedResponse
+type cachedResponse struct {
+	content string
+	usage   api.TokenInfo
+	expires time.Time
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: make(map[string]cachedResponse)}
+}
+
+func (c *responseCache) enabled() bool {
+	return config.AppConfig.ResponseCacheTTL > 0
+}
+
+// responseCacheKey returns the cache key for a prompt, or "" when the
+// request is not a single user message. The prompt is compared with its
+// whitespace collapsed; everything else that shapes the answer is part of
+// the key as is.
+func responseCacheKey(messages []types.Message, system, model, agent string, maxTokens, reasonEnabled, searchEnabled int) string {
+	if len(messages) != 1 || messages[0].Role != "user" {
+		return ""
+	}
+	key, _ := json.Marshal([]interface{}{
+		strings.Join(strings.Fields(messages[0].Content), " "),
+		messages[0].Name,
+		strings.Join(strings.Fields(system), " "),
+		model,
+		agent,
+		maxTokens,
+		reasonEnabled,
+		searchEnabled,
+	})
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the unexpired answer stored under key
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	if key == "" {
+		return cachedResponse{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return cachedResponse{}, false
+	}
+	return entry, true
+}
+
+// store saves a completed turn under the cache key of ctx, if any. When the
+// cache is full, expired answers are dropped first and then the one closest
+// to expiring.
+func (c *responseCache) store(ctx context.Context, turn assistantTurn) {
+	key := responseCacheKeyFrom(ctx)
+	// A partial answer is not what the prompt would get next time
+	if key == "" || len(turn.messages) == 0 || turn.partial {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= config.AppConfig.ResponseCacheSize {
+		oldest := ""
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			} else if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if oldest != "" && len(c.entries) >= config.AppConfig.ResponseCacheSize {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = cachedResponse{
+		content: turn.messages[0].Content,
+		usage:   turn.usage,
+		expires: now.Add(time.Duration(config.AppConfig.ResponseCacheTTL) * time.Second),
+	}
+}
+
+type responseCacheKeyKey struct{}
+
+// withResponseCacheKey marks a request whose answer should be cached
+func withResponseCacheKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, responseCacheKeyKey{}, key)
+}
+
+func responseCacheKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(responseCacheKeyKey{}).(string)
+	return key
+}
+
+type cachedResponseKey struct{}
+
+// withCachedResponse makes startResponse replay cached instead of calling
+// LongCat
+func withCachedResponse(ctx context.Context, cached cachedResponse) context.Context {
+	return context.WithValue(ctx, cachedResponseKey{}, cached)
+}
+
+func cachedResponseFrom(ctx context.Context) (cachedResponse, bool) {
+	cached, ok := ctx.Value(cachedResponseKey{}).(cachedResponse)
+	return cached, ok
+}
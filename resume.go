@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
+)
+
+// bufferedEvent is one SSE frame as it was written to the client
+type bufferedEvent struct {
+	id    int
+	frame []byte
+}
+
+// streamBuffer records the events of one streaming response so a client that
+// drops can reconnect with Last-Event-ID and pick up where it left off
+type streamBuffer struct {
+	mu          sync.Mutex
+	owner       string // queueKey of the client that started the stream
+	contentType string
+	events      []bufferedEvent
+	size        int
+	dropped     int // highest event ID evicted to stay under the size limit
+	done        bool
+	notify      chan struct{} // closed and replaced whenever the buffer changes
+	pending     []byte        // partial frame not yet terminated by a blank line
+}
+
+// record splits written bytes into SSE frames and stores those carrying an ID
+func (b *streamBuffer) record(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, p...)
+	changed := false
+	for {
+		end := bytes.Index(b.pending, []byte("\n\n"))
+		if end < 0 {
+			break
+		}
+		frame := append([]byte(nil), b.pending[:end+2]...)
+		b.pending = b.pending[end+2:]
+
+		idLine, _, _ := bytes.Cut(frame, []byte("\n"))
+		value, ok := bytes.CutPrefix(idLine, []byte("id: "))
+		if !ok {
+			continue
+		}
+		id, err := strconv.Atoi(string(value))
+		if err != nil {
+			continue
+		}
+		b.events = append(b.events, bufferedEvent{id: id, frame: frame})
+		b.size += len(frame)
+		changed = true
+
+		// Evict the oldest events once the buffer is over its limit
+		for b.size > config.AppConfig.ResumeMaxBytes && len(b.events) > 1 {
+			b.size -= len(b.events[0].frame)
+			b.dropped = b.events[0].id
+			b.events = b.events[1:]
+		}
+	}
+	if changed {
+		close(b.notify)
+		b.notify = make(chan struct{})
+	}
+}
+
+// finish marks the stream as complete and wakes any resumed readers
+func (b *streamBuffer) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.done = true
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// after returns the events following lastID along with the stream state
+func (b *streamBuffer) after(lastID int) (events []bufferedEvent, done bool, notify <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, event := range b.events {
+		if event.id > lastID {
+			events = append(events, event)
+		}
+	}
+	return events, b.done, b.notify
+}
+
+// streamBuffers holds the buffers of recent streaming responses by response ID
+type streamBuffers struct {
+	mu      sync.Mutex
+	buffers map[string]*streamBuffer
+}
+
+func newStreamBuffers() *streamBuffers {
+	return &streamBuffers{buffers: make(map[string]*streamBuffer)}
+}
+
+// start creates the buffer for a new streaming response started by owner
+func (s *streamBuffers) start(responseID, owner, contentType string) *streamBuffer {
+	buf := &streamBuffer{owner: owner, contentType: contentType, notify: make(chan struct{})}
+
+	s.mu.Lock()
+	s.buffers[responseID] = buf
+	s.mu.Unlock()
+	return buf
+}
+
+// finish completes a buffer and evicts it after the resume grace period
+func (s *streamBuffers) finish(responseID string, buf *streamBuffer) {
+	buf.finish()
+	time.AfterFunc(time.Duration(config.AppConfig.ResumeSeconds)*time.Second, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.buffers[responseID] == buf {
+			delete(s.buffers, responseID)
+		}
+	})
+}
+
+func (s *streamBuffers) get(responseID string) (*streamBuffer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf, exists := s.buffers[responseID]
+	return buf, exists
+}
+
+// recordingWriter forwards writes to the client while recording them, and
+// keeps recording after the client has gone away
+type recordingWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+	buf     *streamBuffer
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.buf.record(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingWriter) Flush() {
+	w.flusher.Flush()
+}
+
+// handleStreamResume serves GET /v1/streams/{id}, replaying the events of a
+// buffered response after Last-Event-ID and then following it live. Only the
+// API key that started a stream can resume it; clients without a key from
+// API_KEYS share one identity, so their streams are never buffered.
+func (h *UnifiedHandler) handleStreamResume(w http.ResponseWriter, r *http.Request) {
+	responseID := strings.TrimPrefix(r.URL.Path, "/v1/streams/")
+	if config.AppConfig.ResumeSeconds <= 0 || responseID == "" || strings.Contains(responseID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner := queueKey(r)
+	if owner == anonymousClient {
+		writeAPIError(w, r.URL.Path, http.StatusUnauthorized, "invalid_api_key", "Resuming a stream requires an API key listed in API_KEYS")
+		return
+	}
+	buf, exists := h.streams.get(responseID)
+	if !exists || buf.owner != owner {
+		http.Error(w, fmt.Sprintf("Stream %s not found", responseID), http.StatusNotFound)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	lastID := 0
+	if lastEventID != "" {
+		id, err := strconv.Atoi(lastEventID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid Last-Event-ID: %s", lastEventID), http.StatusBadRequest)
+			return
+		}
+		lastID = id
+	}
+
+	buf.mu.Lock()
+	evicted := lastID < buf.dropped
+	buf.mu.Unlock()
+	if evicted {
+		http.Error(w, "Events after Last-Event-ID are no longer buffered", http.StatusGone)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", buf.contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	logging.LogInfo("Resuming stream %s after event %d", responseID, lastID)
+
+	for {
+		events, done, notify := buf.after(lastID)
+		for _, event := range events {
+			w.Write(event.frame)
+			lastID = event.id
+		}
+		flusher.Flush()
+		if done {
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
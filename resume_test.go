@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+func TestStreamResumeOwner(t *testing.T) {
+	savedSeconds, savedBytes := config.AppConfig.ResumeSeconds, config.AppConfig.ResumeMaxBytes
+	config.AppConfig.ResumeSeconds, config.AppConfig.ResumeMaxBytes = 60, 1<<20
+	defer func() { config.AppConfig.ResumeSeconds, config.AppConfig.ResumeMaxBytes = savedSeconds, savedBytes }()
+	savedKeys := config.AppConfig.APIKeys
+	config.AppConfig.APIKeys = []string{"sk-owner", "sk-other"}
+	defer func() { config.AppConfig.APIKeys = savedKeys }()
+
+	owner := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	owner.Header.Set("Authorization", "Bearer sk-owner")
+
+	h := &UnifiedHandler{streams: newStreamBuffers()}
+	buf := h.streams.start("chatcmpl-1", queueKey(owner), "text/event-stream")
+	buf.record([]byte("id: 1\ndata: {\"n\":1}\n\nid: 2\ndata: {\"n\":2}\n\n"))
+	buf.finish()
+
+	tests := []struct {
+		name       string
+		key        string
+		lastID     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"owner replays everything", "sk-owner", "", http.StatusOK, "id: 1\ndata: {\"n\":1}\n\nid: 2\ndata: {\"n\":2}\n\n"},
+		{"owner resumes after Last-Event-ID", "sk-owner", "1", http.StatusOK, "id: 2\ndata: {\"n\":2}\n\n"},
+		{"other key", "sk-other", "", http.StatusNotFound, ""},
+		{"no key", "", "", http.StatusUnauthorized, ""},
+		{"unlisted key", "sk-guess", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/streams/chatcmpl-1", nil)
+			if tt.key != "" {
+				req.Header.Set("x-api-key", tt.key)
+			}
+			if tt.lastID != "" {
+				req.Header.Set("Last-Event-ID", tt.lastID)
+			}
+			w := httptest.NewRecorder()
+			h.handleStreamResume(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Fatalf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestOnlyListedKeyStreamsAreBuffered(t *testing.T) {
+	tests := []struct {
+		name         string
+		apiKeys      []string
+		key          string
+		wantBuffered bool
+	}{
+		{"listed key", []string{"sk-owner"}, "sk-owner", true},
+		{"anonymous", nil, "sk-made-up", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestGateway(t, &fakeLongCat{reply: "Hi"})
+			config.AppConfig.ResumeSeconds, config.AppConfig.ResumeMaxBytes = 60, 1<<20
+			config.AppConfig.APIKeys = tt.apiKeys
+
+			w := postJSON(h, "/v1/chat/completions", `{"stream": true, "messages": [{"role": "user", "content": "Hello"}]}`,
+				http.Header{"X-Api-Key": {tt.key}})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			responseID := w.Header().Get("X-Response-ID")
+			if _, buffered := h.streams.get(responseID); buffered != tt.wantBuffered {
+				t.Fatalf("stream %q buffered = %v, want %v", responseID, buffered, tt.wantBuffered)
+			}
+		})
+	}
+}
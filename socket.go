@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation; 0-2 are stdio
+const listenFDsStart = 3
+
+// activatedListener returns the listening socket inherited through systemd
+// socket activation (LISTEN_PID and LISTEN_FDS), or nil when the process was
+// not socket-activated. Only the first socket is used.
+func activatedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	// Like sd_listen_fds, keep the variables from leaking into children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(listenFDsStart, "LISTEN_FD_3")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use socket-activated fd %d: %w", listenFDsStart, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JessonChan/longcat-web-api/api"
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+// gatewayStats holds process-wide counters reported by GET /admin/stats
+type gatewayStats struct {
+	startedAt      time.Time
+	activeStreams  atomic.Int64
+	upstreamErrors atomic.Int64
+	cacheHits      atomic.Int64
+	cacheMisses    atomic.Int64
+
+	betasMu sync.Mutex
+	betas   map[string]int64 // Requests per anthropic-beta feature
+}
+
+func newGatewayStats() *gatewayStats {
+	return &gatewayStats{startedAt: time.Now(), betas: make(map[string]int64)}
+}
+
+// recordBeta counts a request for an anthropic-beta feature. Unsupported
+// features are counted together so clients cannot grow the map.
+func (s *gatewayStats) recordBeta(beta string) {
+	s.betasMu.Lock()
+	defer s.betasMu.Unlock()
+	s.betas[beta]++
+}
+
+// betaCounts returns a copy of the anthropic-beta counts
+func (s *gatewayStats) betaCounts() map[string]int64 {
+	s.betasMu.Lock()
+	defer s.betasMu.Unlock()
+	counts := make(map[string]int64, len(s.betas))
+	for beta, count := range s.betas {
+		counts[beta] = count
+	}
+	return counts
+}
+
+// StatsResponse is returned by GET /admin/stats
+type StatsResponse struct {
+	UptimeSeconds  int64                  `json:"uptime_seconds"`
+	Goroutines     int                    `json:"goroutines"`
+	ActiveStreams  int64                  `json:"active_streams"`
+	Accounts       int                    `json:"accounts"`
+	UpstreamErrors int64                  `json:"upstream_errors"`
+	CacheHits      int64                  `json:"cache_hits"`
+	CacheMisses    int64                  `json:"cache_misses"`
+	CircuitBreaker api.BreakerStats       `json:"circuit_breaker"`
+	Conversations  map[string]interface{} `json:"conversations"`
+	AnthropicBetas map[string]int64       `json:"anthropic_betas"`
+}
+
+// handleStats serves GET /admin/stats. Like the other debug endpoints it is
+// only enabled when DEBUG_API_KEY is configured.
+func (h *UnifiedHandler) handleStats(w http.ResponseWriter, r *http.Request) {
+	if config.AppConfig.DebugAPIKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isDebugAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// The gateway runs on a single LongCat account
+	accounts := 0
+	if config.CurrentCookies().PassportToken != "" {
+		accounts = 1
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatsResponse{
+		UptimeSeconds:  int64(time.Since(h.stats.startedAt).Seconds()),
+		Goroutines:     runtime.NumGoroutine(),
+		ActiveStreams:  h.stats.activeStreams.Load(),
+		Accounts:       accounts,
+		UpstreamErrors: h.stats.upstreamErrors.Load(),
+		CacheHits:      h.stats.cacheHits.Load(),
+		CacheMisses:    h.stats.cacheMisses.Load(),
+		CircuitBreaker: h.longCatClient.BreakerStats(),
+		Conversations:  h.conversationManager.GetStats(),
+		AnthropicBetas: h.stats.betaCounts(),
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+// keyStreams counts the open streams of each queueKey for MAX_STREAMS_PER_KEY
+type keyStreams struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newKeyStreams() *keyStreams {
+	return &keyStreams{active: make(map[string]int)}
+}
+
+// acquire reserves a stream for key and returns the function that releases
+// it, or false when key already has MAX_STREAMS_PER_KEY streams open
+func (s *keyStreams) acquire(key string) (func(), bool) {
+	limit := config.AppConfig.MaxStreamsPerKey
+	if limit <= 0 {
+		return func() {}, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[key] >= limit {
+		return nil, false
+	}
+	s.active[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.active[key]--; s.active[key] == 0 {
+				delete(s.active, key)
+			}
+		})
+	}, true
+}
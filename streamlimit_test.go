@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JessonChan/longcat-web-api/config"
+)
+
+func TestKeyStreams(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		steps string // Per step: a key to acquire, or - to release the oldest open stream
+		want  []bool // Whether each acquire succeeds
+	}{
+		{"unlimited", 0, "aaaa", []bool{true, true, true, true}},
+		{"limit per key", 2, "aaab", []bool{true, true, false, true}},
+		{"release frees a stream", 1, "aa-a", []bool{true, false, true}},
+		{"keys are independent", 1, "abab", []bool{true, true, false, false}},
+	}
+	saved := config.AppConfig.MaxStreamsPerKey
+	defer func() { config.AppConfig.MaxStreamsPerKey = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.MaxStreamsPerKey = tt.limit
+			s := newKeyStreams()
+			var open []func()
+			var got []bool
+			for _, step := range tt.steps {
+				if step == '-' {
+					open[0]()
+					open = open[1:]
+					continue
+				}
+				release, ok := s.acquire(string(step))
+				got = append(got, ok)
+				if ok {
+					open = append(open, release)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("acquires = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("acquires = %v, want %v", got, tt.want)
+				}
+			}
+			for _, release := range open {
+				release()
+			}
+			if len(s.active) != 0 {
+				t.Fatalf("active = %v after every release, want none", s.active)
+			}
+		})
+	}
+}
+
+func TestKeyStreamsReleaseOnce(t *testing.T) {
+	saved := config.AppConfig.MaxStreamsPerKey
+	defer func() { config.AppConfig.MaxStreamsPerKey = saved }()
+	config.AppConfig.MaxStreamsPerKey = 2
+
+	s := newKeyStreams()
+	first, _ := s.acquire("a")
+	s.acquire("a")
+	first()
+	first() // A second call must not free the other stream
+	if _, ok := s.acquire("a"); !ok {
+		t.Fatal("acquire() refused after a release")
+	}
+	if _, ok := s.acquire("a"); ok {
+		t.Fatal("acquire() allowed a third stream after a double release")
+	}
+}
+
+// A client cannot get around MAX_STREAMS_PER_KEY by sending a new key with
+// each stream: only keys listed in API_KEYS count separately
+func TestStreamLimitFollowsListedKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiKeys    []string
+		first      string // Key of the stream left open
+		second     string
+		wantStatus int
+	}{
+		{"made-up keys share the anonymous limit", nil, "sk-1", "sk-2", http.StatusTooManyRequests},
+		{"listed keys have their own limit", []string{"sk-1", "sk-2"}, "sk-1", "sk-2", http.StatusOK},
+		{"a listed key keeps its limit", []string{"sk-1", "sk-2"}, "sk-1", "sk-1", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestGateway(t, endlessLongCat{})
+			config.AppConfig.MaxStreamsPerKey = 1
+			config.AppConfig.APIKeys = tt.apiKeys
+			gateway := httptest.NewServer(h)
+			defer gateway.Close()
+
+			stream := func(ctx context.Context, key string) *http.Response {
+				req, _ := http.NewRequestWithContext(ctx, http.MethodPost, gateway.URL+"/v1/chat/completions",
+					strings.NewReader(`{"stream": true, "messages": [{"role": "user", "content": "Count"}]}`))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer "+key)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				return resp
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			first := stream(ctx, tt.first)
+			defer first.Body.Close()
+			if _, err := io.ReadFull(first.Body, make([]byte, 64)); err != nil {
+				t.Fatalf("reading the first stream: %v", err)
+			}
+
+			second := stream(ctx, tt.second)
+			second.Body.Close()
+			if second.StatusCode != tt.wantStatus {
+				t.Fatalf("second stream status = %d, want %d", second.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
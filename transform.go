@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/JessonChan/longcat-web-api/config"
+	"github.com/JessonChan/longcat-web-api/logging"
+	"github.com/JessonChan/longcat-web-api/types"
+)
+
+// promptTransform rewrites user messages with the Go text/template in
+// PROMPT_TRANSFORM_FILE before they are fingerprinted and sent to LongCat
+type promptTransform struct {
+	tmpl *template.Template
+}
+
+// promptTransformData is what the template sees for each user message
+type promptTransformData struct {
+	Content  string
+	Name     string
+	Index    int // Position of the message in the request
+	Model    string
+	Path     string
+	Metadata map[string]string
+	Header   http.Header
+}
+
+// newPromptTransform parses PROMPT_TRANSFORM_FILE, exiting on a bad template
+// so a typo is caught at startup rather than on every request
+func newPromptTransform() *promptTransform {
+	if config.AppConfig.TransformFile == "" {
+		return &promptTransform{}
+	}
+	text, err := os.ReadFile(config.AppConfig.TransformFile)
+	if err != nil {
+		log.Fatalf("Failed to read PROMPT_TRANSFORM_FILE: %v", err)
+	}
+	tmpl, err := template.New("prompt").Option("missingkey=zero").Funcs(template.FuncMap{
+		"trim":  strings.TrimSpace,
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+	}).Parse(string(text))
+	if err != nil {
+		log.Fatalf("Invalid PROMPT_TRANSFORM_FILE template: %v", err)
+	}
+	return &promptTransform{tmpl: tmpl}
+}
+
+// apply rewrites the user messages in place. Every user message is
+// transformed, not just the newest, so a replayed history still matches the
+// stored conversation. With PROMPT_TRANSFORM_ON_ERROR=passthrough a message
+// the template fails on is sent unchanged; otherwise the error is returned.
+func (t *promptTransform) apply(messages []types.Message, r *http.Request, model string, metadata map[string]string) error {
+	if t.tmpl == nil {
+		return nil
+	}
+	for i := range messages {
+		if messages[i].Role != "user" {
+			continue
+		}
+		var out strings.Builder
+		err := t.tmpl.Execute(&out, promptTransformData{
+			Content:  messages[i].Content,
+			Name:     messages[i].Name,
+			Index:    i,
+			Model:    model,
+			Path:     r.URL.Path,
+			Metadata: metadata,
+			Header:   r.Header,
+		})
+		if err != nil {
+			if config.AppConfig.TransformOnError == "passthrough" {
+				logging.LogInfo("Prompt transform failed, sending message %d unchanged: %v", i, err)
+				continue
+			}
+			return err
+		}
+		messages[i].Content = out.String()
+	}
+	return nil
+}
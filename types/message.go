@@ -3,4 +3,5 @@ package types
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	Name    string `json:"name,omitempty"` // Optional participant name on OpenAI messages
 }